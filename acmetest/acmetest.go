@@ -0,0 +1,1530 @@
+// Package acmetest implements an in-process ACME v2 server for testing.
+//
+// The server implements the directory, nonces, accounts, orders,
+// authorizations, http-01 and dns-01 challenges, finalization, certificate
+// download, revocation and account key change. It can also act as an OCSP
+// responder and publish a CRL for the certificates it issues. Challenges are really
+// validated: http-01 challenges by fetching the key authorization from a
+// configurable local address, and dns-01 challenges by querying a DNS server,
+// by default one run by the test server whose records are set by the test.
+//
+// The server listens on a local HTTPS address with a self-signed certificate.
+// Use HTTPClient to obtain a client which trusts it.
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	jose "gopkg.in/square/go-jose.v2"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server configuration.
+type Config struct {
+	// The address to which http-01 validation requests are made, whatever the
+	// identifier being validated, e.g. "127.0.0.1:5002". The Host header is
+	// the identifier. Defaults to "127.0.0.1:80".
+	HTTPAddress string
+
+	// The address of the DNS server queried to validate dns-01 challenges. If
+	// empty, the server runs its own DNS server, whose records are set using
+	// SetTXT.
+	DNSAddress string
+
+	// The validity period of issued certificates. Defaults to 90 days.
+	CertificateLifetime time.Duration
+
+	// The profiles offered, mapped to the validity period of certificates
+	// issued under them. Orders without a profile use CertificateLifetime.
+	Profiles map[string]time.Duration
+
+	// If true, challenges become valid without validation.
+	SkipValidation bool
+
+	// If true, issued certificates specify the server as their OCSP responder.
+	OCSP bool
+
+	// If true, issued certificates specify the CRL published by the server as
+	// their CRL distribution point.
+	CRL bool
+
+	// The period between the this update and next update times of OCSP
+	// responses and CRLs. Defaults to 4 days.
+	StatusLifetime time.Duration
+}
+
+// An in-process ACME v2 server.
+type Server struct {
+	cfg   Config
+	https *httptest.Server
+	dns   *dnsServer
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu             sync.Mutex
+	nextID         int
+	nonces         map[string]struct{}
+	accounts       map[string]*account
+	accountsByKey  map[string]*account // by key thumbprint
+	orders         map[string]*order
+	authorizations map[string]*authorization
+	challenges     map[string]*challenge
+	certs          map[string]*issuedCert
+	certsBySerial  map[string]*issuedCert
+	crlNumber      int64
+}
+
+type account struct {
+	ID         string
+	Key        crypto.PublicKey
+	Thumbprint string
+	Status     string
+	Contact    []string
+	Orders     []*order
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	ID             string
+	Account        *account
+	Status         string
+	Expires        time.Time
+	Identifiers    []identifier
+	Profile        string
+	Authorizations []*authorization
+	Cert           *issuedCert
+	Error          *Problem
+}
+
+type authorization struct {
+	ID         string
+	Account    *account
+	Order      *order
+	Status     string
+	Expires    time.Time
+	Identifier identifier
+	Wildcard   bool
+	Challenges []*challenge
+}
+
+type challenge struct {
+	ID            string
+	Authorization *authorization
+	Type          string
+	Token         string
+	Status        string
+	Validated     time.Time
+	Error         *Problem
+}
+
+type issuedCert struct {
+	ID        string
+	Account   *account
+	Chain     [][]byte
+	Serial    *big.Int
+	Revoked   bool
+	RevokedAt time.Time
+	Reason    int
+}
+
+// An ACME problem document.
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+const problemPrefix = "urn:ietf:params:acme:error:"
+
+func newProblem(status int, typ, format string, args ...interface{}) *Problem {
+	return &Problem{
+		Type:   problemPrefix + typ,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
+
+func malformed(format string, args ...interface{}) *Problem {
+	return newProblem(http.StatusBadRequest, "malformed", format, args...)
+}
+
+func unauthorized(format string, args ...interface{}) *Problem {
+	return newProblem(http.StatusForbidden, "unauthorized", format, args...)
+}
+
+func notFound(format string, args ...interface{}) *Problem {
+	return newProblem(http.StatusNotFound, "malformed", format, args...)
+}
+
+// Starts a new server.
+func New(cfg Config) (*Server, error) {
+	if cfg.HTTPAddress == "" {
+		cfg.HTTPAddress = "127.0.0.1:80"
+	}
+
+	if cfg.CertificateLifetime == 0 {
+		cfg.CertificateLifetime = 90 * 24 * time.Hour
+	}
+
+	if cfg.StatusLifetime == 0 {
+		cfg.StatusLifetime = 4 * 24 * time.Hour
+	}
+
+	s := &Server{
+		cfg:            cfg,
+		nonces:         map[string]struct{}{},
+		accounts:       map[string]*account{},
+		accountsByKey:  map[string]*account{},
+		orders:         map[string]*order{},
+		authorizations: map[string]*authorization{},
+		challenges:     map[string]*challenge{},
+		certs:          map[string]*issuedCert{},
+		certsBySerial:  map[string]*issuedCert{},
+	}
+
+	err := s.createCA()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DNSAddress == "" {
+		s.dns, err = newDNSServer("127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+
+		s.cfg.DNSAddress = s.dns.Addr()
+	}
+
+	s.https = httptest.NewTLSServer(s.handler())
+	return s, nil
+}
+
+// Stops the server.
+func (s *Server) Close() {
+	s.https.Close()
+	if s.dns != nil {
+		s.dns.Close()
+	}
+}
+
+// Returns the URL of the ACME directory.
+func (s *Server) DirectoryURL() string {
+	return s.https.URL + "/dir"
+}
+
+// Returns an HTTP client which trusts the server's certificate.
+func (s *Server) HTTPClient() *http.Client {
+	return s.https.Client()
+}
+
+// Returns the certificate of the CA which issues certificates.
+func (s *Server) CACertificate() *x509.Certificate {
+	return s.caCert
+}
+
+// Returns the address of the DNS server used to validate dns-01 challenges.
+func (s *Server) DNSAddress() string {
+	return s.cfg.DNSAddress
+}
+
+// Sets the TXT records for a name on the server's own DNS server, replacing
+// any existing records. With no values, removes the records.
+//
+// Records can also be set by POSTing a JSON object {"host": ..., "values":
+// [...]} to SetTXTURL, for example from a hook script.
+func (s *Server) SetTXT(name string, values ...string) {
+	if s.dns != nil {
+		s.dns.setTXT(name, values)
+	}
+}
+
+// Returns the URL used to set TXT records from outside the test process. See
+// SetTXT.
+func (s *Server) SetTXTURL() string {
+	return s.https.URL + pathSetTXT
+}
+
+// Returns whether the given certificate was issued by the server and has been
+// revoked, and if so, the reason code given.
+func (s *Server) Revoked(der []byte) (revoked bool, reason int) {
+	xc, err := x509.ParseCertificate(der)
+	if err != nil {
+		return false, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.certsBySerial[xc.SerialNumber.String()]
+	if c == nil || !c.Revoked {
+		return false, 0
+	}
+
+	return true, c.Reason
+}
+
+// Revokes a certificate issued by the server with the given reason code, as a
+// CA may do of its own accord. The revocation is reported by the OCSP
+// responder and the CRL.
+func (s *Server) Revoke(der []byte, reason int) error {
+	xc, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.certsBySerial[xc.SerialNumber.String()]
+	if c == nil {
+		return fmt.Errorf("certificate was not issued by this server")
+	}
+
+	c.Revoked = true
+	c.RevokedAt = time.Now()
+	c.Reason = reason
+	return nil
+}
+
+// Issues a certificate for the given names and public key without an order,
+// returning the certificate chain. This allows code which handles issued
+// certificates to be tested without obtaining them via ACME.
+func (s *Server) IssueCertificate(names []string, pub crypto.PublicKey) ([][]byte, error) {
+	csr := &x509.CertificateRequest{
+		Subject:   pkix.Name{CommonName: names[0]},
+		DNSNames:  names,
+		PublicKey: pub,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.issue(csr, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Chain, nil
+}
+
+// Returns the URL of the OCSP responder.
+func (s *Server) OCSPURL() string {
+	return s.https.URL + pathOCSP
+}
+
+// Returns the URL of the CRL.
+func (s *Server) CRLURL() string {
+	return s.https.URL + pathCRL
+}
+
+func (s *Server) createCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acmetest root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	s.caKey = key
+	s.caCert, err = x509.ParseCertificate(der)
+	return err
+}
+
+// Must be called with the lock held.
+func (s *Server) newID() string {
+	s.nextID++
+	return fmt.Sprintf("%d", s.nextID)
+}
+
+func (s *Server) url(path string, id string) string {
+	return s.https.URL + path + id
+}
+
+func decodeB64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func encodeB64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return encodeB64(b)
+}
+
+// Resource paths.
+const (
+	pathDirectory     = "/dir"
+	pathNonce         = "/nonce"
+	pathNewAccount    = "/new-account"
+	pathNewOrder      = "/new-order"
+	pathRevokeCert    = "/revoke-cert"
+	pathKeyChange     = "/key-change"
+	pathAccount       = "/acct/"
+	pathOrder         = "/order/"
+	pathFinalize      = "/finalize/"
+	pathAuthorization = "/authz/"
+	pathChallenge     = "/chall/"
+	pathCertificate   = "/cert/"
+	pathSetTXT        = "/set-txt"
+	pathOCSP          = "/ocsp"
+	pathCRL           = "/crl"
+)
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pathDirectory, s.handleDirectory)
+	mux.HandleFunc(pathNonce, s.handleNonce)
+	mux.HandleFunc(pathNewAccount, s.post(s.handleNewAccount))
+	mux.HandleFunc(pathNewOrder, s.post(s.handleNewOrder))
+	mux.HandleFunc(pathRevokeCert, s.post(s.handleRevokeCert))
+	mux.HandleFunc(pathKeyChange, s.post(s.handleKeyChange))
+	mux.HandleFunc(pathAccount, s.post(s.handleAccount))
+	mux.HandleFunc(pathOrder, s.post(s.handleOrder))
+	mux.HandleFunc(pathFinalize, s.post(s.handleFinalize))
+	mux.HandleFunc(pathAuthorization, s.post(s.handleAuthorization))
+	mux.HandleFunc(pathChallenge, s.post(s.handleChallenge))
+	mux.HandleFunc(pathCertificate, s.post(s.handleCertificate))
+	mux.HandleFunc(pathSetTXT, s.handleSetTXT)
+	mux.HandleFunc(pathOCSP, s.handleOCSP)
+	mux.HandleFunc(pathCRL, s.handleCRL)
+	return mux
+}
+
+// Must be called with the lock held.
+func (s *Server) issueNonce() string {
+	nonce := randomToken()
+	s.nonces[nonce] = struct{}{}
+	return nonce
+}
+
+func (s *Server) writeHeaders(w http.ResponseWriter) {
+	s.mu.Lock()
+	nonce := s.issueNonce()
+	s.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", nonce)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.DirectoryURL()))
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		s.writeProblem(w, newProblem(http.StatusInternalServerError, "serverInternal", "%v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (s *Server) writeProblem(w http.ResponseWriter, p *Problem) {
+	b, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(b)
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profiles := map[string]string{}
+	for name, lifetime := range s.cfg.Profiles {
+		profiles[name] = fmt.Sprintf("certificates valid for %v", lifetime)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   s.url(pathNonce, ""),
+		"newAccount": s.url(pathNewAccount, ""),
+		"newOrder":   s.url(pathNewOrder, ""),
+		"revokeCert": s.url(pathRevokeCert, ""),
+		"keyChange":  s.url(pathKeyChange, ""),
+		"meta": map[string]interface{}{
+			"termsOfService": s.https.URL + "/terms",
+			"profiles":       profiles,
+		},
+	})
+}
+
+func (s *Server) handleSetTXT(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		Host   string   `json:"host"`
+		Values []string `json:"values"`
+	}
+	err := json.NewDecoder(io.LimitReader(req.Body, maxRequestSize)).Decode(&payload)
+	if err != nil || payload.Host == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	s.SetTXT(payload.Host, payload.Values...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleNonce(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "HEAD":
+		s.writeHeaders(w)
+		w.WriteHeader(http.StatusOK)
+	case "GET":
+		s.writeHeaders(w)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// A verified request.
+type request struct {
+	// The URL of the request, as it appears in the JWS header.
+	URL string
+
+	// The ID of the resource, for requests to resource URLs.
+	ID string
+
+	// The payload. Empty for POST-as-GET requests.
+	Payload []byte
+
+	// The account which signed the request, if it was signed with a key ID.
+	Account *account
+
+	// The key in the JWS header, if it was signed with a JWK.
+	JWK crypto.PublicKey
+}
+
+const maxRequestSize = 1 << 16
+
+type postHandler func(w http.ResponseWriter, r *request) *Problem
+
+// Wraps a handler for a resource which is accessed by signed POST requests.
+// The nonce, URL and signature are verified before the handler is called. The
+// handler must lock the server if it accesses its state.
+func (s *Server) post(h postHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.writeHeaders(w)
+
+		r, p := s.verifyRequest(req)
+		if p == nil {
+			p = h(w, r)
+		}
+		if p != nil {
+			s.writeProblem(w, p)
+		}
+	}
+}
+
+func (s *Server) verifyRequest(req *http.Request) (*request, *Problem) {
+	if ct := req.Header.Get("Content-Type"); ct != "application/jose+json" {
+		return nil, newProblem(http.StatusUnsupportedMediaType, "malformed", "unexpected content type: %q", ct)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestSize))
+	if err != nil {
+		return nil, malformed("%v", err)
+	}
+
+	sig, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return nil, malformed("%v", err)
+	}
+
+	if len(sig.Signatures) != 1 {
+		return nil, malformed("JWS must have exactly one signature")
+	}
+
+	h := sig.Signatures[0].Protected
+	r := &request{
+		URL: s.https.URL + req.URL.Path,
+	}
+
+	if u, _ := h.ExtraHeaders["url"].(string); u != r.URL {
+		return nil, unauthorized("JWS URL %q does not match request URL %q", u, r.URL)
+	}
+
+	for _, prefix := range []string{pathAccount, pathOrder, pathFinalize, pathAuthorization, pathChallenge, pathCertificate} {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			r.ID = req.URL.Path[len(prefix):]
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nonces[h.Nonce]; !ok {
+		return nil, newProblem(http.StatusBadRequest, "badNonce", "invalid or reused nonce: %q", h.Nonce)
+	}
+	delete(s.nonces, h.Nonce)
+
+	var key crypto.PublicKey
+	switch {
+	case h.JSONWebKey != nil && h.KeyID != "":
+		return nil, malformed("JWS header contains both jwk and kid")
+
+	case h.JSONWebKey != nil:
+		if req.URL.Path != pathNewAccount && req.URL.Path != pathRevokeCert {
+			return nil, malformed("requests to %q must be signed with a key ID", req.URL.Path)
+		}
+
+		if !h.JSONWebKey.Valid() || !h.JSONWebKey.IsPublic() {
+			return nil, newProblem(http.StatusBadRequest, "badPublicKey", "invalid JWK")
+		}
+
+		key = h.JSONWebKey.Key
+		r.JWK = key
+
+	case h.KeyID != "":
+		if req.URL.Path == pathNewAccount {
+			return nil, malformed("requests to %q must be signed with a JWK", req.URL.Path)
+		}
+
+		r.Account = s.accounts[strings.TrimPrefix(h.KeyID, s.url(pathAccount, ""))]
+		if r.Account == nil || s.url(pathAccount, r.Account.ID) != h.KeyID {
+			return nil, newProblem(http.StatusBadRequest, "accountDoesNotExist", "no such account: %q", h.KeyID)
+		}
+
+		if r.Account.Status != "valid" {
+			return nil, unauthorized("account is %s", r.Account.Status)
+		}
+
+		key = r.Account.Key
+
+	default:
+		return nil, malformed("JWS header contains neither jwk nor kid")
+	}
+
+	r.Payload, err = sig.Verify(key)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "JWS verification failed: %v", err)
+	}
+
+	return r, nil
+}
+
+// Returns the base64url-encoded RFC 7638 thumbprint of a public key.
+func thumbprint(pub crypto.PublicKey) (string, error) {
+	tp, err := (&jose.JSONWebKey{Key: pub}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(tp), nil
+}
+
+func (r *request) decodePayload(v interface{}) *Problem {
+	err := json.Unmarshal(r.Payload, v)
+	if err != nil {
+		return malformed("invalid payload: %v", err)
+	}
+
+	return nil
+}
+
+// Accounts
+
+func (s *Server) accountJSON(a *account) interface{} {
+	return map[string]interface{}{
+		"status":  a.Status,
+		"contact": a.Contact,
+		"orders":  s.url(pathAccount, a.ID+"/orders"),
+	}
+}
+
+func (s *Server) handleNewAccount(w http.ResponseWriter, r *request) *Problem {
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if p := r.decodePayload(&payload); p != nil {
+		return p
+	}
+
+	tp, err := thumbprint(r.JWK)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a := s.accountsByKey[tp]; a != nil {
+		w.Header().Set("Location", s.url(pathAccount, a.ID))
+		s.writeJSON(w, http.StatusOK, s.accountJSON(a))
+		return nil
+	}
+
+	if payload.OnlyReturnExisting {
+		return newProblem(http.StatusBadRequest, "accountDoesNotExist", "no account exists with the given key")
+	}
+
+	for _, c := range payload.Contact {
+		if !strings.HasPrefix(c, "mailto:") {
+			return newProblem(http.StatusBadRequest, "unsupportedContact", "unsupported contact: %q", c)
+		}
+	}
+
+	a := &account{
+		ID:         s.newID(),
+		Key:        r.JWK,
+		Thumbprint: tp,
+		Status:     "valid",
+		Contact:    payload.Contact,
+	}
+
+	s.accounts[a.ID] = a
+	s.accountsByKey[tp] = a
+
+	w.Header().Set("Location", s.url(pathAccount, a.ID))
+	s.writeJSON(w, http.StatusCreated, s.accountJSON(a))
+	return nil
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *request) *Problem {
+	id := strings.TrimSuffix(r.ID, "/orders")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id != r.Account.ID {
+		return unauthorized("request signed by another account")
+	}
+
+	if id != r.ID {
+		var urls []string
+		for _, o := range r.Account.Orders {
+			urls = append(urls, s.url(pathOrder, o.ID))
+		}
+
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"orders": urls})
+		return nil
+	}
+
+	if len(r.Payload) > 0 {
+		var payload struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if p := r.decodePayload(&payload); p != nil {
+			return p
+		}
+
+		if payload.Contact != nil {
+			r.Account.Contact = payload.Contact
+		}
+
+		switch payload.Status {
+		case "":
+		case "deactivated":
+			r.Account.Status = "deactivated"
+		default:
+			return malformed("cannot change account status to %q", payload.Status)
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, s.accountJSON(r.Account))
+	return nil
+}
+
+func (s *Server) handleKeyChange(w http.ResponseWriter, r *request) *Problem {
+	if r.Account == nil {
+		return malformed("key change requests must be signed with a key ID")
+	}
+
+	inner, err := jose.ParseSigned(string(r.Payload))
+	if err != nil {
+		return malformed("inner JWS: %v", err)
+	}
+
+	if len(inner.Signatures) != 1 {
+		return malformed("inner JWS must have exactly one signature")
+	}
+
+	h := inner.Signatures[0].Protected
+	if h.JSONWebKey == nil || h.KeyID != "" {
+		return malformed("inner JWS must be signed with a JWK")
+	}
+
+	if u, _ := h.ExtraHeaders["url"].(string); u != r.URL {
+		return malformed("inner JWS URL %q does not match request URL", u)
+	}
+
+	if !h.JSONWebKey.Valid() || !h.JSONWebKey.IsPublic() {
+		return newProblem(http.StatusBadRequest, "badPublicKey", "invalid JWK")
+	}
+
+	newKey := h.JSONWebKey.Key
+	innerPayload, err := inner.Verify(newKey)
+	if err != nil {
+		return malformed("inner JWS verification failed: %v", err)
+	}
+
+	var payload struct {
+		Account string           `json:"account"`
+		OldKey  *jose.JSONWebKey `json:"oldKey"`
+	}
+	err = json.Unmarshal(innerPayload, &payload)
+	if err != nil || payload.OldKey == nil {
+		return malformed("invalid inner payload")
+	}
+
+	if !payload.OldKey.Valid() || !payload.OldKey.IsPublic() {
+		return malformed("invalid old key")
+	}
+
+	oldTP, _ := thumbprint(payload.OldKey.Key)
+	newTP, err := thumbprint(newKey)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := r.Account
+	if payload.Account != s.url(pathAccount, a.ID) {
+		return unauthorized("inner JWS account does not match outer JWS")
+	}
+
+	if oldTP != a.Thumbprint {
+		return unauthorized("old key is not the account key")
+	}
+
+	if other := s.accountsByKey[newTP]; other != nil {
+		w.Header().Set("Location", s.url(pathAccount, other.ID))
+		return newProblem(http.StatusConflict, "malformed", "new key is already in use by an account")
+	}
+
+	delete(s.accountsByKey, a.Thumbprint)
+	a.Key = newKey
+	a.Thumbprint = newTP
+	s.accountsByKey[newTP] = a
+
+	s.writeJSON(w, http.StatusOK, s.accountJSON(a))
+	return nil
+}
+
+// Orders
+
+func (s *Server) orderJSON(o *order) interface{} {
+	var authzURLs []string
+	for _, az := range o.Authorizations {
+		authzURLs = append(authzURLs, s.url(pathAuthorization, az.ID))
+	}
+
+	m := map[string]interface{}{
+		"status":         o.Status,
+		"expires":        o.Expires.Format(time.RFC3339),
+		"identifiers":    o.Identifiers,
+		"authorizations": authzURLs,
+		"finalize":       s.url(pathFinalize, o.ID),
+	}
+
+	if o.Profile != "" {
+		m["profile"] = o.Profile
+	}
+
+	if o.Cert != nil {
+		m["certificate"] = s.url(pathCertificate, o.Cert.ID)
+	}
+
+	if o.Error != nil {
+		m["error"] = o.Error
+	}
+
+	return m
+}
+
+func (s *Server) handleNewOrder(w http.ResponseWriter, r *request) *Problem {
+	if r.Account == nil {
+		return malformed("orders must be signed with a key ID")
+	}
+
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+		Profile     string       `json:"profile"`
+	}
+	if p := r.decodePayload(&payload); p != nil {
+		return p
+	}
+
+	if len(payload.Identifiers) == 0 {
+		return malformed("order contains no identifiers")
+	}
+
+	if _, ok := s.cfg.Profiles[payload.Profile]; payload.Profile != "" && !ok {
+		return newProblem(http.StatusBadRequest, "invalidProfile", "unknown profile: %q", payload.Profile)
+	}
+
+	seen := map[identifier]struct{}{}
+	for i, ident := range payload.Identifiers {
+		switch ident.Type {
+		case "dns":
+			ident.Value = strings.ToLower(ident.Value)
+			v := strings.TrimPrefix(ident.Value, "*.")
+			if v == "" || strings.Contains(v, "*") || net.ParseIP(v) != nil {
+				return newProblem(http.StatusBadRequest, "rejectedIdentifier", "invalid DNS identifier: %q", ident.Value)
+			}
+		case "ip":
+			ip := net.ParseIP(ident.Value)
+			if ip == nil {
+				return newProblem(http.StatusBadRequest, "rejectedIdentifier", "invalid IP identifier: %q", ident.Value)
+			}
+			ident.Value = ip.String()
+		default:
+			return newProblem(http.StatusBadRequest, "unsupportedIdentifier", "unsupported identifier type: %q", ident.Type)
+		}
+
+		if _, ok := seen[ident]; ok {
+			return malformed("duplicate identifier: %q", ident.Value)
+		}
+
+		seen[ident] = struct{}{}
+		payload.Identifiers[i] = ident
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := &order{
+		ID:          s.newID(),
+		Account:     r.Account,
+		Status:      "pending",
+		Expires:     time.Now().Add(7 * 24 * time.Hour),
+		Identifiers: payload.Identifiers,
+		Profile:     payload.Profile,
+	}
+
+	for _, ident := range o.Identifiers {
+		az := &authorization{
+			ID:         s.newID(),
+			Account:    r.Account,
+			Order:      o,
+			Status:     "pending",
+			Expires:    o.Expires,
+			Identifier: ident,
+		}
+
+		if strings.HasPrefix(ident.Value, "*.") {
+			az.Wildcard = true
+			az.Identifier.Value = ident.Value[2:]
+		}
+
+		var types []string
+		switch {
+		case ident.Type == "ip":
+			types = []string{"http-01"}
+		case az.Wildcard:
+			types = []string{"dns-01"}
+		default:
+			types = []string{"http-01", "dns-01"}
+		}
+
+		token := randomToken()
+		for _, typ := range types {
+			ch := &challenge{
+				ID:            s.newID(),
+				Authorization: az,
+				Type:          typ,
+				Token:         token,
+				Status:        "pending",
+			}
+
+			az.Challenges = append(az.Challenges, ch)
+			s.challenges[ch.ID] = ch
+		}
+
+		o.Authorizations = append(o.Authorizations, az)
+		s.authorizations[az.ID] = az
+	}
+
+	s.orders[o.ID] = o
+	r.Account.Orders = append(r.Account.Orders, o)
+
+	w.Header().Set("Location", s.url(pathOrder, o.ID))
+	s.writeJSON(w, http.StatusCreated, s.orderJSON(o))
+	return nil
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *request) *Problem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.orders[r.ID]
+	if o == nil {
+		return notFound("no such order")
+	}
+
+	if r.Account != o.Account {
+		return unauthorized("order belongs to another account")
+	}
+
+	s.writeJSON(w, http.StatusOK, s.orderJSON(o))
+	return nil
+}
+
+func (s *Server) handleFinalize(w http.ResponseWriter, r *request) *Problem {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if p := r.decodePayload(&payload); p != nil {
+		return p
+	}
+
+	der, err := decodeB64(payload.CSR)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", "invalid CSR encoding: %v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", "invalid CSR: %v", err)
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR", "invalid CSR signature: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.orders[r.ID]
+	if o == nil {
+		return notFound("no such order")
+	}
+
+	if r.Account != o.Account {
+		return unauthorized("order belongs to another account")
+	}
+
+	if o.Status != "ready" {
+		return newProblem(http.StatusForbidden, "orderNotReady", "order is %s, not ready", o.Status)
+	}
+
+	if p := checkCSRIdentifiers(csr, o.Identifiers); p != nil {
+		return p
+	}
+
+	c, err := s.issue(csr, o.Account, o.Profile)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "serverInternal", "cannot issue certificate: %v", err)
+	}
+
+	o.Cert = c
+	o.Status = "valid"
+
+	w.Header().Set("Location", s.url(pathOrder, o.ID))
+	s.writeJSON(w, http.StatusOK, s.orderJSON(o))
+	return nil
+}
+
+// Checks that the names in a CSR are exactly the identifiers of the order.
+func checkCSRIdentifiers(csr *x509.CertificateRequest, identifiers []identifier) *Problem {
+	want := map[identifier]struct{}{}
+	for _, ident := range identifiers {
+		want[ident] = struct{}{}
+	}
+
+	got := map[identifier]struct{}{}
+	for _, name := range csr.DNSNames {
+		got[identifier{"dns", strings.ToLower(name)}] = struct{}{}
+	}
+	for _, ip := range csr.IPAddresses {
+		got[identifier{"ip", ip.String()}] = struct{}{}
+	}
+	if cn := csr.Subject.CommonName; cn != "" {
+		ident := identifier{"dns", strings.ToLower(cn)}
+		if ip := net.ParseIP(cn); ip != nil {
+			ident = identifier{"ip", ip.String()}
+		}
+
+		if _, ok := got[ident]; !ok {
+			return newProblem(http.StatusBadRequest, "badCSR", "CSR common name %q is not among its names", cn)
+		}
+	}
+
+	if len(got) != len(want) {
+		return newProblem(http.StatusBadRequest, "badCSR", "CSR names do not match order identifiers")
+	}
+
+	for ident := range got {
+		if _, ok := want[ident]; !ok {
+			return newProblem(http.StatusBadRequest, "badCSR", "CSR contains name %q not in order", ident.Value)
+		}
+	}
+
+	return nil
+}
+
+// Must be called with the lock held.
+func (s *Server) issue(csr *x509.CertificateRequest, a *account, profile string) (*issuedCert, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	names := append([]string(nil), csr.DNSNames...)
+	sort.Strings(names)
+
+	lifetime := s.cfg.CertificateLifetime
+	if profile != "" {
+		lifetime = s.cfg.Profiles[profile]
+	}
+
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     names,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if s.cfg.OCSP {
+		tpl.OCSPServer = []string{s.OCSPURL()}
+	}
+
+	if s.cfg.CRL {
+		tpl.CRLDistributionPoints = []string{s.CRLURL()}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256(der)
+	c := &issuedCert{
+		ID:      hex.EncodeToString(h[:8]),
+		Account: a,
+		Chain:   [][]byte{der, s.caCert.Raw},
+		Serial:  serial,
+	}
+
+	s.certs[c.ID] = c
+	s.certsBySerial[serial.String()] = c
+	return c, nil
+}
+
+func (s *Server) handleCertificate(w http.ResponseWriter, r *request) *Problem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.certs[r.ID]
+	if c == nil {
+		return notFound("no such certificate")
+	}
+
+	if r.Account != c.Account {
+		return unauthorized("certificate belongs to another account")
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	for _, der := range c.Chain {
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+
+	return nil
+}
+
+func (s *Server) handleRevokeCert(w http.ResponseWriter, r *request) *Problem {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if p := r.decodePayload(&payload); p != nil {
+		return p
+	}
+
+	der, err := decodeB64(payload.Certificate)
+	if err != nil {
+		return malformed("invalid certificate encoding: %v", err)
+	}
+
+	xc, err := x509.ParseCertificate(der)
+	if err != nil {
+		return malformed("invalid certificate: %v", err)
+	}
+
+	if payload.Reason < 0 || payload.Reason > 10 || payload.Reason == 7 {
+		return newProblem(http.StatusBadRequest, "badRevocationReason", "invalid reason code: %d", payload.Reason)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.certsBySerial[xc.SerialNumber.String()]
+	if c == nil || string(c.Chain[0]) != string(der) {
+		return notFound("certificate was not issued by this server")
+	}
+
+	if r.Account != nil {
+		if r.Account != c.Account && !s.accountControlsNames(r.Account, xc) {
+			return unauthorized("account is not authorized to revoke this certificate")
+		}
+	} else {
+		tpCert, err := thumbprint(xc.PublicKey)
+		tpReq, _ := thumbprint(r.JWK)
+		if err != nil || tpCert != tpReq {
+			return unauthorized("request must be signed by the account or the certificate key")
+		}
+	}
+
+	if c.Revoked {
+		return newProblem(http.StatusBadRequest, "alreadyRevoked", "certificate is already revoked")
+	}
+
+	c.Revoked = true
+	c.RevokedAt = time.Now()
+	c.Reason = payload.Reason
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// Returns true if the account has valid authorizations for all the names in
+// the certificate. Must be called with the lock held.
+func (s *Server) accountControlsNames(a *account, xc *x509.Certificate) bool {
+	valid := map[identifier]struct{}{}
+	for _, az := range s.authorizations {
+		if az.Account == a && az.Status == "valid" {
+			ident := az.Identifier
+			if az.Wildcard {
+				ident.Value = "*." + ident.Value
+			}
+			valid[ident] = struct{}{}
+		}
+	}
+
+	for _, name := range xc.DNSNames {
+		if _, ok := valid[identifier{"dns", name}]; !ok {
+			return false
+		}
+	}
+
+	for _, ip := range xc.IPAddresses {
+		if _, ok := valid[identifier{"ip", ip.String()}]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Authorizations and challenges
+
+func (s *Server) challengeJSON(ch *challenge) interface{} {
+	m := map[string]interface{}{
+		"type":   ch.Type,
+		"url":    s.url(pathChallenge, ch.ID),
+		"token":  ch.Token,
+		"status": ch.Status,
+	}
+
+	if !ch.Validated.IsZero() {
+		m["validated"] = ch.Validated.Format(time.RFC3339)
+	}
+
+	if ch.Error != nil {
+		m["error"] = ch.Error
+	}
+
+	return m
+}
+
+func (s *Server) authorizationJSON(az *authorization) interface{} {
+	var challenges []interface{}
+	for _, ch := range az.Challenges {
+		challenges = append(challenges, s.challengeJSON(ch))
+	}
+
+	m := map[string]interface{}{
+		"identifier": az.Identifier,
+		"status":     az.Status,
+		"expires":    az.Expires.Format(time.RFC3339),
+		"challenges": challenges,
+	}
+
+	if az.Wildcard {
+		m["wildcard"] = true
+	}
+
+	return m
+}
+
+func (s *Server) handleAuthorization(w http.ResponseWriter, r *request) *Problem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	az := s.authorizations[r.ID]
+	if az == nil {
+		return notFound("no such authorization")
+	}
+
+	if r.Account != az.Account {
+		return unauthorized("authorization belongs to another account")
+	}
+
+	if len(r.Payload) > 0 {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if p := r.decodePayload(&payload); p != nil {
+			return p
+		}
+
+		if payload.Status != "deactivated" {
+			return malformed("cannot change authorization status to %q", payload.Status)
+		}
+
+		az.Status = "deactivated"
+		s.updateOrder(az.Order)
+	}
+
+	s.writeJSON(w, http.StatusOK, s.authorizationJSON(az))
+	return nil
+}
+
+func (s *Server) handleChallenge(w http.ResponseWriter, r *request) *Problem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := s.challenges[r.ID]
+	if ch == nil {
+		return notFound("no such challenge")
+	}
+
+	az := ch.Authorization
+	if r.Account != az.Account {
+		return unauthorized("challenge belongs to another account")
+	}
+
+	// A POST with a payload other than the empty one of POST-as-GET is a
+	// request to validate the challenge.
+	if len(r.Payload) > 0 && ch.Status == "pending" {
+		if az.Status != "pending" {
+			return malformed("authorization is %s", az.Status)
+		}
+
+		ch.Status = "processing"
+		go s.validate(ch, r.Account.Thumbprint)
+	}
+
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"up\"", s.url(pathAuthorization, az.ID)))
+	s.writeJSON(w, http.StatusOK, s.challengeJSON(ch))
+	return nil
+}
+
+// Validates a challenge and updates the challenge, its authorization and its
+// order with the result.
+func (s *Server) validate(ch *challenge, accountThumbprint string) {
+	keyAuthorization := ch.Token + "." + accountThumbprint
+
+	var p *Problem
+	if !s.cfg.SkipValidation {
+		s.mu.Lock()
+		ident := ch.Authorization.Identifier
+		s.mu.Unlock()
+
+		switch ch.Type {
+		case "http-01":
+			p = s.validateHTTP(ident, ch.Token, keyAuthorization)
+		case "dns-01":
+			p = s.validateDNS(ident, keyAuthorization)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	az := ch.Authorization
+	if p != nil {
+		ch.Status = "invalid"
+		ch.Error = p
+		az.Status = "invalid"
+	} else {
+		ch.Status = "valid"
+		ch.Validated = time.Now()
+		az.Status = "valid"
+	}
+
+	s.updateOrder(az.Order)
+}
+
+// Updates the status of a pending order from the status of its
+// authorizations. Must be called with the lock held.
+func (s *Server) updateOrder(o *order) {
+	if o.Status != "pending" {
+		return
+	}
+
+	ready := true
+	for _, az := range o.Authorizations {
+		switch az.Status {
+		case "valid":
+		case "pending":
+			ready = false
+		default:
+			o.Status = "invalid"
+			o.Error = unauthorized("authorization for %q is %s", az.Identifier.Value, az.Status)
+			return
+		}
+	}
+
+	if ready {
+		o.Status = "ready"
+	}
+}
+
+// Answers OCSP requests (RFC 6960) made using POST. Responses are signed by
+// the CA.
+func (s *Server) handleOCSP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, 64*1024))
+	if err != nil {
+		return
+	}
+
+	oreq, err := ocsp.ParseRequest(b)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	now := time.Now()
+	tpl := ocsp.Response{
+		SerialNumber: oreq.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(s.cfg.StatusLifetime),
+	}
+
+	s.mu.Lock()
+	c := s.certsBySerial[oreq.SerialNumber.String()]
+	switch {
+	case c == nil:
+		tpl.Status = ocsp.Unknown
+	case c.Revoked:
+		tpl.Status = ocsp.Revoked
+		tpl.RevokedAt = c.RevokedAt
+		tpl.RevocationReason = c.Reason
+	default:
+		tpl.Status = ocsp.Good
+	}
+	s.mu.Unlock()
+
+	der, err := ocsp.CreateResponse(s.caCert, s.caCert, tpl, s.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(der)
+}
+
+// Serves a CRL listing the revoked certificates, signed by the CA.
+func (s *Server) handleCRL(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	tpl := &x509.RevocationList{
+		ThisUpdate: now,
+		NextUpdate: now.Add(s.cfg.StatusLifetime),
+	}
+
+	s.mu.Lock()
+	s.crlNumber++
+	tpl.Number = big.NewInt(s.crlNumber)
+	for _, c := range s.certs {
+		if c.Revoked {
+			tpl.RevokedCertificateEntries = append(tpl.RevokedCertificateEntries, x509.RevocationListEntry{
+				SerialNumber:   c.Serial,
+				RevocationTime: c.RevokedAt,
+				ReasonCode:     c.Reason,
+			})
+		}
+	}
+	s.mu.Unlock()
+
+	der, err := x509.CreateRevocationList(rand.Reader, tpl, s.caCert, s.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(der)
+}
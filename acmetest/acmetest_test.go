@@ -0,0 +1,471 @@
+package acmetest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"golang.org/x/crypto/ocsp"
+	jose "gopkg.in/square/go-jose.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal ACME client for exercising the server.
+type testClient struct {
+	t   *testing.T
+	s   *Server
+	key *ecdsa.PrivateKey
+	kid string
+}
+
+func (c *testClient) nonce() string {
+	res, err := c.s.HTTPClient().Head(c.s.url(pathNonce, ""))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.Header.Get("Replay-Nonce")
+}
+
+type staticNonce string
+
+func (n staticNonce) Nonce() (string, error) {
+	return string(n), nil
+}
+
+// Signs a payload with a P-256 key. The JWK is embedded in the protected
+// header if kid is empty. No nonce is included if nonce is empty.
+func signJWS(key *ecdsa.PrivateKey, nonce, url, kid string, payload []byte) []byte {
+	opts := &jose.SignerOptions{
+		EmbedJWK:     kid == "",
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"url": url},
+	}
+	if nonce != "" {
+		opts.NonceSource = staticNonce(nonce)
+	}
+	if kid != "" {
+		opts.ExtraHeaders["kid"] = kid
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		panic(err)
+	}
+
+	return []byte(sig.FullSerialize())
+}
+
+// Makes a signed request. payload is marshalled as JSON unless it is nil, in
+// which case the request is a POST-as-GET, or a []byte. The request is signed
+// with the JWK if the client has no account yet.
+func (c *testClient) post(url string, payload interface{}) (*http.Response, []byte) {
+	var pb []byte
+	switch p := payload.(type) {
+	case nil:
+	case []byte:
+		pb = p
+	default:
+		pb, _ = json.Marshal(p)
+	}
+
+	b := signJWS(c.key, c.nonce(), url, c.kid, pb)
+	res, err := c.s.HTTPClient().Post(url, "application/jose+json", bytes.NewReader(b))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return res, body
+}
+
+func (c *testClient) postJSON(url string, payload interface{}, status int, v interface{}) *http.Response {
+	res, body := c.post(url, payload)
+	if res.StatusCode != status {
+		c.t.Fatalf("%s: got status %d, expected %d: %s", url, res.StatusCode, status, body)
+	}
+
+	if v != nil {
+		err := json.Unmarshal(body, v)
+		if err != nil {
+			c.t.Fatalf("%s: %v", url, err)
+		}
+	}
+
+	return res
+}
+
+func (c *testClient) expectProblem(url string, payload interface{}, problemType string) {
+	res, body := c.post(url, payload)
+	var p Problem
+	json.Unmarshal(body, &p)
+	if res.StatusCode < 400 || p.Type != problemPrefix+problemType {
+		c.t.Fatalf("%s: got status %d, problem %q, expected %q", url, res.StatusCode, p.Type, problemType)
+	}
+}
+
+type testOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type testAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+func (c *testClient) waitOrder(url string, status string) *testOrder {
+	for i := 0; i < 100; i++ {
+		var o testOrder
+		c.postJSON(url, nil, http.StatusOK, &o)
+		if o.Status == status {
+			return &o
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	c.t.Fatalf("order %s did not become %s", url, status)
+	return nil
+}
+
+// Serves http-01 key authorizations.
+type httpResponder struct {
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func (h *httpResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ka, ok := h.keys[strings.TrimPrefix(req.URL.Path, "/.well-known/acme-challenge/")]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Write([]byte(ka))
+}
+
+func (h *httpResponder) set(token, ka string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys[token] = ka
+}
+
+func newTestServer(t *testing.T) (*Server, *httpResponder) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &httpResponder{keys: map[string]string{}}
+	hs := &http.Server{Handler: h}
+	go hs.Serve(ln)
+	t.Cleanup(func() { hs.Close() })
+
+	s, err := New(Config{HTTPAddress: ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	return s, h
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testClient{t: t, s: s, key: key}
+	res := c.postJSON(s.url(pathNewAccount, ""), map[string]interface{}{"termsOfServiceAgreed": true}, http.StatusCreated, nil)
+	c.kid = res.Header.Get("Location")
+	return c
+}
+
+func TestIssuance(t *testing.T) {
+	s, h := newTestServer(t)
+	c := newTestClient(t, s)
+
+	// Registering the same key again returns the existing account.
+	kid := c.kid
+	c.kid = ""
+	res := c.postJSON(s.url(pathNewAccount, ""), map[string]interface{}{}, http.StatusOK, nil)
+	if res.Header.Get("Location") != kid {
+		t.Fatalf("got account %q, expected %q", res.Header.Get("Location"), kid)
+	}
+	c.kid = kid
+
+	thumb, _ := thumbprint(&c.key.PublicKey)
+
+	var o testOrder
+	res = c.postJSON(s.url(pathNewOrder, ""), map[string]interface{}{
+		"identifiers": []identifier{{"dns", "example.com"}, {"dns", "www.example.com"}},
+	}, http.StatusCreated, &o)
+	orderURL := res.Header.Get("Location")
+
+	for _, azURL := range o.Authorizations {
+		var az testAuthorization
+		c.postJSON(azURL, nil, http.StatusOK, &az)
+
+		// Use http-01 for example.com and dns-01 for www.example.com.
+		for _, ch := range az.Challenges {
+			ka := ch.Token + "." + thumb
+			switch {
+			case ch.Type == "http-01" && az.Identifier.Value == "example.com":
+				h.set(ch.Token, ka)
+			case ch.Type == "dns-01" && az.Identifier.Value == "www.example.com":
+				d := sha256.Sum256([]byte(ka))
+				s.SetTXT("_acme-challenge.www.example.com", encodeB64(d[:]))
+			default:
+				continue
+			}
+
+			c.postJSON(ch.URL, map[string]interface{}{}, http.StatusOK, nil)
+		}
+	}
+
+	c.waitOrder(orderURL, "ready")
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "example.com"},
+		DNSNames: []string{"example.com", "www.example.com"},
+	}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.postJSON(o.Finalize, map[string]interface{}{"csr": encodeB64(csr)}, http.StatusOK, nil)
+	vo := c.waitOrder(orderURL, "valid")
+
+	res, body := c.post(vo.Certificate, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("certificate download failed: %d", res.StatusCode)
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil {
+		t.Fatal("no certificate in response")
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.CACertificate())
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the account key.
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	inner := signJWS(newKey, "", s.url(pathKeyChange, ""), "", mustMarshal(map[string]interface{}{
+		"account": c.kid,
+		"oldKey":  &jose.JSONWebKey{Key: &c.key.PublicKey},
+	}))
+	c.postJSON(s.url(pathKeyChange, ""), inner, http.StatusOK, nil)
+
+	oldKey := c.key
+	c.key = newKey
+	c.postJSON(c.kid, nil, http.StatusOK, nil)
+
+	c.key, c.kid = oldKey, ""
+	c.expectProblem(s.url(pathNewAccount, ""), map[string]interface{}{"onlyReturnExisting": true}, "accountDoesNotExist")
+	c.key, c.kid = newKey, kid
+
+	// Revoke the certificate.
+	revoke := map[string]interface{}{"certificate": encodeB64(leaf.Raw), "reason": 4}
+	c.postJSON(s.url(pathRevokeCert, ""), revoke, http.StatusOK, nil)
+	if revoked, reason := s.Revoked(leaf.Raw); !revoked || reason != 4 {
+		t.Fatalf("certificate not revoked: %v %d", revoked, reason)
+	}
+
+	c.expectProblem(s.url(pathRevokeCert, ""), revoke, "alreadyRevoked")
+}
+
+func TestFailedValidation(t *testing.T) {
+	s, h := newTestServer(t)
+	c := newTestClient(t, s)
+
+	var o testOrder
+	res := c.postJSON(s.url(pathNewOrder, ""), map[string]interface{}{
+		"identifiers": []identifier{{"dns", "example.com"}},
+	}, http.StatusCreated, &o)
+	orderURL := res.Header.Get("Location")
+
+	var az testAuthorization
+	c.postJSON(o.Authorizations[0], nil, http.StatusOK, &az)
+	for _, ch := range az.Challenges {
+		if ch.Type == "http-01" {
+			h.set(ch.Token, "wrong")
+			c.postJSON(ch.URL, map[string]interface{}{}, http.StatusOK, nil)
+		}
+	}
+
+	c.waitOrder(orderURL, "invalid")
+
+	// Finalizing an order which is not ready fails.
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"example.com"},
+	}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.expectProblem(o.Finalize, map[string]interface{}{"csr": encodeB64(csr)}, "orderNotReady")
+
+	// Requests signed by another account are refused.
+	other := newTestClient(t, s)
+	other.expectProblem(orderURL, nil, "unauthorized")
+}
+
+func (s *Server) testOCSPStatus(t *testing.T, leaf *x509.Certificate) *ocsp.Response {
+	req, err := ocsp.CreateRequest(leaf, s.CACertificate(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.HTTPClient().Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ores, err := ocsp.ParseResponseForCert(b, leaf, s.CACertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ores
+}
+
+func (s *Server) testCRL(t *testing.T) *x509.RevocationList {
+	res, err := s.HTTPClient().Get(s.CRLURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = crl.CheckSignatureFrom(s.CACertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return crl
+}
+
+// Certificates revoked by the CA are reported as revoked by the OCSP
+// responder and listed in the CRL.
+func TestRevocationStatus(t *testing.T) {
+	s, err := New(Config{OCSP: true, CRL: true, StatusLifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := s.IssueCertificate([]string{"example.com"}, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leaf.OCSPServer) != 1 || leaf.OCSPServer[0] != s.OCSPURL() ||
+		len(leaf.CRLDistributionPoints) != 1 || leaf.CRLDistributionPoints[0] != s.CRLURL() {
+		t.Fatalf("certificate does not specify OCSP responder and CRL: %v, %v", leaf.OCSPServer, leaf.CRLDistributionPoints)
+	}
+
+	ores := s.testOCSPStatus(t, leaf)
+	if ores.Status != ocsp.Good || ores.NextUpdate.Sub(ores.ThisUpdate) != time.Hour {
+		t.Fatalf("unexpected OCSP response: %+v", ores)
+	}
+
+	crl := s.testCRL(t)
+	if len(crl.RevokedCertificateEntries) != 0 || crl.NextUpdate.Sub(crl.ThisUpdate) != time.Hour {
+		t.Fatalf("unexpected CRL: %+v", crl)
+	}
+
+	err = s.Revoke(chain[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ores = s.testOCSPStatus(t, leaf)
+	if ores.Status != ocsp.Revoked || ores.RevocationReason != 1 {
+		t.Fatalf("unexpected OCSP response: %+v", ores)
+	}
+
+	crl2 := s.testCRL(t)
+	if len(crl2.RevokedCertificateEntries) != 1 || crl2.RevokedCertificateEntries[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 ||
+		crl2.RevokedCertificateEntries[0].ReasonCode != 1 || crl2.Number.Cmp(crl.Number) <= 0 {
+		t.Fatalf("unexpected CRL: %+v", crl2)
+	}
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,184 @@
+package acmetest
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+)
+
+// A minimal authoritative DNS server which answers TXT queries from records
+// set by the test, for the purposes of dns-01 validation. Queries for other
+// types, or names without records, are answered with no records.
+type dnsServer struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func newDNSServer(addr string) (*dnsServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &dnsServer{
+		conn:    conn,
+		records: map[string][]string{},
+	}
+
+	go ds.serve()
+	return ds, nil
+}
+
+func (ds *dnsServer) Addr() string {
+	return ds.conn.LocalAddr().String()
+}
+
+func (ds *dnsServer) Close() error {
+	return ds.conn.Close()
+}
+
+func canonicalDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (ds *dnsServer) setTXT(name string, values []string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	name = canonicalDNSName(name)
+	if len(values) == 0 {
+		delete(ds.records, name)
+		return
+	}
+
+	ds.records[name] = append([]string(nil), values...)
+}
+
+func (ds *dnsServer) txt(name string) []string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return ds.records[canonicalDNSName(name)]
+}
+
+func (ds *dnsServer) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := ds.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			return
+		}
+
+		res := ds.answer(buf[:n])
+		if res != nil {
+			ds.conn.WriteTo(res, addr)
+		}
+	}
+}
+
+const (
+	dnsTypeTXT  = 16
+	dnsClassIN  = 1
+	dnsRcodeErr = 1 // FORMERR
+)
+
+// Returns the response to a DNS query message, or nil if it cannot be parsed
+// well enough to respond.
+func (ds *dnsServer) answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+
+	id := binary.BigEndian.Uint16(q[0:2])
+	flags := binary.BigEndian.Uint16(q[2:4])
+	qdcount := binary.BigEndian.Uint16(q[4:6])
+
+	// QR set, opcode zero, AA set, RD copied from the query.
+	resFlags := uint16(0x8400) | flags&0x0100
+
+	res := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(res[0:2], id)
+
+	name, qtype, qclass, end, ok := parseDNSQuestion(q)
+	if flags&0x8000 != 0 || flags&0x7800 != 0 || qdcount != 1 || !ok {
+		binary.BigEndian.PutUint16(res[2:4], resFlags|dnsRcodeErr)
+		return res
+	}
+
+	binary.BigEndian.PutUint16(res[2:4], resFlags)
+	binary.BigEndian.PutUint16(res[4:6], 1)
+	res = append(res, q[12:end]...)
+
+	if qtype != dnsTypeTXT || qclass != dnsClassIN {
+		return res
+	}
+
+	values := ds.txt(name)
+	binary.BigEndian.PutUint16(res[6:8], uint16(len(values)))
+	for _, v := range values {
+		var rdata []byte
+		for {
+			chunk := v
+			if len(chunk) > 255 {
+				chunk = chunk[:255]
+			}
+
+			rdata = append(rdata, byte(len(chunk)))
+			rdata = append(rdata, chunk...)
+			v = v[len(chunk):]
+			if v == "" {
+				break
+			}
+		}
+
+		// Pointer to the name in the question, type, class, TTL zero and data.
+		rr := make([]byte, 12, 12+len(rdata))
+		rr[0], rr[1] = 0xC0, 12
+		binary.BigEndian.PutUint16(rr[2:4], dnsTypeTXT)
+		binary.BigEndian.PutUint16(rr[4:6], dnsClassIN)
+		binary.BigEndian.PutUint16(rr[10:12], uint16(len(rdata)))
+		res = append(res, append(rr, rdata...)...)
+	}
+
+	return res
+}
+
+// Parses the question of a DNS query, which must not use name compression.
+// Returns the offset of the end of the question.
+func parseDNSQuestion(q []byte) (name string, qtype, qclass uint16, end int, ok bool) {
+	var labels []string
+	i := 12
+	for {
+		if i >= len(q) {
+			return
+		}
+
+		n := int(q[i])
+		i++
+		if n == 0 {
+			break
+		}
+
+		if n&0xC0 != 0 || i+n > len(q) {
+			return
+		}
+
+		labels = append(labels, string(q[i:i+n]))
+		i += n
+	}
+
+	if i+4 > len(q) {
+		return
+	}
+
+	qtype = binary.BigEndian.Uint16(q[i : i+2])
+	qclass = binary.BigEndian.Uint16(q[i+2 : i+4])
+	return strings.Join(labels, "."), qtype, qclass, i + 4, true
+}
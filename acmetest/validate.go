@@ -0,0 +1,92 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const validationTimeout = 10 * time.Second
+
+// Validates an http-01 challenge by fetching the key authorization from
+// HTTPAddress.
+func (s *Server) validateHTTP(ident identifier, token, keyAuthorization string) *Problem {
+	host := ident.Value
+	if ident.Type == "ip" && strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	dialer := &net.Dialer{Timeout: validationTimeout}
+	cl := &http.Client{
+		Timeout: validationTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, s.cfg.HTTPAddress)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	u := "http://" + host + "/.well-known/acme-challenge/" + token
+	res, err := cl.Get(u)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "connection", "fetching %s: %v", u, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return unauthorized("fetching %s: status %d", u, res.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "connection", "fetching %s: %v", u, err)
+	}
+
+	if got := strings.TrimSpace(string(b)); got != keyAuthorization {
+		return newProblem(http.StatusForbidden, "incorrectResponse", "fetching %s: key authorization %q does not match %q", u, got, keyAuthorization)
+	}
+
+	return nil
+}
+
+// Validates a dns-01 challenge by looking up the TXT records of the
+// _acme-challenge name using the DNS server at DNSAddress.
+func (s *Server) validateDNS(ident identifier, keyAuthorization string) *Problem {
+	h := sha256.Sum256([]byte(keyAuthorization))
+	expected := encodeB64(h[:])
+
+	dialer := &net.Dialer{Timeout: validationTimeout}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "udp", s.cfg.DNSAddress)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), validationTimeout)
+	defer cancel()
+
+	name := "_acme-challenge." + ident.Value + "."
+	values, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return unauthorized("no TXT records found for %s", name)
+		}
+
+		return newProblem(http.StatusBadRequest, "dns", "looking up TXT records for %s: %v", name, err)
+	}
+
+	for _, v := range values {
+		if v == expected {
+			return nil
+		}
+	}
+
+	return unauthorized("no TXT record for %s matches %q", name, expected)
+}
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/storageops"
+)
+
+// Applies the manifest, printing the changes made. Returns true if any
+// changes were made.
+func cmdApply() bool {
+	var b []byte
+	var err error
+	if *applyFileFlag == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(*applyFileFlag)
+	}
+	log.Fatale(err, "cannot read manifest")
+
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	changes, err := storageops.PlanApply(s, b, *applyOwnerFlag)
+	log.Fatale(err, "apply")
+
+	for _, c := range changes {
+		fmt.Print(c.Diff())
+	}
+
+	if len(changes) == 0 || *applyDryRunFlag {
+		return false
+	}
+
+	err = storageops.Apply(s, changes)
+	log.Fatale(err, "apply")
+
+	return true
+}
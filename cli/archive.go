@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/storageops"
+)
+
+func cmdExport() {
+	cfg := storageops.ExportConfig{
+		ExcludeKeys:     *exportExcludeKeysFlag,
+		ExcludeAccounts: *exportExcludeAccountsFlag,
+	}
+
+	if *exportPassphraseFileFlag != "" {
+		var err error
+		cfg.Passphrase, err = readPassphraseFile(*exportPassphraseFileFlag)
+		log.Fatale(err, "passphrase")
+	}
+
+	if *exportOutputFlag == "-" {
+		err := exportState(os.Stdout, *exportOutputFlag, cfg)
+		log.Fatale(err, "export")
+		return
+	}
+
+	err := exportStateToFile(*exportOutputFlag, cfg)
+	log.Fatale(err, "export")
+}
+
+// The archive is written to a temporary file which is renamed into place once
+// it is complete, so that a failed export does not leave a partial archive
+// behind.
+func exportStateToFile(path string, cfg storageops.ExportConfig) error {
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%q already exists", path)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	err = exportState(f, path, cfg)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Writes the archive to w, compressed according to filename.
+func exportState(w io.Writer, filename string, cfg storageops.ExportConfig) error {
+	cw, wait, err := compressWriter(filename, w)
+	if err != nil {
+		return err
+	}
+
+	err = storageops.ExportState(*stateFlag, cw, cfg)
+	closeErr := cw.Close()
+	waitErr := wait()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = waitErr
+	}
+
+	return err
+}
+
+// Reads a passphrase from a file, ignoring a trailing newline.
+func readPassphraseFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) == 0 {
+		return nil, fmt.Errorf("passphrase file %q is empty", path)
+	}
+
+	return b, nil
+}
+
+func cmdImportState() {
+	var r io.Reader = os.Stdin
+	if *importStateArg != "-" {
+		f, err := os.Open(*importStateArg)
+		log.Fatale(err, "open archive")
+		defer f.Close()
+		r = f
+	}
+
+	dr, wait, err := decompressReader(*importStateArg, r)
+	log.Fatale(err, "decompress archive")
+
+	var cfg storageops.ImportConfig
+	if *importStatePassphraseFileFlag != "" {
+		cfg.Passphrase, err = readPassphraseFile(*importStatePassphraseFileFlag)
+		log.Fatale(err, "passphrase")
+	}
+
+	err = storageops.ImportState(*stateFlag, dr, cfg)
+	log.Fatale(err, "import")
+
+	// Consume any trailing padding so that a decompressor can exit.
+	_, err = io.Copy(ioutil.Discard, dr)
+	log.Fatale(err, "decompress archive")
+
+	err = wait()
+	log.Fatale(err, "decompress archive")
+
+	// Opening the store verifies the imported state directory and enforces the
+	// configured permissions.
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	err = storageops.Relink(s)
+	log.Fatale(err, "relink")
+}
+
+// Archives are compressed according to their filename extension. gzip is
+// supported natively; zstd requires the zstd command to be installed.
+func compressWriter(filename string, w io.Writer) (io.WriteCloser, func() error, error) {
+	switch {
+	case strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".tgz"):
+		return gzip.NewWriter(w), noWait, nil
+	case strings.HasSuffix(filename, ".zst"):
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		cw, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = cmd.Start()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return cw, cmd.Wait, nil
+	default:
+		return nopWriteCloser{w}, noWait, nil
+	}
+}
+
+func decompressReader(filename string, r io.Reader) (io.Reader, func() error, error) {
+	switch {
+	case strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".tgz"):
+		gr, err := gzip.NewReader(r)
+		return gr, noWait, err
+	case strings.HasSuffix(filename, ".zst"):
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = r
+		cmd.Stderr = os.Stderr
+		dr, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = cmd.Start()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return dr, cmd.Wait, nil
+	default:
+		return r, noWait, nil
+	}
+}
+
+func noWait() error {
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
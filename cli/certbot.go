@@ -0,0 +1,309 @@
+package cli
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/storageops"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// Imports the accounts, renewal configurations, certificates and keys of a
+// Certbot configuration directory (usually /etc/letsencrypt). Each renewal
+// configuration becomes a target named after the certificate lineage.
+//
+// Certbot does not record the order a certificate was obtained with, so the
+// certificates are imported as external certificates, which cannot be revoked
+// via ACME by acmetool.
+func cmdImportCertbot() {
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	err = importCertbotAccounts(s, filepath.Join(*importCertbotArg, "accounts"))
+	log.Fatale(err, "import accounts")
+
+	renewalConfs, err := filepath.Glob(filepath.Join(*importCertbotArg, "renewal", "*.conf"))
+	log.Fatale(err, "list renewal configurations")
+
+	for _, fn := range renewalConfs {
+		err := importCertbotRenewal(s, *importCertbotArg, fn)
+		log.Errore(err, "failed to import renewal configuration ", fn)
+	}
+
+	err = storageops.Relink(s)
+	log.Fatale(err, "relink")
+}
+
+// Certbot stores account keys as JWKs at
+// accounts/(server host)/(server path)/(account ID)/private_key.json.
+func importCertbotAccounts(s storage.Store, accountsPath string) error {
+	return filepath.Walk(accountsPath, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || fi.Name() != "private_key.json" {
+			return err
+		}
+
+		rpath, err := filepath.Rel(accountsPath, filepath.Dir(filepath.Dir(path)))
+		if err != nil {
+			return err
+		}
+
+		directoryURL := "https://" + filepath.ToSlash(rpath)
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		k := jose.JsonWebKey{}
+		err = k.UnmarshalJSON(b)
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal account key %q: %v", path, err)
+		}
+
+		a, err := s.ImportAccount(directoryURL, k.Key)
+		if err != nil {
+			return err
+		}
+
+		log.Noticef("imported account %v", a)
+		return nil
+	})
+}
+
+func importCertbotRenewal(s storage.Store, configDir, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conf, err := parseCertbotConf(f)
+	if err != nil {
+		return err
+	}
+
+	lineage := strings.TrimSuffix(filepath.Base(fn), ".conf")
+	if s.TargetByFilename(lineage) != nil {
+		log.Noticef("target %q already exists, not importing %q", lineage, fn)
+		return nil
+	}
+
+	// Import the key and certificate first, so that the target is satisfied
+	// immediately and nothing is reissued.
+	err = importKey(s, certbotPath(conf, configDir, conf[".privkey"]))
+	if err != nil {
+		return fmt.Errorf("cannot import private key: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(certbotPath(conf, configDir, conf[".fullchain"]))
+	if err != nil {
+		return err
+	}
+
+	certs, err := acmeutils.LoadCertificates(b)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.ImportExternalCertificate(certs)
+	if err != nil {
+		return err
+	}
+
+	xcrt, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return err
+	}
+
+	tgt, err := certbotTarget(conf, storageops.CertificateNames(xcrt))
+	if err != nil {
+		return err
+	}
+
+	tgt.Filename = lineage
+	err = s.SaveTarget(tgt)
+	if err != nil {
+		return err
+	}
+
+	log.Noticef("imported %q as target %q with certificate %v", fn, lineage, c)
+	return nil
+}
+
+// Renewal configurations contain absolute paths under the configuration
+// directory Certbot was using when they were written, which need not be the
+// directory being imported, e.g. when importing a copy of /etc/letsencrypt.
+// That directory is the grandparent of the archive directory of the lineage.
+// Paths under it are rebased onto configDir.
+func certbotPath(conf map[string]string, configDir, p string) string {
+	if !filepath.IsAbs(p) {
+		return filepath.Join(configDir, p)
+	}
+
+	origDir := "/etc/letsencrypt"
+	if archiveDir := conf[".archive_dir"]; archiveDir != "" {
+		origDir = filepath.Dir(filepath.Dir(archiveDir))
+	}
+
+	rel, err := filepath.Rel(origDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+
+	return filepath.Join(configDir, rel)
+}
+
+// Converts a parsed Certbot renewal configuration to an equivalent target.
+func certbotTarget(conf map[string]string, names []string) (*storage.Target, error) {
+	tgt := &storage.Target{
+		Satisfy: storage.TargetSatisfy{
+			Names: names,
+		},
+	}
+
+	tr := &tgt.Request
+	tr.Provider = conf["renewalparams.server"]
+
+	switch conf["renewalparams.key_type"] {
+	case "", "rsa":
+		if sz := conf["renewalparams.rsa_key_size"]; sz != "" {
+			n, err := strconv.Atoi(sz)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RSA key size: %q", sz)
+			}
+			tr.Key.Type = "rsa"
+			tr.Key.RSASize = n
+		}
+	case "ecdsa":
+		tr.Key.Type = "ecdsa"
+		switch conf["renewalparams.elliptic_curve"] {
+		case "", "secp256r1":
+			tr.Key.ECDSACurve = "nistp256"
+		case "secp384r1":
+			tr.Key.ECDSACurve = "nistp384"
+		case "secp521r1":
+			tr.Key.ECDSACurve = "nistp521"
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve: %q", conf["renewalparams.elliptic_curve"])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type: %q", conf["renewalparams.key_type"])
+	}
+
+	tr.OCSPMustStaple = parseCertbotBool(conf["renewalparams.must_staple"])
+
+	switch authenticator := conf["renewalparams.authenticator"]; authenticator {
+	case "webroot":
+		// acmetool's webroot paths are the challenge directories themselves.
+		// Certbot may additionally map names to different webroots, so take the
+		// union of all of them.
+		seen := map[string]struct{}{}
+		addWebroot := func(p string) {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				return
+			}
+			p = filepath.Join(p, ".well-known", "acme-challenge")
+			if _, ok := seen[p]; !ok {
+				seen[p] = struct{}{}
+				tr.Challenge.WebrootPaths = append(tr.Challenge.WebrootPaths, p)
+			}
+		}
+
+		for _, p := range strings.Split(conf["renewalparams.webroot_path"], ",") {
+			addWebroot(p)
+		}
+		// Sorted so that the webroot paths are in the same order every time.
+		var mapKeys []string
+		for k := range conf {
+			if strings.HasPrefix(k, "renewalparams.webroot_map.") {
+				mapKeys = append(mapKeys, k)
+			}
+		}
+
+		sort.Strings(mapKeys)
+		for _, k := range mapKeys {
+			addWebroot(conf[k])
+		}
+
+	case "standalone":
+		if port := conf["renewalparams.http01_port"]; port != "" && port != "None" {
+			tr.Challenge.HTTPPorts = []string{port}
+		}
+
+	default:
+		log.Warnf("certbot authenticator %q cannot be converted automatically; configure webroot paths, the redirector or DNS hooks so that names %v can be validated", authenticator, names)
+	}
+
+	return tgt, nil
+}
+
+func parseCertbotBool(s string) bool {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on", "1":
+		return true
+	default:
+		return false
+	}
+}
+
+// Parses the subset of the configobj format used by Certbot renewal
+// configuration files. Keys are qualified by the sections they are in, e.g.
+// "renewalparams.server"; keys outside any section are prefixed with ".".
+func parseCertbotConf(r io.Reader) (map[string]string, error) {
+	conf := map[string]string{}
+	var sections []string
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			depth := 0
+			for depth < len(line) && line[depth] == '[' {
+				depth++
+			}
+
+			name := strings.TrimSpace(strings.Trim(line, "[]"))
+			if name == "" || depth > len(sections)+1 {
+				return nil, fmt.Errorf("line %d: malformed section header: %q", lineNo, line)
+			}
+
+			sections = append(sections[0:depth-1], name)
+			continue
+		}
+
+		idx := strings.IndexByte(line, '=')
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value: %q", lineNo, line)
+		}
+
+		k := strings.TrimSpace(line[0:idx])
+		v := strings.Trim(strings.TrimSpace(line[idx+1:]), `"'`)
+		conf[strings.Join(sections, ".")+"."+k] = v
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
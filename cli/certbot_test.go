@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+const testCertbotConf = `# renew_before_expiry = 30 days
+version = 1.21.0
+archive_dir = /etc/letsencrypt/archive/example.com
+cert = /etc/letsencrypt/live/example.com/cert.pem
+privkey = /etc/letsencrypt/live/example.com/privkey.pem
+fullchain = /etc/letsencrypt/live/example.com/fullchain.pem
+
+# Options used in the renewal process
+[renewalparams]
+account = 0123456789abcdef0123456789abcdef
+authenticator = webroot
+webroot_path = /var/www/html,
+server = https://acme-v02.api.letsencrypt.org/directory
+key_type = ecdsa
+elliptic_curve = secp384r1
+must_staple = True
+[[webroot_map]]
+example.com = /var/www/html
+www.example.com = /var/www/www
+b.example.com = /var/www/b
+a.example.com = /var/www/a
+`
+
+func TestCertbotConf(t *testing.T) {
+	conf, err := parseCertbotConf(strings.NewReader(testCertbotConf))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for k, v := range map[string]string{
+		".privkey":                    "/etc/letsencrypt/live/example.com/privkey.pem",
+		"renewalparams.authenticator": "webroot",
+		"renewalparams.webroot_map.www.example.com": "/var/www/www",
+	} {
+		if conf[k] != v {
+			t.Fatalf("mismatch for %q: %q != %q", k, conf[k], v)
+		}
+	}
+
+	for _, configDir := range []string{"/etc/letsencrypt", "/tmp/letsencrypt"} {
+		p := certbotPath(conf, configDir, conf[".privkey"])
+		if p != configDir+"/live/example.com/privkey.pem" {
+			t.Fatalf("path not rebased onto %q: %q", configDir, p)
+		}
+	}
+
+	tgt, err := certbotTarget(conf, []string{"example.com", "www.example.com"})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if tgt.Request.Key.Type != "ecdsa" || tgt.Request.Key.ECDSACurve != "nistp384" || !tgt.Request.OCSPMustStaple {
+		t.Fatalf("key settings not converted: %#v", tgt.Request)
+	}
+
+	if tgt.Request.Provider != "https://acme-v02.api.letsencrypt.org/directory" {
+		t.Fatalf("provider not converted: %q", tgt.Request.Provider)
+	}
+
+	// The webroot paths come in a consistent order: webroot_path, then the
+	// webroot map by name.
+	webrootPaths := []string{"/var/www/html", "/var/www/a", "/var/www/b", "/var/www/www"}
+	if len(tgt.Request.Challenge.WebrootPaths) != len(webrootPaths) {
+		t.Fatalf("webroot paths not converted: %#v", tgt.Request.Challenge.WebrootPaths)
+	}
+
+	for i, p := range webrootPaths {
+		if tgt.Request.Challenge.WebrootPaths[i] != p+"/.well-known/acme-challenge" {
+			t.Fatalf("webroot paths not converted: %#v", tgt.Request.Challenge.WebrootPaths)
+		}
+	}
+}
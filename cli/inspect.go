@@ -0,0 +1,434 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/storageops"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+)
+
+type targetInfo struct {
+	Filename   string   `json:"filename"`
+	PackedFrom string   `json:"packed_from,omitempty"`
+	Names      []string `json:"names"`
+	Label      string   `json:"label,omitempty"`
+	Priority   int      `json:"priority"`
+	Template   string   `json:"template,omitempty"`
+	Provider   string   `json:"provider,omitempty"`
+	Providers  []string `json:"providers,omitempty"`
+	KeyTypes   []string `json:"key_types,omitempty"`
+
+	// The best certificate for each key type requested.
+	Certificates []string `json:"certificates,omitempty"`
+}
+
+type certificateInfo struct {
+	ID       string `json:"id"`
+	URL      string `json:"url,omitempty"`
+	External bool   `json:"external,omitempty"`
+	Cached   bool   `json:"cached"`
+	Account  string `json:"account,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Key      string `json:"key,omitempty"`
+	KeyType  string `json:"key_type,omitempty"`
+	KeySize  int    `json:"key_size,omitempty"`
+
+	Subject      string     `json:"subject,omitempty"`
+	Names        []string   `json:"names,omitempty"`
+	Serial       string     `json:"serial,omitempty"`
+	Issuer       string     `json:"issuer,omitempty"`
+	NotBefore    *time.Time `json:"not_before,omitempty"`
+	NotAfter     *time.Time `json:"not_after,omitempty"`
+	ChainIssuers []string   `json:"chain_issuers,omitempty"`
+	OCSPResponse bool       `json:"ocsp_response,omitempty"`
+
+	RevocationDesired bool   `json:"revocation_desired,omitempty"`
+	RevocationReason  string `json:"revocation_reason,omitempty"`
+	Revoked           bool   `json:"revoked,omitempty"`
+
+	// Targets for which this is the best certificate, and the live hostnames
+	// linked to it.
+	Targets   []string `json:"targets,omitempty"`
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+type keyInfo struct {
+	ID           string     `json:"id"`
+	Type         string     `json:"type"`
+	Size         int        `json:"size"`
+	Created      *time.Time `json:"created,omitempty"`
+	Compromised  bool       `json:"compromised,omitempty"`
+	Certificates []string   `json:"certificates,omitempty"`
+}
+
+type accountInfo struct {
+	ID           string   `json:"id"`
+	Label        string   `json:"label,omitempty"`
+	DirectoryURL string   `json:"directory_url"`
+	Thumbprint   string   `json:"thumbprint,omitempty"`
+	Certificates []string `json:"certificates,omitempty"`
+}
+
+func cmdList() {
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	var items []interface{}
+	switch *listKindArg {
+	case "targets":
+		for _, t := range sortedTargets(s) {
+			items = append(items, makeTargetInfo(s, t))
+		}
+
+	case "certs":
+		var certs []*storage.Certificate
+		s.VisitCertificates(func(c *storage.Certificate) error {
+			certs = append(certs, c)
+			return nil
+		})
+
+		sort.Slice(certs, func(i, j int) bool {
+			return certs[i].ID() < certs[j].ID()
+		})
+
+		certTargets := certificateTargets(s)
+		for _, c := range certs {
+			items = append(items, makeCertificateInfo(s, c, certTargets))
+		}
+
+	case "keys":
+		var keys []*storage.Key
+		s.VisitKeys(func(k *storage.Key) error {
+			keys = append(keys, k)
+			return nil
+		})
+
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].ID < keys[j].ID
+		})
+
+		for _, k := range keys {
+			items = append(items, makeKeyInfo(s, k))
+		}
+
+	case "accounts":
+		for _, a := range sortedAccounts(s) {
+			items = append(items, makeAccountInfo(s, a))
+		}
+	}
+
+	if *listJSONFlag {
+		if items == nil {
+			items = []interface{}{}
+		}
+
+		writeJSON(os.Stdout, items)
+		return
+	}
+
+	for _, item := range items {
+		fmt.Println(summarizeInfo(item))
+	}
+}
+
+func cmdShow() {
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	item := resolveShowSpec(s, *showArg)
+	if item == nil {
+		log.Fatalf("no certificate, key, account, target or hostname matches %q", *showArg)
+	}
+
+	if *showJSONFlag {
+		writeJSON(os.Stdout, item)
+		return
+	}
+
+	writeInfoText(os.Stdout, item)
+}
+
+// Finds the object identified by spec, which can be a certificate, key or
+// account ID, an account label, a target filename or a hostname with a
+// preferred certificate.
+func resolveShowSpec(s storage.Store, spec string) interface{} {
+	if c := s.CertificateByID(spec); c != nil {
+		return makeCertificateInfo(s, c, certificateTargets(s))
+	}
+
+	if k := s.KeyByID(spec); k != nil {
+		return makeKeyInfo(s, k)
+	}
+
+	if a := s.AccountByID(spec); a != nil {
+		return makeAccountInfo(s, a)
+	}
+
+	if a := s.AccountByLabel(spec, ""); a != nil {
+		return makeAccountInfo(s, a)
+	}
+
+	if t := s.TargetByFilename(spec); t != nil {
+		return makeTargetInfo(s, t)
+	}
+
+	hostname, err := storage.NormalizeName(spec)
+	if err == nil {
+		if c, err := s.PreferredCertificateForHostname(hostname); err == nil {
+			return makeCertificateInfo(s, c, certificateTargets(s))
+		}
+	}
+
+	return nil
+}
+
+func sortedTargets(s storage.Store) []*storage.Target {
+	var targets []*storage.Target
+	s.VisitTargets(func(t *storage.Target) error {
+		targets = append(targets, t)
+		return nil
+	})
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Filename < targets[j].Filename
+	})
+
+	return targets
+}
+
+func makeTargetInfo(s storage.Store, t *storage.Target) *targetInfo {
+	ti := &targetInfo{
+		Filename:   t.Filename,
+		PackedFrom: t.PackedFrom,
+		Names:      t.Satisfy.Names,
+		Label:      t.Label,
+		Priority:   t.Priority,
+		Template:   t.Template,
+		Provider:   t.Request.Provider,
+		Providers:  t.Request.Providers,
+		KeyTypes:   t.Request.Key.Types,
+	}
+
+	// A pack target is not itself satisfied by any certificate.
+	if t.Pack.IsSet() {
+		return ti
+	}
+
+	for _, tv := range t.KeyTypeVariants() {
+		c, err := storageops.FindBestCertificateSatisfying(s, tv)
+		if err == nil {
+			ti.Certificates = append(ti.Certificates, c.ID())
+		}
+	}
+
+	return ti
+}
+
+// Returns the filenames of the targets for which each certificate is the best
+// certificate, in order.
+func certificateTargets(s storage.Store) map[*storage.Certificate][]string {
+	targetCertificates, err := storageops.TargetCertificates(s)
+	log.Errore(err, "cannot determine the best certificate for each target")
+
+	certTargets := map[*storage.Certificate][]string{}
+	for t, certs := range targetCertificates {
+		seen := map[*storage.Certificate]struct{}{}
+		for _, c := range certs {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				certTargets[c] = append(certTargets[c], t.Filename)
+			}
+		}
+	}
+
+	for _, filenames := range certTargets {
+		sort.Strings(filenames)
+	}
+
+	return certTargets
+}
+
+func makeCertificateInfo(s storage.Store, c *storage.Certificate, certTargets map[*storage.Certificate][]string) *certificateInfo {
+	ci := &certificateInfo{
+		ID:                c.ID(),
+		URL:               c.URL,
+		External:          c.External,
+		Cached:            c.Cached,
+		Provider:          c.Provider,
+		OCSPResponse:      len(c.OCSPResponse) > 0,
+		RevocationDesired: c.RevocationDesired,
+		Revoked:           c.Revoked,
+	}
+
+	if c.RevocationDesired || c.Revoked {
+		ci.RevocationReason = storageops.RevocationReasonName(c.RevocationReason)
+	}
+
+	if c.Account != nil {
+		ci.Account = c.Account.ID()
+	}
+
+	if c.Key != nil {
+		ci.Key = c.Key.ID
+		ci.KeyType, ci.KeySize = keyTypeAndSize(c.Key)
+	}
+
+	if len(c.Certificates) > 0 {
+		xcrt, err := x509.ParseCertificate(c.Certificates[0])
+		if err == nil {
+			ci.Subject = xcrt.Subject.String()
+			ci.Names = storageops.CertificateNames(xcrt)
+			ci.Serial = fmt.Sprintf("%x", xcrt.SerialNumber)
+			ci.Issuer = xcrt.Issuer.String()
+			ci.NotBefore = &xcrt.NotBefore
+			ci.NotAfter = &xcrt.NotAfter
+		}
+
+		for _, der := range c.Certificates[1:] {
+			xc, err := x509.ParseCertificate(der)
+			if err == nil {
+				ci.ChainIssuers = append(ci.ChainIssuers, xc.Issuer.String())
+			}
+		}
+	}
+
+	ci.Targets = certTargets[c]
+
+	s.VisitPreferredCertificates(func(hostname string, pc *storage.Certificate) error {
+		if pc == c {
+			ci.Hostnames = append(ci.Hostnames, hostname)
+		}
+		return nil
+	})
+	sort.Strings(ci.Hostnames)
+
+	return ci
+}
+
+func makeKeyInfo(s storage.Store, k *storage.Key) *keyInfo {
+	ki := &keyInfo{
+		ID:          k.ID,
+		Compromised: k.Compromised,
+	}
+
+	if !k.Created.IsZero() {
+		ki.Created = &k.Created
+	}
+
+	ki.Type, ki.Size = keyTypeAndSize(k)
+
+	for _, c := range storageops.CertificatesUsingKey(s, k) {
+		ki.Certificates = append(ki.Certificates, c.ID())
+	}
+	sort.Strings(ki.Certificates)
+
+	return ki
+}
+
+func makeAccountInfo(s storage.Store, a *storage.Account) *accountInfo {
+	ai := &accountInfo{
+		ID:           a.ID(),
+		Label:        a.Label,
+		DirectoryURL: a.DirectoryURL,
+	}
+
+	ai.Thumbprint, _ = acmeutils.Base64Thumbprint(a.PrivateKey)
+
+	s.VisitCertificates(func(c *storage.Certificate) error {
+		if c.Account == a {
+			ai.Certificates = append(ai.Certificates, c.ID())
+		}
+		return nil
+	})
+	sort.Strings(ai.Certificates)
+
+	return ai
+}
+
+func keyTypeAndSize(k *storage.Key) (string, int) {
+	switch pk := k.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return "rsa", pk.N.BitLen()
+	case *ecdsa.PrivateKey:
+		return "ecdsa", pk.Curve.Params().BitSize
+	default:
+		return k.Type(), 0
+	}
+}
+
+// Returns a one-line summary of an object for list output.
+func summarizeInfo(item interface{}) string {
+	switch v := item.(type) {
+	case *targetInfo:
+		return fmt.Sprintf("%s\t%s", v.Filename, strings.Join(v.Names, ","))
+	case *certificateInfo:
+		var flags []string
+		if !v.Cached {
+			flags = append(flags, "not-downloaded")
+		}
+		if v.RevocationDesired {
+			flags = append(flags, "revocation-desired")
+		}
+		if v.Revoked {
+			flags = append(flags, "revoked")
+		}
+		expiry := ""
+		if v.NotAfter != nil {
+			expiry = v.NotAfter.Format("2006-01-02")
+		}
+		return strings.TrimSpace(fmt.Sprintf("%s\t%s\t%s\t%s", v.ID, strings.Join(v.Names, ","), expiry, strings.Join(flags, ",")))
+	case *keyInfo:
+		compromised := ""
+		if v.Compromised {
+			compromised = "\tcompromised"
+		}
+		return fmt.Sprintf("%s\t%s-%d%s", v.ID, v.Type, v.Size, compromised)
+	case *accountInfo:
+		return strings.TrimSpace(fmt.Sprintf("%s\t%s\t%s", v.ID, v.DirectoryURL, v.Label))
+	default:
+		return fmt.Sprintf("%v", item)
+	}
+}
+
+// Writes the non-empty fields of an object for show output, one per line,
+// using the same field names as the JSON output.
+func writeInfoText(w io.Writer, item interface{}) {
+	v := reflect.ValueOf(item).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fv := v.Field(i)
+		if fv.IsZero() {
+			continue
+		}
+
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		switch x := fv.Interface().(type) {
+		case []string:
+			fmt.Fprintf(w, "%s:\n", name)
+			for _, s := range x {
+				fmt.Fprintf(w, "  %s\n", s)
+			}
+		case *time.Time:
+			fmt.Fprintf(w, "%s: %s\n", name, x.Format(time.RFC3339))
+		default:
+			fmt.Fprintf(w, "%s: %v\n", name, x)
+		}
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	log.Fatale(err, "marshal")
+
+	fmt.Fprintf(w, "%s\n", b)
+}
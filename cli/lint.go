@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hlandau/acmetool/storage"
+)
+
+func cmdLint() {
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	numProblems := 0
+
+	specs := *lintArg
+	if len(specs) == 0 {
+		// The default target is checked too, since its settings are inherited by
+		// every target.
+		b, err := ioutil.ReadFile(filepath.Join(s.Path(), "conf", "target"))
+		if err == nil {
+			for _, p := range s.LintDefaultTarget(b) {
+				fmt.Fprintf(os.Stderr, "%v\n", p)
+				numProblems++
+			}
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "conf/target: %v\n", err)
+			numProblems++
+		}
+
+		fis, err := ioutil.ReadDir(filepath.Join(s.Path(), "desired"))
+		log.Fatale(err, "cannot list targets")
+
+		for _, fi := range fis {
+			if !fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+				specs = append(specs, fi.Name())
+			}
+		}
+	}
+
+	for _, spec := range specs {
+		problems, err := lintTarget(s, spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", spec, err)
+			numProblems++
+			continue
+		}
+
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "%v\n", p)
+		}
+
+		numProblems += len(problems)
+	}
+
+	if numProblems > 0 {
+		os.Exit(1)
+	}
+}
+
+// Lints a target given as a filename in the desired directory or as a path to
+// a target file, which need not be in the desired directory.
+func lintTarget(s storage.Store, spec string) ([]*storage.TargetProblem, error) {
+	path := spec
+	origin := spec
+	if !strings.ContainsRune(spec, filepath.Separator) {
+		path = filepath.Join(s.Path(), "desired", spec)
+		origin = "desired/" + spec
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.LintTarget(filepath.Base(path), origin, b), nil
+}
@@ -3,12 +3,17 @@ package cli
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hlandau/acmetool/hooks"
 	"github.com/hlandau/acmetool/interaction"
@@ -49,13 +54,25 @@ var (
 
 	responseFileFlag = kingpin.Flag("response-file", "Read dialog responses from the given file (default: $ACME_STATE_DIR/conf/responses)").ExistingFile()
 
+	timeoutFlag = kingpin.Flag("timeout", "Give up reconciling after this long, cleaning up any challenges in progress (e.g. '30m'; default: no limit)").Duration()
+
 	reconcileCmd     = kingpin.Command("reconcile", reconcileHelp).Default()
-	reconcileSpecArg = reconcileCmd.Arg("target-filenames", "optionally, specify one or more target file paths or filenames to reconcile only those targets").Strings()
+	reconcileSpecArg = reconcileCmd.Arg("target-filenames", "optionally, specify one or more target file paths, filenames or hostnames to reconcile only those targets").Strings()
+
+	renewCmd                  = kingpin.Command("renew", "Renew certificates for the given targets, optionally before they need renewing")
+	renewSpecArg              = renewCmd.Arg("hostname-or-target", "Hostnames, target filenames or target file paths selecting the targets to renew (default: all targets, unless --force is given)").Strings()
+	renewForceFlag            = renewCmd.Flag("force", "Request new certificates for the selected targets even if the current ones are valid").Bool()
+	renewIfExpiringWithinFlag = renewCmd.Flag("if-expiring-within", "Request new certificates for the selected targets whose certificates expire within this period (e.g. '10d')").PlaceHolder("DAYS").String()
 
-	cullCmd          = kingpin.Command("cull", "Delete expired, unused certificates")
-	cullSimulateFlag = cullCmd.Flag("simulate", "Show which certificates would be deleted without deleting any").Short('n').Bool()
+	ocspCmd = kingpin.Command("ocsp", "Fetch OCSP responses for preferred certificates which need them, without reconciling")
 
-	statusCmd = kingpin.Command("status", "Show active configuration")
+	cullCmd                = kingpin.Command("cull", "Delete expired, unused certificates and unused keys")
+	cullSimulateFlag       = cullCmd.Flag("simulate", "Show which certificates and keys would be deleted without deleting any").Short('n').Bool()
+	cullKeyGracePeriodFlag = cullCmd.Flag("key-grace-period", "Do not delete unused keys created more recently than this (e.g. '30d')").Default("30d").String()
+	cullEraseKeysFlag      = cullCmd.Flag("erase-keys", "Overwrite private key files before deleting them").Bool()
+
+	statusCmd         = kingpin.Command("status", "Show active configuration")
+	statusExplainFlag = statusCmd.Flag("explain", "Show the settings of the given target and the file each came from").PlaceHolder("TARGET").String()
 
 	wantCmd       = kingpin.Command("want", "Add a target with one or more hostnames")
 	wantReconcile = wantCmd.Flag("reconcile", "Specify --no-reconcile to skip reconcile after adding target").Default("1").Bool()
@@ -89,19 +106,54 @@ var (
 	importKeyCmd = kingpin.Command("import-key", "Import a certificate private key")
 	importKeyArg = importKeyCmd.Arg("private-key-file", "Path to PEM-encoded private key").Required().ExistingFile()
 
-	importLECmd = kingpin.Command("import-le", "Import a Let's Encrypt client state directory")
-	importLEArg = importLECmd.Arg("le-state-path", "Path to Let's Encrypt state directory").Default("/etc/letsencrypt").ExistingDir()
+	exportCmd                 = kingpin.Command("export", "Export the state directory to an archive, e.g. for moving to another host")
+	exportOutputFlag          = exportCmd.Flag("output", "Path of the archive to create; compressed if ending in .gz or .zst ('-' for stdout)").Short('o').Required().String()
+	exportExcludeKeysFlag     = exportCmd.Flag("exclude-keys", "Do not include private keys").Bool()
+	exportExcludeAccountsFlag = exportCmd.Flag("exclude-accounts", "Do not include account keys").Bool()
+	exportPassphraseFileFlag  = exportCmd.Flag("passphrase-file", "Encrypt private keys with the passphrase in the given file").ExistingFile()
+
+	importStateCmd                = kingpin.Command("import-state", "Import a state directory archive created by export into an empty state directory")
+	importStateArg                = importStateCmd.Arg("archive", "Path to the archive; decompressed if ending in .gz or .zst ('-' for stdin)").Required().String()
+	importStatePassphraseFileFlag = importStateCmd.Flag("passphrase-file", "Decrypt private keys with the passphrase in the given file").ExistingFile()
 
-	// Arguments we should probably support for revocation:
+	importCertCmd     = kingpin.Command("import-cert", "Import a certificate not obtained via ACME, e.g. when migrating from another CA")
+	importCertArg     = importCertCmd.Arg("fullchain-file", "Path to PEM-encoded certificate, followed by any chain certificates").Required().ExistingFile()
+	importCertKeyFlag = importCertCmd.Flag("key", "Path to PEM-encoded private key for the certificate, if not already imported").ExistingFile()
+
+	importCertbotCmd = kingpin.Command("import-certbot", "Import accounts, renewal configurations, certificates and keys from a Certbot configuration directory. The certificates are imported as external certificates, so acmetool cannot revoke them; use Certbot to revoke them if necessary").Alias("import-le")
+	importCertbotArg = importCertbotCmd.Arg("certbot-config-path", "Path to Certbot configuration directory").Default("/etc/letsencrypt").ExistingDir()
+
+	// Revocation can be requested by:
 	//   A certificate ID
-	//   A key ID
-	//   A path to a PEM-encoded certificate - TODO
-	//   A path to a PEM-encoded private key (revoke all known certificates with that key) - TODO
-	//   A path to a certificate directory - TODO
-	//   A path to a key directory - TODO
-	//   A certificate URL - TODO
-	revokeCmd = kingpin.Command("revoke", "Revoke a certificate")
-	revokeArg = revokeCmd.Arg("certificate-id-or-path", "Certificate ID to revoke").String()
+	//   A key ID (revoke all known certificates with that key)
+	//   A path to a PEM-encoded certificate
+	//   A path to a PEM-encoded private key (revoke all known certificates with that key)
+	//   A path to a certificate directory (including a live/ symlink)
+	//   A path to a key directory
+	//   A certificate (order) URL
+	revokeCmd        = kingpin.Command("revoke", "Revoke a certificate")
+	revokeArg        = revokeCmd.Arg("certificate-id-or-path", "Certificate or key ID, path to a certificate, key, certificate directory or key directory, or certificate URL").Required().String()
+	revokeReasonFlag = revokeCmd.Flag("reason", "Revocation reason (e.g. keyCompromise, superseded, cessationOfOperation)").Default("unspecified").String()
+
+	compromiseKeyCmd = kingpin.Command("compromise-key", "Revoke all certificates using a compromised private key, prevent its further use and obtain replacement certificates")
+	compromiseKeyArg = compromiseKeyCmd.Arg("key-id-or-path", "Key ID, or path to a private key or key directory").Required().String()
+
+	applyCmd           = kingpin.Command("apply", "Create, update or remove targets to match a manifest listing all targets it manages")
+	applyFileFlag      = applyCmd.Flag("file", "Path to the manifest ('-' for stdin)").Short('f').Required().String()
+	applyOwnerFlag     = applyCmd.Flag("owner", "Owner recorded in the targets managed by the manifest, allowing several manifests to be used").Default(storageops.DefaultManifestOwner).String()
+	applyDryRunFlag    = applyCmd.Flag("dry-run", "Show the changes which would be made without making them").Short('n').Bool()
+	applyReconcileFlag = applyCmd.Flag("reconcile", "Specify --no-reconcile to skip reconcile after applying the manifest").Default("1").Bool()
+
+	listCmd      = kingpin.Command("list", "List targets, certificates, keys or accounts")
+	listKindArg  = listCmd.Arg("kind", "What to list: targets, certs, keys or accounts").Required().Enum("targets", "certs", "keys", "accounts")
+	listJSONFlag = listCmd.Flag("json", "Output JSON").Bool()
+
+	showCmd      = kingpin.Command("show", "Show details of a certificate, key, account or target, or the certificate for a hostname")
+	showArg      = showCmd.Arg("id-or-name", "Certificate, key or account ID, target filename or hostname").Required().String()
+	showJSONFlag = showCmd.Flag("json", "Output JSON").Bool()
+
+	lintCmd = kingpin.Command("lint", "Check target files for errors, exiting unsuccessfully if any are found")
+	lintArg = lintCmd.Arg("target", "Target filenames in the desired directory or paths to target files (default: all targets)").Strings()
 
 	accountThumbprintCmd = kingpin.Command("account-thumbprint", "Prints account thumbprints")
 
@@ -156,6 +208,10 @@ func Main() {
 	switch cmd {
 	case "reconcile":
 		cmdReconcile()
+	case "renew":
+		cmdRenew()
+	case "ocsp":
+		cmdOCSP()
 	case "cull":
 		cmdCull()
 	case "status":
@@ -181,10 +237,30 @@ func Main() {
 		cmdImportJWKAccount()
 	case "import-pem-account":
 		cmdImportPEMAccount()
+	case "import-cert":
+		cmdImportCert()
+	case "import-certbot":
+		cmdImportCertbot()
+	case "export":
+		cmdExport()
+	case "import-state":
+		cmdImportState()
 	case "revoke":
 		cmdRevoke()
+	case "compromise-key":
+		cmdCompromiseKey()
 	case "account-url":
 		cmdAccountURL()
+	case "lint":
+		cmdLint()
+	case "list":
+		cmdList()
+	case "show":
+		cmdShow()
+	case "apply":
+		if cmdApply() && *applyReconcileFlag {
+			cmdReconcile()
+		}
 	}
 }
 
@@ -233,21 +309,143 @@ func cmdImportKey() {
 	log.Fatale(err, "import key")
 }
 
+func cmdImportCert() {
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	b, err := ioutil.ReadFile(*importCertArg)
+	log.Fatale(err, "cannot read certificate file")
+
+	certs, err := acmeutils.LoadCertificates(b)
+	log.Fatale(err, "cannot parse certificates")
+
+	if len(certs) == 0 {
+		log.Fatalf("no certificates found in %q", *importCertArg)
+	}
+
+	xcrt, err := x509.ParseCertificate(certs[0])
+	log.Fatale(err, "cannot parse certificate")
+
+	keyID, err := storage.DetermineKeyIDFromPublicKey(xcrt.PublicKey)
+	log.Fatale(err, "cannot determine key ID")
+
+	if *importCertKeyFlag != "" {
+		b, err := ioutil.ReadFile(*importCertKeyFlag)
+		log.Fatale(err, "cannot read private key file")
+
+		pk, err := acmeutils.LoadPrivateKey(b)
+		log.Fatale(err, "cannot parse private key")
+
+		k, err := s.ImportKey(pk)
+		log.Fatale(err, "cannot import private key")
+
+		if k.ID != keyID {
+			log.Fatalf("private key %q does not match certificate (key ID %q)", k.ID, keyID)
+		}
+	} else if s.KeyByID(keyID) == nil {
+		log.Fatalf("the private key for the certificate (key ID %q) has not been imported; specify it using --key", keyID)
+	}
+
+	c, err := s.ImportExternalCertificate(certs)
+	log.Fatale(err, "cannot import certificate")
+
+	fmt.Printf("%s\n", c.ID())
+
+	err = storageops.Relink(s)
+	log.Fatale(err, "relink")
+}
+
+// Returns the context to reconcile under. It is cancelled on SIGINT or
+// SIGTERM, or when the time given by --timeout has elapsed, so that
+// challenges in progress are cleaned up before exiting.
+func reconcileContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if *timeoutFlag > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigChan:
+			log.Warnf("received %v, cleaning up", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigChan)
+	}()
+
+	return ctx, cancel
+}
+
 func cmdReconcile() {
 	s, err := storage.NewFDB(*stateFlag)
 	log.Fatale(err, "storage")
 
-	err = storageops.Reconcile(s, storageops.ReconcileConfig{
+	ctx, cancel := reconcileContext()
+	defer cancel()
+
+	err = storageops.Reconcile(ctx, s, storageops.ReconcileConfig{
 		Targets: *reconcileSpecArg,
 	})
 	log.Fatale(err, "reconcile")
 }
 
+func cmdRenew() {
+	cfg := storageops.ReconcileConfig{
+		Targets:      *renewSpecArg,
+		ForceRenewal: *renewForceFlag,
+	}
+
+	if cfg.ForceRenewal && len(cfg.Targets) == 0 {
+		log.Fatalf("--force requires the targets to renew to be specified")
+	}
+
+	if *renewIfExpiringWithinFlag != "" {
+		d, err := storage.ParseDays(*renewIfExpiringWithinFlag)
+		log.Fatale(err, "--if-expiring-within")
+		cfg.RenewIfExpiringWithin = d
+	}
+
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	ctx, cancel := reconcileContext()
+	defer cancel()
+
+	err = storageops.Reconcile(ctx, s, cfg)
+	log.Fatale(err, "renew")
+}
+
+func cmdOCSP() {
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	ctx, cancel := reconcileContext()
+	defer cancel()
+
+	err = storageops.RefreshOCSP(ctx, s)
+	log.Fatale(err, "ocsp")
+}
+
 func cmdCull() {
 	s, err := storage.NewFDB(*stateFlag)
 	log.Fatale(err, "storage")
 
-	err = storageops.Cull(s, *cullSimulateFlag)
+	keyGracePeriod, err := storage.ParseDays(*cullKeyGracePeriodFlag)
+	log.Fatale(err, "key grace period")
+
+	// A zero grace period in CullConfig means the default.
+	if keyGracePeriod == 0 {
+		keyGracePeriod = -1
+	}
+
+	err = storageops.Cull(s, storageops.CullConfig{
+		Simulate:       *cullSimulateFlag,
+		KeyGracePeriod: keyGracePeriod,
+		EraseKeys:      *cullEraseKeysFlag,
+	})
 	log.Fatale(err, "cull")
 }
 
@@ -255,6 +453,14 @@ func cmdStatus() {
 	s, err := storage.NewFDB(*stateFlag)
 	log.Fatale(err, "storage")
 
+	if *statusExplainFlag != "" {
+		info, err := ExplainString(s, *statusExplainFlag)
+		log.Fatale(err, "explain")
+
+		fmt.Print(info)
+		return
+	}
+
 	info := StatusString(s)
 	log.Fatale(err, "status")
 
@@ -286,12 +492,54 @@ func importKey(s storage.Store, filename string) error {
 	return err
 }
 
+// Describes the settings of a target and where each came from. The target
+// can be given as a filename in the desired directory or as a path to it.
+func ExplainString(s storage.Store, target string) (string, error) {
+	filename := target
+	if strings.ContainsRune(target, filepath.Separator) {
+		filename = filepath.Base(target)
+	}
+
+	origins, err := s.ExplainTarget(filename)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if t := s.TargetByFilename(filename); t != nil {
+		fmt.Fprintf(&buf, "%v\n", t)
+	}
+
+	for _, o := range origins {
+		fmt.Fprintf(&buf, "  %s: %s  (from %s)\n", o.Setting, formatSettingValue(o.Value), o.Origin)
+	}
+
+	return buf.String(), nil
+}
+
+func formatSettingValue(v interface{}) string {
+	switch vv := v.(type) {
+	case []interface{}:
+		var items []string
+		for _, item := range vv {
+			items = append(items, formatSettingValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case []string:
+		return "[" + strings.Join(vv, ", ") + "]"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%v", vv)
+	}
+}
+
 func StatusString(s storage.Store) string {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "Settings:\n")
 	fmt.Fprintf(&buf, "  ACME_STATE_DIR: %s\n", s.Path())
 	fmt.Fprintf(&buf, "  ACME_HOOKS_DIR: %s\n", strings.Join(hooks.DefaultPaths, "; "))
-	fmt.Fprintf(&buf, "  Default directory URL: %s\n", s.DefaultTarget().Request.Provider)
+	fmt.Fprintf(&buf, "  Default directory URL: %s\n", strings.Join(s.DefaultTarget().Request.ProviderURLs(), ", "))
 	fmt.Fprintf(&buf, "  Preferred key type: %v\n", &s.DefaultTarget().Request.Key)
 	fmt.Fprintf(&buf, "  Additional webroots:\n")
 	for _, wr := range s.DefaultTarget().Request.Challenge.WebrootPaths {
@@ -299,36 +547,69 @@ func StatusString(s storage.Store) string {
 	}
 
 	fmt.Fprintf(&buf, "\nAvailable accounts:\n")
-	s.VisitAccounts(func(a *storage.Account) error {
+	label := ""
+	for _, a := range sortedAccounts(s) {
+		if a.Label != label {
+			label = a.Label
+			fmt.Fprintf(&buf, "  label %q:\n", label)
+		}
 		fmt.Fprintf(&buf, "  %v\n", a)
 		thumbprint, _ := acmeutils.Base64Thumbprint(a.PrivateKey)
 		fmt.Fprintf(&buf, "    thumbprint: %s\n", thumbprint)
-		return nil
-	})
+	}
 
 	fmt.Fprintf(&buf, "\n")
 	s.VisitTargets(func(t *storage.Target) error {
 		fmt.Fprintf(&buf, "%v\n", t)
 
-		c, err := storageops.FindBestCertificateSatisfying(s, t)
-		if err != nil {
-			fmt.Fprintf(&buf, "  error: %v\n", err)
-			return nil // continue
-		}
+		for _, tv := range t.KeyTypeVariants() {
+			keyTypeStr := ""
+			if len(t.Request.Key.Types) > 0 {
+				keyTypeStr = " (" + tv.Request.Key.Type + ")"
+			}
 
-		renewStr := ""
-		if storageops.CertificateNeedsRenewing(c, t) {
-			renewStr = " needs-renewing"
-		}
+			c, err := storageops.FindBestCertificateSatisfying(s, tv)
+			if err != nil {
+				fmt.Fprintf(&buf, "  error%s: %v\n", keyTypeStr, err)
+				continue
+			}
 
-		fmt.Fprintf(&buf, "  best: %v%s\n", c, renewStr)
+			renewStr := ""
+			if storageops.CertificateNeedsRenewing(c, tv) {
+				renewStr = " needs-renewing"
+			}
+
+			fmt.Fprintf(&buf, "  best%s: %v%s\n", keyTypeStr, c, renewStr)
+			if c.Provider != "" {
+				fmt.Fprintf(&buf, "    provider: %s\n", c.Provider)
+			}
+		}
 		return nil
 	})
 
+	if err := s.DefaultTargetError(); err != nil {
+		fmt.Fprintf(&buf, "\nERROR: %v\n", err)
+	}
+
+	if errs := storageops.TargetLoadErrors(s); len(errs) > 0 {
+		fmt.Fprintf(&buf, "\nTargets which could not be loaded and are not being renewed:\n")
+		for _, err := range errs {
+			fmt.Fprintf(&buf, "  %v\n", err)
+		}
+	}
+
 	if storageops.HaveUncachedCertificates(s) {
 		fmt.Fprintf(&buf, "\nThere are uncached certificates.\n")
 	}
 
+	if interval, ok := storageops.ReconcileInterval(s); ok {
+		fmt.Fprintf(&buf, "\nReconciliation runs about every %v.\n", interval.Round(time.Minute))
+	}
+
+	for _, w := range storageops.CheckReconcileInterval(s) {
+		fmt.Fprintf(&buf, "WARNING: %s\n", w)
+	}
+
 	return buf.String()
 }
 
@@ -336,11 +617,34 @@ func cmdAccountThumbprint() {
 	s, err := storage.NewFDB(*stateFlag)
 	log.Fatale(err, "storage")
 
-	s.VisitAccounts(func(a *storage.Account) error {
+	// Accounts are grouped by label, with the label as a third column.
+	for _, a := range sortedAccounts(s) {
 		thumbprint, _ := acmeutils.Base64Thumbprint(a.PrivateKey)
-		fmt.Printf("%s\t%s\n", thumbprint, a.ID())
+		if a.Label != "" {
+			fmt.Printf("%s\t%s\t%s\n", thumbprint, a.ID(), a.Label)
+		} else {
+			fmt.Printf("%s\t%s\n", thumbprint, a.ID())
+		}
+	}
+}
+
+// Returns all accounts ordered by label, then by ID. Unlabelled accounts come
+// first.
+func sortedAccounts(s storage.Store) []*storage.Account {
+	var accounts []*storage.Account
+	s.VisitAccounts(func(a *storage.Account) error {
+		accounts = append(accounts, a)
 		return nil
 	})
+
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Label != accounts[j].Label {
+			return accounts[i].Label < accounts[j].Label
+		}
+		return accounts[i].ID() < accounts[j].ID()
+	})
+
+	return accounts
 }
 
 func cmdWant() {
@@ -348,9 +652,9 @@ func cmdWant() {
 
 	// Ensure all hostnames provided are valid.
 	for idx := range hostnames {
-		norm, err := acmeutils.NormalizeHostname(hostnames[idx])
+		norm, err := storage.NormalizeName(hostnames[idx])
 		if err != nil {
-			log.Fatalf("invalid hostname: %#v: %v", hostnames[idx], err)
+			log.Fatalf("invalid hostname or IP address: %#v: %v", hostnames[idx], err)
 			return
 		}
 		hostnames[idx] = norm
@@ -494,43 +798,3 @@ func parseResponse(v interface{}) (*interaction.Response, error) {
 		return nil, fmt.Errorf("unknown response value")
 	}
 }
-
-func cmdRevoke() {
-	certSpec := *revokeArg
-	f, _ := os.Open(certSpec)
-	//var fi os.FileInfo
-	if f != nil {
-		defer f.Close()
-		//var err error
-		//fi, err = f.Stat()
-		//log.Panice(err)
-	}
-	//u, _ := url.Parse(certSpec)
-
-	switch {
-	//case f != nil && !fi.IsDir(): // is a file path
-
-	//case f != nil && fi.IsDir(): // is a directory path
-	//  f, _ = os.Open(filepath.Join(certSpec, "cert"))
-
-	//case u != nil && u.IsAbs() && acmeapi.ValidURL(certSpec): // is an URL
-
-	case storage.IsWellFormattedCertificateOrKeyID(certSpec):
-		// key or certificate ID
-		revokeByCertificateID(certSpec)
-
-	default:
-		log.Fatalf("don't understand argument, must be a certificate or key ID: %q", certSpec)
-	}
-}
-
-func revokeByCertificateID(certID string) {
-	s, err := storage.NewFDB(*stateFlag)
-	log.Fatale(err, "storage")
-
-	err = storageops.RevokeByCertificateOrKeyID(s, certID)
-	log.Fatale(err, "revoke")
-
-	err = storageops.Reconcile(s, storageops.ReconcileConfig{})
-	log.Fatale(err, "reconcile")
-}
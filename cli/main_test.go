@@ -0,0 +1,236 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hlandau/acmetool/acmetest"
+	"github.com/hlandau/acmetool/hooks"
+	"github.com/hlandau/acmetool/interaction"
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/storageops"
+)
+
+type interceptor struct {
+	directoryURL string
+	webrootPath  string
+}
+
+func (i *interceptor) Prompt(c *interaction.Challenge) (*interaction.Response, error) {
+	switch c.UniqueID {
+	case "acmetool-quickstart-choose-server":
+		return &interaction.Response{Value: "url"}, nil
+	case "acmetool-quickstart-enter-directory-url":
+		return &interaction.Response{Value: i.directoryURL}, nil
+	case "acmetool-quickstart-choose-method":
+		return &interaction.Response{Value: "webroot"}, nil
+	case "acmetool-quickstart-webroot-path":
+		return &interaction.Response{Value: i.webrootPath}, nil
+	case "acme-enter-email":
+		return &interaction.Response{Value: "nobody@example.com"}, nil
+	case "acmetool-quickstart-complete":
+		return &interaction.Response{}, nil
+	case "acmetool-quickstart-install-cronjob", "acmetool-quickstart-install-haproxy-script", "acmetool-quickstart-install-redirector-systemd":
+		return &interaction.Response{Cancelled: true}, nil
+	default:
+		if strings.HasPrefix(c.UniqueID, "acme-agreement:") {
+			return &interaction.Response{}, nil
+		}
+
+		return nil, fmt.Errorf("unsupported challenge for interceptor: %v", c)
+	}
+}
+
+func (i *interceptor) Status(info *interaction.StatusInfo) (interaction.StatusSink, error) {
+	return nil, fmt.Errorf("status not supported")
+}
+
+// Records the hostnames passed to live-updated hooks.
+const testHookFile = `#!/bin/sh
+[ "$1" = "live-updated" ] || exit 42
+while read line; do
+  echo "$line" >> "$ACME_STATE_DIR/live-updated.log"
+done
+`
+
+// Runs quickstart, want and reconcile against an in-process ACME server,
+// which validates http-01 challenges by fetching them from a web server
+// serving the webroot configured by quickstart.
+func TestCLI(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "acmetool-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The web server holds its listener for the duration of the test, so no
+	// other process can take the port which the ACME server connects to.
+	webroot := filepath.Join(tmpDir, "www")
+	webSrv := httptest.NewServer(http.FileServer(http.Dir(webroot)))
+	defer webSrv.Close()
+
+	srv, err := acmetest.New(acmetest.Config{
+		HTTPAddress: webSrv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer srv.Close()
+
+	// Restore the global state changed by the test.
+	defer func(httpClient *http.Client, interceptor interaction.Interactor, hookPaths []string, state string, hooksDirs, want []string) {
+		storageops.InternalHTTPClient = httpClient
+		interaction.Interceptor = interceptor
+		hooks.DefaultPaths = hookPaths
+		*stateFlag = state
+		*hooksFlag = hooksDirs
+		*wantArg = want
+	}(storageops.InternalHTTPClient, interaction.Interceptor, hooks.DefaultPaths, *stateFlag, *hooksFlag, *wantArg)
+
+	storageops.InternalHTTPClient = srv.HTTPClient()
+	interaction.Interceptor = &interceptor{
+		directoryURL: srv.DirectoryURL(),
+		webrootPath:  filepath.Join(webroot, ".well-known", "acme-challenge"),
+	}
+
+	*stateFlag = filepath.Join(tmpDir, "state")
+	*hooksFlag = []string{filepath.Join(tmpDir, "hooks")}
+	hooks.DefaultPaths = *hooksFlag
+
+	cmdQuickstart()
+
+	// Replace the reload hook installed by quickstart, which reloads system
+	// services, with one which records its invocations.
+	err = os.Remove(filepath.Join(tmpDir, "hooks", "reload"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Join(tmpDir, "hooks"), 0755)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "hooks", "record"), []byte(testHookFile), 0755)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The test names do not resolve to the web server, so the self-test would
+	// fail.
+	s, err := storage.NewFDB(*stateFlag)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	selfTest := false
+	s.DefaultTarget().Request.Challenge.HTTPSelfTest = &selfTest
+	err = s.SaveTarget(s.DefaultTarget())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	names := []string{"dom1.acmetool-test.devever.net", "dom2.acmetool-test.devever.net"}
+	*wantArg = append([]string(nil), names...)
+
+	cmdWant()
+	cmdReconcile()
+
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(*stateFlag, "live", name, "cert"))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		p, _ := pem.Decode(b)
+		if p == nil {
+			t.Fatalf("no certificate for %q", name)
+		}
+
+		c, err := x509.ParseCertificate(p.Bytes)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = c.CheckSignatureFrom(srv.CACertificate())
+		if err != nil {
+			t.Fatalf("certificate for %q not issued by the test CA: %v", name, err)
+		}
+
+		err = c.VerifyHostname(name)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(*stateFlag, "live-updated.log"))
+	if err != nil {
+		t.Fatalf("live-updated hook not invoked: %v", err)
+	}
+
+	for _, name := range names {
+		if !bytes.Contains(b, []byte(name+"\n")) {
+			t.Fatalf("live-updated hook not invoked for %q: %q", name, b)
+		}
+	}
+}
+
+// "status --explain" shows each setting with the file it came from, for a
+// target given by filename or path.
+func TestExplainString(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "acmetool-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s, err := storage.NewFDB(tmpDir)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for name, data := range map[string]string{
+		"conf/templates/customer": "request:\n  provider: https://customer.example.com/directory\n",
+		"desired/example.com":     "template: customer\nsatisfy:\n  names:\n    - example.com\n    - www.example.com\n",
+	} {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, name)), 0755)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, target := range []string{"example.com", filepath.Join(tmpDir, "desired", "example.com")} {
+		info, err := ExplainString(s, target)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		for _, line := range []string{
+			"  request.provider: https://customer.example.com/directory  (from conf/templates/customer)\n",
+			"  satisfy.names: [example.com, www.example.com]  (from desired/example.com)\n",
+		} {
+			if !strings.Contains(info, line) {
+				t.Fatalf("%q not in explanation:\n%s", line, info)
+			}
+		}
+	}
+}
@@ -115,7 +115,7 @@ const reloadHookFile = `#!/bin/sh
 ###############################################################################
 set -e
 EVENT_NAME="$1"
-[ "$EVENT_NAME" = "live-updated" ] || exit 42
+[ "$EVENT_NAME" = "live-updated" -o "$EVENT_NAME" = "ocsp-updated" ] || exit 42
 
 SERVICES="httpd apache2 apache nginx tengine lighttpd postfix dovecot exim exim4 haproxy hitch quassel quasselcore opensmtpd freeswitch apache24"
 [ -e "/etc/default/acme-reload" ] && . /etc/default/acme-reload
@@ -212,7 +212,7 @@ const combinedReloadHookFile = `#!/bin/sh
 ###############################################################################
 set -e
 EVENT_NAME="$1"
-[ "$EVENT_NAME" = "live-updated" ] || exit 42
+[ "$EVENT_NAME" = "live-updated" -o "$EVENT_NAME" = "ocsp-updated" ] || exit 42
 
 # List of services. If any of these are in PATH (or HAPROXY_ALWAYS_GENERATE is
 # set), assume we need to generate combined files.
@@ -249,7 +249,16 @@ while read name; do
     cat "$certdir/privkey" "$certdir/fullchain" > "$certdir/haproxy"
   fi
 
+  # haproxy loads an OCSP response for a certificate file from the same path
+  # with ".ocsp" appended.
+  if [ -e "$certdir/ocsp" ]; then
+    cp "$certdir/ocsp" "$certdir/haproxy.ocsp"
+  else
+    rm -f "$certdir/haproxy.ocsp"
+  fi
+
   [ -h "$ACME_STATE_DIR/haproxy/$name" ] || ln -fs "../live/$name/haproxy" "$ACME_STATE_DIR/haproxy/$name"
+  [ -h "$ACME_STATE_DIR/haproxy/$name.ocsp" ] || ln -fs "../live/$name/haproxy.ocsp" "$ACME_STATE_DIR/haproxy/$name.ocsp"
 done`
 
 func installHook(name, value string) {
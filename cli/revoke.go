@@ -0,0 +1,234 @@
+package cli
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/storageops"
+	"gopkg.in/hlandau/acmeapi.v2"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+)
+
+func cmdRevoke() {
+	reason, err := storageops.ParseRevocationReason(*revokeReasonFlag)
+	log.Fatale(err, "revocation reason")
+
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	certs, err := resolveRevocationSpec(s, *revokeArg)
+	log.Fatale(err, "cannot determine certificates to revoke")
+
+	if len(certs) == 0 {
+		log.Fatalf("no known certificates match %q", *revokeArg)
+	}
+
+	// External certificates cannot be revoked via ACME. They are skipped, as
+	// when revoking by key ID, rather than failing after some certificates
+	// have been marked.
+	var revocable []*storage.Certificate
+	for _, c := range certs {
+		if c.External {
+			log.Warnf("%v is an external certificate and cannot be revoked via ACME, skipping it", c)
+			continue
+		}
+
+		revocable = append(revocable, c)
+	}
+	certs = revocable
+
+	if len(certs) == 0 {
+		log.Fatalf("no certificates matching %q can be revoked via ACME", *revokeArg)
+	}
+
+	for _, c := range certs {
+		fmt.Printf("%s\n", describeCertificate(c))
+	}
+
+	for _, c := range certs {
+		err = storageops.MarkForRevocation(s, c, reason)
+		log.Fatale(err, "revoke")
+	}
+
+	ctx, cancel := reconcileContext()
+	defer cancel()
+
+	err = storageops.Reconcile(ctx, s, storageops.ReconcileConfig{})
+	log.Fatale(err, "reconcile")
+}
+
+// Determines the certificates to be revoked given a command line argument.
+func resolveRevocationSpec(s storage.Store, spec string) ([]*storage.Certificate, error) {
+	if storage.IsWellFormattedCertificateID(spec) {
+		if c := s.CertificateByID(spec); c != nil {
+			return []*storage.Certificate{c}, nil
+		}
+
+		if k := s.KeyByID(spec); k != nil {
+			return storageops.CertificatesUsingKey(s, k), nil
+		}
+
+		return nil, fmt.Errorf("cannot find certificate or key with given ID: %q", spec)
+	}
+
+	if acmeapi.ValidURL(spec) {
+		// The order URL is also accepted, as the certificate URL is not known
+		// for certificates downloaded before it was recorded.
+		var certs []*storage.Certificate
+		s.VisitCertificates(func(c *storage.Certificate) error {
+			if c.CertificateURL == spec || c.URL == spec {
+				certs = append(certs, c)
+			}
+			return nil
+		})
+
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("no known certificate has URL %q", spec)
+		}
+
+		return certs, nil
+	}
+
+	fi, err := os.Stat(spec)
+	if err != nil {
+		return nil, fmt.Errorf("don't understand argument, must be a certificate or key ID, path or URL: %q: %v", spec, err)
+	}
+
+	if fi.IsDir() {
+		// Certificate directories (and live/ symlinks) contain "cert"; key
+		// directories contain only "privkey".
+		certPath := filepath.Join(spec, "cert")
+		if _, err := os.Stat(certPath); err == nil {
+			return resolveRevocationFile(s, certPath)
+		}
+
+		return resolveRevocationFile(s, filepath.Join(spec, "privkey"))
+	}
+
+	return resolveRevocationFile(s, spec)
+}
+
+// Determines the certificates to be revoked given a path to a PEM-encoded
+// certificate or private key.
+func resolveRevocationFile(s storage.Store, path string) ([]*storage.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Contains(b, []byte("PRIVATE KEY-----")) {
+		keyID, err := determinePrivateKeyID(b)
+		if err != nil {
+			return nil, err
+		}
+
+		k := s.KeyByID(keyID)
+		if k == nil {
+			return nil, fmt.Errorf("private key %q (key ID %q) is not known", path, keyID)
+		}
+
+		return storageops.CertificatesUsingKey(s, k), nil
+	}
+
+	certs, err := acmeutils.LoadCertificates(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate or private key found in %q", path)
+	}
+
+	var matches []*storage.Certificate
+	s.VisitCertificates(func(c *storage.Certificate) error {
+		if len(c.Certificates) > 0 && bytes.Equal(c.Certificates[0], certs[0]) {
+			matches = append(matches, c)
+		}
+		return nil
+	})
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("certificate %q is not known", path)
+	}
+
+	return matches, nil
+}
+
+// Determines the key ID of a PEM-encoded private key.
+func determinePrivateKeyID(b []byte) (string, error) {
+	pk, err := acmeutils.LoadPrivateKey(b)
+	if err != nil {
+		return "", err
+	}
+
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("unsupported private key type: %T", pk)
+	}
+
+	return storage.DetermineKeyIDFromPublicKey(signer.Public())
+}
+
+// Handles the compromise of a private key, revoking all certificates using it,
+// preventing its further use and replacing those certificates.
+func cmdCompromiseKey() {
+	s, err := storage.NewFDB(*stateFlag)
+	log.Fatale(err, "storage")
+
+	keyID := *compromiseKeyArg
+	if !storage.IsWellFormattedCertificateOrKeyID(keyID) {
+		path := keyID
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			path = filepath.Join(path, "privkey")
+		}
+
+		b, err := ioutil.ReadFile(path)
+		log.Fatale(err, "don't understand argument, must be a key ID or path to a private key")
+
+		keyID, err = determinePrivateKeyID(b)
+		log.Fatale(err, "cannot load private key")
+	}
+
+	if s.IsKeyCompromised(keyID) {
+		log.Noticef("key %q is already marked as compromised", keyID)
+	}
+
+	fmt.Printf("key %s\n", keyID)
+	if k := s.KeyByID(keyID); k != nil {
+		for _, c := range storageops.CertificatesUsingKey(s, k) {
+			fmt.Printf("%s\n", describeCertificate(c))
+		}
+	}
+
+	err = storageops.CompromiseKey(s, keyID)
+	log.Fatale(err, "compromise key")
+
+	// Reconciling requests revocation, obtains replacement certificates for
+	// affected targets, relinks and notifies hooks.
+	ctx, cancel := reconcileContext()
+	defer cancel()
+
+	err = storageops.Reconcile(ctx, s, storageops.ReconcileConfig{})
+	log.Fatale(err, "reconcile")
+}
+
+// Returns a one-line description of a certificate including its ID and names.
+func describeCertificate(c *storage.Certificate) string {
+	if len(c.Certificates) == 0 {
+		return fmt.Sprintf("%s (not downloaded)", c.ID())
+	}
+
+	xcrt, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return fmt.Sprintf("%s (unparseable)", c.ID())
+	}
+
+	return fmt.Sprintf("%s %s (expires %s)", c.ID(), strings.Join(storageops.CertificateNames(xcrt), ","), xcrt.NotAfter.Format("2006-01-02"))
+}
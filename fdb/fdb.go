@@ -549,7 +549,14 @@ func (c *Collection) OSPath(name string) string {
 // Atomically delete an existing object or link or subcollection in the given
 // collection with the given name. Returns nil if the object does not exist.
 func (c *Collection) Delete(name string) error {
-	return os.RemoveAll(filepath.Join(c.db.path, c.name, name))
+	rpath := filepath.Join(c.name, name)
+	for path := range c.db.extantDirs {
+		if path == rpath || strings.HasPrefix(path, rpath+"/") {
+			delete(c.db.extantDirs, path)
+		}
+	}
+
+	return os.RemoveAll(filepath.Join(c.db.path, rpath))
 }
 
 // Returned when calling Open() on a symlink. (To open symlinks, use Openl.)
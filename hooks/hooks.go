@@ -3,6 +3,7 @@
 package hooks
 
 import (
+	"context"
 	"fmt"
 	deos "github.com/hlandau/goutils/os"
 	"github.com/hlandau/xlog"
@@ -39,6 +40,10 @@ type Context struct {
 
 	// Arbitrary environment variables to set.
 	Env map[string]string
+
+	// If non-nil, hooks still running when it is done are killed, and no
+	// further hooks are run.
+	Ctx context.Context
 }
 
 func init() {
@@ -84,6 +89,25 @@ func NotifyLiveUpdated(ctx *Context, hostnames []string) error {
 	return nil
 }
 
+// Notifies hook programs that the OCSP responses for the preferred
+// certificates of one or more hostnames have been updated.
+//
+// The hostnames are passed as information to the hooks in the same way as for
+// NotifyLiveUpdated.
+func NotifyOCSPUpdated(ctx *Context, hostnames []string) error {
+	if len(hostnames) == 0 {
+		return nil
+	}
+
+	hostnameList := strings.Join(hostnames, "\n") + "\n"
+	_, err := runParts(ctx, []byte(hostnameList), "ocsp-updated")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Invokes HTTP challenge start hooks.
 //
 // installed indicates whether at least one hook script indicated success. err
@@ -193,7 +217,16 @@ func runParts(ctx *Context, stdinData []byte, args ...string) (anySucceeded bool
 		ms = append(ms, m...)
 	}
 
+	cctx := ctx.Ctx
+	if cctx == nil {
+		cctx = context.Background()
+	}
+
 	for _, m := range ms {
+		if err := cctx.Err(); err != nil {
+			return anySucceeded, err
+		}
+
 		fi, err := os.Stat(m)
 		if err != nil {
 			log.Errore(err, "hook: ", m)
@@ -233,10 +266,10 @@ func runParts(ctx *Context, stdinData []byte, args ...string) (anySucceeded bool
 			log.Debugf("calling hook script (with sudo): %s", m)
 			args2 := []string{"-n", "--", m}
 			args2 = append(args2, args...)
-			cmd = exec.Command("sudo", args2...)
+			cmd = exec.CommandContext(cctx, "sudo", args2...)
 		} else {
 			log.Debugf("calling hook script: %s", m)
-			cmd = exec.Command(m, args...)
+			cmd = exec.CommandContext(cctx, m, args...)
 		}
 
 		cmd.Dir = "/"
@@ -1,6 +1,7 @@
 package responder
 
 import (
+	"context"
 	"crypto"
 	"encoding/json"
 	"fmt"
@@ -38,10 +39,10 @@ func newDNSResponder(rcfg Config) (Responder, error) {
 }
 
 // Start is a no-op for the DNS method.
-func (s *dnsResponder) Start() error {
+func (s *dnsResponder) Start(ctx context.Context) error {
 	// Try hooks.
 	if startFunc := s.rcfg.ChallengeConfig.StartHookFunc; startFunc != nil {
-		err := startFunc(&DNSChallengeInfo{
+		err := startFunc(ctx, &DNSChallengeInfo{
 			Hostname: s.rcfg.Hostname,
 			Body:     s.dnsString,
 		})
@@ -52,10 +53,10 @@ func (s *dnsResponder) Start() error {
 }
 
 // Stop is a no-op for the DNS method.
-func (s *dnsResponder) Stop() error {
+func (s *dnsResponder) Stop(ctx context.Context) error {
 	// Try hooks.
 	if stopFunc := s.rcfg.ChallengeConfig.StopHookFunc; stopFunc != nil {
-		err := stopFunc(&DNSChallengeInfo{
+		err := stopFunc(ctx, &DNSChallengeInfo{
 			Hostname: s.rcfg.Hostname,
 			Body:     s.dnsString,
 		})
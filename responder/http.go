@@ -2,6 +2,7 @@ package responder
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/tls"
 	"encoding/json"
@@ -77,18 +78,17 @@ func (s *httpResponder) notify() {
 }
 
 // Start handling HTTP requests.
-func (s *httpResponder) Start() error {
-	err := s.startActual()
+func (s *httpResponder) Start(ctx context.Context) error {
+	err := s.startActual(ctx)
 	if err != nil {
 		return err
 	}
 
 	if !s.rcfg.ChallengeConfig.HTTPNoSelfTest {
 		log.Debugf("http-01 self test for %q", s.rcfg.Hostname)
-		err = s.selfTest()
+		err = s.selfTest(ctx)
 		if err != nil {
 			log.Infoe(err, "http-01 self test failed: ", s.rcfg.Hostname)
-			s.Stop()
 			return err
 		}
 	}
@@ -103,7 +103,7 @@ var selfTestTimeout = 5 * time.Second
 
 // Test that the challenge is reachable at the given hostname. If a hostname
 // was not provided, this test is skipped.
-func (s *httpResponder) selfTest() error {
+func (s *httpResponder) selfTest(ctx context.Context) error {
 	if s.rcfg.Hostname == "" {
 		return nil
 	}
@@ -114,7 +114,10 @@ func (s *httpResponder) selfTest() error {
 		Path:   "/.well-known/acme-challenge/" + s.rcfg.Token,
 	}
 	if InternalHTTPPort != 80 {
-		u.Host = net.JoinHostPort(u.Host, fmt.Sprintf("%d", InternalHTTPPort))
+		u.Host = net.JoinHostPort(s.rcfg.Hostname, fmt.Sprintf("%d", InternalHTTPPort))
+	} else if ip := net.ParseIP(s.rcfg.Hostname); ip != nil && ip.To4() == nil {
+		// The hostname may be an IPv6 address (RFC 8738).
+		u.Host = "[" + s.rcfg.Hostname + "]"
 	}
 
 	trans := &http.Transport{
@@ -127,7 +130,12 @@ func (s *httpResponder) selfTest() error {
 		Timeout:   selfTestTimeout,
 	}
 
-	res, err := client.Get(u.String())
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -314,7 +322,7 @@ func determineListenAddrs(userAddrs []string) []string {
 	return addrsl
 }
 
-func (s *httpResponder) startActual() error {
+func (s *httpResponder) startActual(ctx context.Context) error {
 	// Determine and listen on sorted list of addresses.
 	addrs := determineListenAddrs(s.rcfg.ChallengeConfig.HTTPPorts)
 
@@ -331,7 +339,7 @@ func (s *httpResponder) startActual() error {
 
 	// Try hooks.
 	if startFunc := s.rcfg.ChallengeConfig.StartHookFunc; startFunc != nil {
-		err := startFunc(&HTTPChallengeInfo{
+		err := startFunc(ctx, &HTTPChallengeInfo{
 			Hostname: s.rcfg.Hostname,
 			Filename: s.rcfg.Token,
 			Body:     string(s.ka),
@@ -343,7 +351,7 @@ func (s *httpResponder) startActual() error {
 }
 
 // Stop handling HTTP requests.
-func (s *httpResponder) Stop() error {
+func (s *httpResponder) Stop(ctx context.Context) error {
 	for _, pc := range s.portClaims {
 		pc.Close()
 	}
@@ -354,7 +362,7 @@ func (s *httpResponder) Stop() error {
 
 	// Try and stop hooks.
 	if stopFunc := s.rcfg.ChallengeConfig.StopHookFunc; stopFunc != nil {
-		err := stopFunc(&HTTPChallengeInfo{
+		err := stopFunc(ctx, &HTTPChallengeInfo{
 			Hostname: s.rcfg.Hostname,
 			Filename: s.rcfg.Token,
 			Body:     string(s.ka),
@@ -2,6 +2,7 @@
 package responder
 
 import (
+	"context"
 	"crypto"
 	"encoding/json"
 	"fmt"
@@ -19,14 +20,18 @@ var log, Log = xlog.New("acme.responder")
 // ValidationSigningKey() to submit the challenge response.
 //
 // Once the challenge has been completed, as determined by polling, you must
-// call Stop. If RequestDetectedChan() is non-nil, it provides a hint as to
-// when polling may be fruitful.
+// call Stop. Stop must be called once Start has been called, even if Start
+// fails or the operation is cancelled, so that anything installed to complete
+// the challenge is removed. If RequestDetectedChan() is non-nil, it provides a
+// hint as to when polling may be fruitful.
 type Responder interface {
-	// Become ready to be interrogated by the ACME server.
-	Start() error
+	// Become ready to be interrogated by the ACME server. ctx bounds any
+	// operations performed, such as the execution of hooks.
+	Start(ctx context.Context) error
 
-	// Stop responding to any queries by the ACME server.
-	Stop() error
+	// Stop responding to any queries by the ACME server. ctx should not be
+	// the context passed to Start, which may already be cancelled.
+	Stop(ctx context.Context) error
 
 	// This channel is sent to when a request to the responder is detected,
 	// which may indicates completion of the challenge is imminent.
@@ -80,7 +85,7 @@ type ChallengeConfig struct {
 // return an error. Returning an error short circuits.
 type PriorKeyFunc func(crypto.PublicKey) (crypto.PrivateKey, error)
 
-type HookFunc func(challengeInfo interface{}) error
+type HookFunc func(ctx context.Context, challengeInfo interface{}) error
 
 var responderTypes = map[string]func(Config) (Responder, error){}
 
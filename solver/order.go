@@ -14,6 +14,13 @@ import (
 
 var log, Log = xlog.New("acmetool.solver")
 
+// The identifier type for IP addresses (RFC 8738).
+const IdentifierTypeIP = "ip"
+
+// The maximum time allowed for stopping a responder, which may involve
+// running hooks to remove challenges.
+var responderStopTimeout = 2 * time.Minute
+
 type blacklist struct {
 	mutex sync.Mutex
 	m     map[string]struct{}
@@ -70,6 +77,9 @@ func Order(ctx context.Context, rc *acmeapi.RealmClient, acct *acmeapi.Account,
 		if !shouldRetry {
 			return nil, err
 		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 	}
 }
 
@@ -141,10 +151,15 @@ func orderAuthorizeAll(ctx context.Context, rc *acmeapi.RealmClient, acct *acmea
 
 	ch := make(chan result, len(order.AuthorizationURLs))
 
+	// If any authorization fails fatally, there is no point continuing with
+	// the others, so they share a context which is then cancelled. Each still
+	// stops its responder before returning.
+	ctxAuth, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	for i := range order.AuthorizationURLs {
 		authURL := order.AuthorizationURLs[i]
 		go func() {
-			ctxAuth := ctx // TODO
 			isFatal, err := orderAuthorizeOne(ctxAuth, rc, acct, authURL, ccfg, bl)
 			ch <- result{isFatal, err}
 		}()
@@ -155,8 +170,8 @@ func orderAuthorizeAll(ctx context.Context, rc *acmeapi.RealmClient, acct *acmea
 	for i := 0; i < len(order.AuthorizationURLs); i++ {
 		r := <-ch
 		if r.isFatal {
-			// CANCEL ALL
 			isFatal = true
+			cancel()
 		}
 
 		if r.err != nil {
@@ -249,8 +264,10 @@ func orderAuthorizeOne(ctx context.Context, rc *acmeapi.RealmClient, acct *acmea
 			}
 		}
 
-		// If the authorization is not for a DNS identifier, return FATAL.
-		if authz.Identifier.Type != acmeapi.IdentifierTypeDNS {
+		// If the authorization is not for a DNS or IP identifier, return FATAL.
+		// IP identifiers can be validated using the same challenge responders;
+		// the server offers only the challenge types applicable to them.
+		if authz.Identifier.Type != acmeapi.IdentifierTypeDNS && authz.Identifier.Type != IdentifierTypeIP {
 			err = fmt.Errorf("unsupported authorization identifier type %q, value %q", authz.Identifier.Type, authz.Identifier.Value)
 			isFatal = true
 			return
@@ -384,14 +401,22 @@ func orderCompleteChallenge(ctx context.Context, rc *acmeapi.RealmClient, acct *
 		return
 	}
 
-	err = r.Start()
+	// The responder must be stopped even if ctx is cancelled, so that
+	// challenge files, DNS records, etc. are removed, so it is stopped using a
+	// context of its own.
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), responderStopTimeout)
+		defer cancel()
+		err := r.Stop(stopCtx)
+		log.Errore(err, "failed to stop challenge responder for ", authz.Identifier.Value)
+	}()
+
+	err = r.Start(ctx)
 	if err != nil {
 		log.Debuge(err, "challenge start failed")
 		return
 	}
 
-	defer r.Stop()
-
 	// RESPOND
 	err = rc.RespondToChallenge(ctx, acct, &oldCh, r.Validation()) //r.ValidationSigningKey()
 	if err != nil {
@@ -0,0 +1,224 @@
+package solver
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2"
+	jose "gopkg.in/square/go-jose.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// An ACME profile (draft-ietf-acme-profiles) to request for new orders.
+//
+// The ACME client library cannot send the profile field of a new order. A
+// RealmClient created by NewRealmClient makes its requests through an HTTP
+// transport which adds the profile to newOrder requests and signs them again
+// using the account key, with the same JOSE library and protected header the
+// client library uses. Everything else, including the directory, nonces and
+// problem documents, is handled by the client library as usual.
+type Profile struct {
+	// The profile name, e.g. "shortlived".
+	Name string
+
+	// The directory URL of the provider.
+	DirectoryURL string
+
+	// The HTTP client to use. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Returns a RealmClient for the provider which requests the profile for every
+// order it creates. key must be the private key of the account used to create
+// orders.
+//
+// If the provider does not offer the profile, newOrder requests fail with an
+// invalidProfile problem without being sent.
+func (p *Profile) NewRealmClient(key crypto.PrivateKey) (*acmeapi.RealmClient, error) {
+	cl := http.Client{}
+	if p.HTTPClient != nil {
+		cl = *p.HTTPClient
+	}
+
+	next := cl.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	cl.Transport = &profileTransport{
+		profile: p,
+		key:     key,
+		next:    next,
+	}
+
+	return acmeapi.NewRealmClient(acmeapi.RealmClientConfig{
+		DirectoryURL: p.DirectoryURL,
+		HTTPClient:   &cl,
+	})
+}
+
+type profileDirectory struct {
+	NewOrder string `json:"newOrder"`
+	Meta     struct {
+		Profiles map[string]string `json:"profiles"`
+	} `json:"meta"`
+}
+
+type profileTransport struct {
+	profile *Profile
+	key     crypto.PrivateKey
+	next    http.RoundTripper
+
+	// The directory as last retrieved by the client library, which caches it
+	// for the lifetime of the RealmClient.
+	dirMutex sync.Mutex
+	dir      *profileDirectory
+}
+
+func (t *profileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dir := t.directory()
+	if req.Method == "POST" && dir != nil && dir.NewOrder != "" && req.URL.String() == dir.NewOrder {
+		return t.roundTripNewOrder(req, dir)
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != "GET" || req.URL.String() != t.profile.DirectoryURL || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+
+	// Note the newOrder URL and the profiles offered, leaving the body for the
+	// client library to decode.
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	dir = &profileDirectory{}
+	if json.Unmarshal(b, dir) == nil {
+		t.dirMutex.Lock()
+		t.dir = dir
+		t.dirMutex.Unlock()
+	}
+
+	return res, nil
+}
+
+func (t *profileTransport) directory() *profileDirectory {
+	t.dirMutex.Lock()
+	defer t.dirMutex.Unlock()
+
+	return t.dir
+}
+
+// Adds the profile to the payload of a newOrder request and signs it again
+// with the same protected header.
+func (t *profileTransport) roundTripNewOrder(req *http.Request, dir *profileDirectory) (*http.Response, error) {
+	if _, ok := dir.Meta.Profiles[t.profile.Name]; !ok {
+		req.Body.Close()
+		return problemResponse(req, http.StatusBadRequest, "urn:ietf:params:acme:error:invalidProfile",
+			fmt.Sprintf("provider %q does not offer profile %q", t.profile.DirectoryURL, t.profile.Name)), nil
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := jose.ParseSigned(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sig.Signatures) != 1 {
+		return nil, fmt.Errorf("newOrder request has %d signatures", len(sig.Signatures))
+	}
+
+	// The request was signed by the client library with t.key, so there is no
+	// need to verify it.
+	var payload map[string]json.RawMessage
+	err = json.Unmarshal(sig.UnsafePayloadWithoutVerification(), &payload)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode newOrder request: %v", err)
+	}
+
+	payload["profile"], err = json.Marshal(t.profile.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	pb, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sig.Signatures[0].Protected
+	extraHeaders := map[jose.HeaderKey]interface{}{
+		"url": h.ExtraHeaders["url"],
+	}
+	if h.KeyID != "" {
+		extraHeaders["kid"] = h.KeyID
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(h.Algorithm),
+		Key:       t.key,
+	}, &jose.SignerOptions{
+		NonceSource:  staticNonce(h.Nonce),
+		EmbedJWK:     h.JSONWebKey != nil,
+		ExtraHeaders: extraHeaders,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := signer.Sign(pb)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []byte(signed.FullSerialize())
+
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	return t.next.RoundTrip(req)
+}
+
+// Supplies the nonce of the request being signed again.
+type staticNonce string
+
+func (n staticNonce) Nonce() (string, error) {
+	return string(n), nil
+}
+
+// Makes a response carrying an ACME problem document, which the client
+// library decodes like one sent by the provider.
+func problemResponse(req *http.Request, status int, problemType, detail string) *http.Response {
+	b, _ := json.Marshal(&acmeapi.Problem{
+		Type:   problemType,
+		Detail: detail,
+		Status: status,
+	})
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/problem+json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}
+}
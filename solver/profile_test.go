@@ -0,0 +1,233 @@
+package solver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2"
+	jose "gopkg.in/square/go-jose.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// A minimal ACME server which accepts newOrder requests from a single
+// account.
+type testProfileServer struct {
+	t        *testing.T
+	srv      *httptest.Server
+	key      *ecdsa.PrivateKey
+	profiles map[string]string
+
+	mutex       sync.Mutex
+	nonce       int
+	nonces      map[string]bool
+	badNonces   int
+	directories int
+	orders      []string
+}
+
+func newTestProfileServer(t *testing.T, profiles map[string]string) *testProfileServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s := &testProfileServer{t: t, key: key, profiles: profiles, nonces: map[string]bool{}}
+	s.srv = httptest.NewTLSServer(s)
+	return s
+}
+
+func (s *testProfileServer) account() *acmeapi.Account {
+	return &acmeapi.Account{
+		URL:        s.srv.URL + "/acct/1",
+		PrivateKey: s.key,
+	}
+}
+
+func (s *testProfileServer) realmClient(t *testing.T, name string) *acmeapi.RealmClient {
+	p := &Profile{
+		Name:         name,
+		DirectoryURL: s.srv.URL + "/directory",
+		HTTPClient:   s.srv.Client(),
+	}
+
+	rc, err := p.NewRealmClient(s.key)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return rc
+}
+
+func (s *testProfileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nonce++
+	nonce := fmt.Sprintf("nonce-%d", s.nonce)
+	s.nonces[nonce] = true
+	rw.Header().Set("Replay-Nonce", nonce)
+
+	switch req.URL.Path {
+	case "/directory":
+		s.directories++
+		dir := map[string]interface{}{
+			"newNonce":   s.srv.URL + "/new-nonce",
+			"newAccount": s.srv.URL + "/new-account",
+			"newOrder":   s.srv.URL + "/new-order",
+		}
+		if s.profiles != nil {
+			dir["meta"] = map[string]interface{}{"profiles": s.profiles}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(dir)
+
+	case "/new-nonce":
+
+	case "/new-order":
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			s.t.Errorf("error: %v", err)
+			return
+		}
+
+		sig, err := jose.ParseSigned(string(b))
+		if err != nil {
+			s.t.Errorf("error: %v", err)
+			return
+		}
+
+		payload, err := sig.Verify(&s.key.PublicKey)
+		if err != nil {
+			s.t.Errorf("newOrder request not signed with account key: %v", err)
+			return
+		}
+
+		h := sig.Signatures[0].Protected
+		if h.KeyID != s.srv.URL+"/acct/1" || h.ExtraHeaders["url"] != s.srv.URL+"/new-order" || h.JSONWebKey != nil {
+			s.t.Errorf("unexpected newOrder header: %+v", h)
+		}
+
+		// Each nonce issued can be used once.
+		if !s.nonces[h.Nonce] {
+			s.t.Errorf("newOrder request with nonce not issued or already used: %q", h.Nonce)
+		}
+		delete(s.nonces, h.Nonce)
+
+		if s.badNonces > 0 {
+			s.badNonces--
+			rw.Header().Set("Content-Type", "application/problem+json")
+			rw.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(rw, `{"type":"urn:ietf:params:acme:error:badNonce","detail":"bad nonce"}`)
+			return
+		}
+
+		s.orders = append(s.orders, string(payload))
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.srv.URL, len(s.orders)))
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(rw, `{"status":"pending"}`)
+
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func testOrder() *acmeapi.Order {
+	return &acmeapi.Order{
+		Identifiers: []acmeapi.Identifier{
+			{Type: acmeapi.IdentifierTypeDNS, Value: "example.com"},
+			{Type: IdentifierTypeIP, Value: "192.0.2.1"},
+		},
+	}
+}
+
+func TestProfileNewOrder(t *testing.T) {
+	s := newTestProfileServer(t, map[string]string{"classic": "", "shortlived": ""})
+	defer s.srv.Close()
+
+	rc := s.realmClient(t, "shortlived")
+	for i := 1; i <= 2; i++ {
+		order := testOrder()
+		err := rc.NewOrder(context.Background(), s.account(), order)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if order.URL != fmt.Sprintf("%s/order/%d", s.srv.URL, i) || order.Status != acmeapi.OrderPending {
+			t.Fatalf("order not loaded: %#v", order)
+		}
+	}
+
+	if len(s.orders) != 2 {
+		t.Fatalf("unexpected number of orders: %d", len(s.orders))
+	}
+
+	var newOrder struct {
+		Identifiers []acmeapi.Identifier `json:"identifiers"`
+		Profile     string               `json:"profile"`
+	}
+	err := json.Unmarshal([]byte(s.orders[0]), &newOrder)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if newOrder.Profile != "shortlived" || len(newOrder.Identifiers) != 2 ||
+		newOrder.Identifiers[0].Value != "example.com" || newOrder.Identifiers[1].Type != IdentifierTypeIP {
+		t.Fatalf("unexpected newOrder payload: %s", s.orders[0])
+	}
+
+	// The client library retrieves the directory once per client.
+	if s.directories != 1 {
+		t.Fatalf("directory retrieved %d times", s.directories)
+	}
+}
+
+// A profile which the provider does not offer is not requested.
+func TestProfileNotOffered(t *testing.T) {
+	for _, profiles := range []map[string]string{nil, {"classic": ""}} {
+		s := newTestProfileServer(t, profiles)
+		defer s.srv.Close()
+
+		err := s.realmClient(t, "shortlived").NewOrder(context.Background(), s.account(), testOrder())
+		he, ok := err.(*acmeapi.HTTPError)
+		if !ok || he.Problem == nil || he.Problem.Type != "urn:ietf:params:acme:error:invalidProfile" {
+			t.Fatalf("expected invalid profile error, got %v", err)
+		}
+
+		if len(s.orders) != 0 {
+			t.Fatalf("order created for profile not offered")
+		}
+	}
+}
+
+// A request rejected for a bad nonce is retried by the client library with a
+// fresh nonce, and still requests the profile.
+func TestProfileBadNonce(t *testing.T) {
+	s := newTestProfileServer(t, map[string]string{"shortlived": ""})
+	defer s.srv.Close()
+
+	s.badNonces = 2
+	err := s.realmClient(t, "shortlived").NewOrder(context.Background(), s.account(), testOrder())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if s.badNonces != 0 || len(s.orders) != 1 {
+		t.Fatalf("request not retried: %d bad nonces left, %d orders", s.badNonces, len(s.orders))
+	}
+
+	var newOrder struct {
+		Profile string `json:"profile"`
+	}
+	err = json.Unmarshal([]byte(s.orders[0]), &newOrder)
+	if err != nil || newOrder.Profile != "shortlived" {
+		t.Fatalf("profile not requested on retry: %s", s.orders[0])
+	}
+}
@@ -15,11 +15,39 @@ type Store interface {
 	// is not found.
 	AccountByID(accountID string) *Account
 	AccountByDirectoryURL(directoryURL string) *Account
+	AccountByLabel(label, directoryURL string) *Account
 	CertificateByID(certificateID string) *Certificate
 	KeyByID(keyID string) *Key
 	TargetByFilename(filename string) *Target
 
 	DefaultTarget() *Target // Returns the default target.
+
+	// Returns the error which occurred loading the default target file, if it
+	// exists but is invalid. The settings it would provide are then missing
+	// from every target, so operations which act on targets should fail.
+	DefaultTargetError() error
+
+	// Returns the errors which prevented target files in the desired directory
+	// from being loaded, keyed by filename. These targets are missing, so
+	// operations which act on all targets should report the errors.
+	TargetErrors() map[string]error
+
+	// Returns the settings of a target and the file each came from.
+	ExplainTarget(filename string) ([]TargetSettingOrigin, error)
+
+	// Checks the contents of a target file, to be stored under the given
+	// filename, for problems. origin identifies the file in the problems
+	// returned.
+	LintTarget(filename, origin string, b []byte) []*TargetProblem
+
+	// Like LintTarget, but label conflicts are checked against the targets as
+	// they would be after the target files in changes were written to the
+	// desired directory, or removed where the data is nil.
+	LintTargetWith(filename, origin string, b []byte, changes map[string][]byte) []*TargetProblem
+
+	// Checks the contents of a default target file for problems.
+	LintDefaultTarget(b []byte) []*TargetProblem
+
 	PreferredCertificateForHostname(hostname string) (*Certificate, error)
 	VisitPreferredCertificates(func(hostname string, c *Certificate) error) error
 
@@ -30,25 +58,58 @@ type Store interface {
 	VisitKeys(func(*Key) error) error
 	VisitTargets(func(*Target) error) error
 
+	// Calls the given function with the ID of each compromised key which is
+	// still in the keys directory but is not loaded, because every
+	// certificate using it has been revoked. Such keys can be removed using
+	// RemoveKey or EraseKey.
+	VisitCompromisedKeys(func(keyID string) error) error
+
 	// Mutators.
 	SaveTarget(*Target) error           // Saves a target.
 	RemoveTarget(filename string) error // Remove a target from the database.
 
-	SaveCertificate(*Certificate) error // Saves certificate information.
-	SaveAccount(*Account) error         // Save account information.
+	// Access target files in the desired directory without decoding them. The
+	// targets loaded are not updated until the store is reloaded.
+	ListTargetFiles() ([]string, error)
+	ReadTargetFile(filename string) ([]byte, error)
+	WriteTargetFile(filename string, data []byte) error
+
+	SaveCertificate(*Certificate) error                         // Saves certificate information.
+	SaveOCSPResponse(c *Certificate, ocspResponse []byte) error // Saves an OCSP response for a certificate.
+	SaveAccount(*Account) error                                 // Save account information.
 
 	// Erase a whole certificate directory including URL, certificates, etc.
 	RemoveCertificate(certificateID string) error
 	// Erase a private key directory.
 	RemoveKey(keyID string) error
+	// Erase a private key directory, overwriting the private key file first.
+	EraseKey(keyID string) error
+
+	// Adds a key to the compromised key list, so that it is never used for a
+	// certificate or imported again.
+	MarkKeyCompromised(keyID string) error
+	// Returns true iff the key is on the compromised key list.
+	IsKeyCompromised(keyID string) bool
 
 	ImportKey(privateKey crypto.PrivateKey) (*Key, error)                              // Imports the key if it isn't already imported.
 	ImportAccount(directoryURL string, privateKey crypto.PrivateKey) (*Account, error) // Imports an account key if it isn't already imported.
 	ImportCertificate(acct *Account, url string) (*Certificate, error)                 // Imports a certificate if it isn't already imported.
+	ImportExternalCertificate(certs [][]byte) (*Certificate, error)                    // Imports a certificate not obtained via ACME if it isn't already imported.
 
 	SetPreferredCertificateForHostname(hostname string, c *Certificate) error
 
+	// Links the files of certificate kc from the directory of certificate c
+	// with the key type as a suffix, e.g. "fullchain-ecdsa".
+	SetCertificateForKeyType(c *Certificate, keyType string, kc *Certificate) error
+
+	// Removes the links created by SetCertificateForKeyType for the key type.
+	RemoveCertificateForKeyType(c *Certificate, keyType string) error
+
+	// Records a key pregenerated for use by the successor of a certificate.
+	SetNextKey(c *Certificate, k *Key) error
+
 	WriteMiscellaneousConfFile(filename string, data []byte) error
+	ReadMiscellaneousConfFile(filename string) ([]byte, error)
 }
 
 // Return this sentinel value to stop visitation.
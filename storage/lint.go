@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2"
+	"gopkg.in/yaml.v2"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A problem found in a target file or a template it uses.
+type TargetProblem struct {
+	// The file containing the problem, e.g. "desired/example.com".
+	Origin string
+
+	// The position of the problem in the file, counting from 1. Zero if
+	// unknown.
+	Line, Column int
+
+	Message string
+}
+
+func (p *TargetProblem) Error() string {
+	switch {
+	case p.Line == 0:
+		return fmt.Sprintf("%s: %s", p.Origin, p.Message)
+	case p.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", p.Origin, p.Line, p.Message)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", p.Origin, p.Line, p.Column, p.Message)
+	}
+}
+
+// Checks a target file for problems which would prevent it from loading or
+// from working as intended. filename is the filename the target would have in
+// the desired directory, and origin identifies the file in problems reported.
+//
+// Besides the errors which prevent a target from loading, the settings must
+// have valid values, webroot paths and trust stores must exist, and no name
+// may be in another target with the same label, priority and number of names,
+// which would make the choice of certificate for that name arbitrary.
+func (s *fdbStore) LintTarget(filename, origin string, b []byte) []*TargetProblem {
+	return s.LintTargetWith(filename, origin, b, nil)
+}
+
+// Like LintTarget, but label conflicts are checked against the targets as they
+// would be after the target files in changes were written to the desired
+// directory, or removed where the data is nil.
+func (s *fdbStore) LintTargetWith(filename, origin string, b []byte, changes map[string][]byte) []*TargetProblem {
+	layers, err := s.targetLayers(origin, b)
+	if err != nil {
+		return []*TargetProblem{s.problemAt(layers, origin, b, "template", err.Error())}
+	}
+
+	var problems []*TargetProblem
+	for _, layer := range layers {
+		err := yaml.UnmarshalStrict(layer.Data, &Target{})
+		if err != nil {
+			problems = append(problems, yamlProblems(layer, err)...)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	t, err := s.parseTarget(filename, b, false)
+	if err != nil {
+		return []*TargetProblem{{Origin: origin, Message: err.Error()}}
+	}
+
+	settings, err := s.explainLayers(layers)
+	if err != nil {
+		return []*TargetProblem{{Origin: origin, Message: err.Error()}}
+	}
+
+	for _, sp := range t.settingProblems() {
+		o, ok := settings[sp.setting]
+		if !ok {
+			problems = append(problems, &TargetProblem{Origin: origin, Message: sp.message})
+			continue
+		}
+
+		problems = append(problems, s.problemAt(layers, o.Origin, nil, sp.setting, sp.message))
+	}
+
+	for _, msg := range labelConflicts(t, s.plannedTargets(changes)) {
+		problems = append(problems, s.problemAt(layers, origin, b, "label", msg))
+	}
+
+	return problems
+}
+
+// Checks a default target file for problems. Settings are checked as for
+// LintTarget, but the default target is not checked for label conflicts.
+func (s *fdbStore) LintDefaultTarget(b []byte) []*TargetProblem {
+	layer := targetLayer{Origin: "conf/target", Data: b}
+	err := yaml.UnmarshalStrict(b, &Target{})
+	if err != nil {
+		return yamlProblems(layer, err)
+	}
+
+	t, err := s.parseTarget("target", b, true)
+	if err != nil {
+		return []*TargetProblem{{Origin: layer.Origin, Message: err.Error()}}
+	}
+
+	var problems []*TargetProblem
+	for _, sp := range t.settingProblems() {
+		problems = append(problems, s.problemAt(nil, layer.Origin, b, sp.setting, sp.message))
+	}
+
+	return problems
+}
+
+type settingProblem struct {
+	setting, message string
+}
+
+// Semantic checks on the values of settings.
+func (t *Target) settingProblems() []settingProblem {
+	var problems []settingProblem
+	add := func(setting, format string, args ...interface{}) {
+		problems = append(problems, settingProblem{setting, fmt.Sprintf(format, args...)})
+	}
+
+	if t.Request.Provider != "" && !acmeapi.ValidURL(t.Request.Provider) {
+		add("request.provider", "invalid provider URL: %q", t.Request.Provider)
+	}
+
+	for _, p := range t.Request.Providers {
+		if !acmeapi.ValidURL(p) {
+			add("request.providers", "invalid provider URL: %q", p)
+		}
+	}
+
+	if t.Request.Key.Type != "" && !IsSupportedKeyType(t.Request.Key.Type) {
+		add("request.key.type", "unsupported key type: %q", t.Request.Key.Type)
+	}
+
+	if t.Satisfy.Key.Type != "" && !IsSupportedKeyType(t.Satisfy.Key.Type) {
+		add("satisfy.key.type", "unsupported key type: %q", t.Satisfy.Key.Type)
+	}
+
+	if c := t.Request.Key.ECDSACurve; c != "" && clampECDSACurve(c) != c {
+		add("request.key.ecdsa-curve", "unsupported ECDSA curve: %q", c)
+	}
+
+	if n := t.Request.Key.RSASize; n != 0 && clampRSAKeySize(n) != n {
+		add("request.key.rsa-size", "RSA key size must be between %d and %d: %d", minRSASize, maxRSASize, n)
+	}
+
+	if t.Satisfy.Margin < 0 {
+		add("satisfy.margin", "margin must not be negative: %d", t.Satisfy.Margin)
+	}
+
+	for _, wp := range t.Request.Challenge.WebrootPaths {
+		fi, err := os.Stat(wp)
+		if err != nil {
+			add("request.challenge.webroot-paths", "webroot path does not exist: %q", wp)
+		} else if !fi.IsDir() {
+			add("request.challenge.webroot-paths", "webroot path is not a directory: %q", wp)
+		}
+	}
+
+	if ts := t.Request.TrustStore; ts != "" && ts != "system" {
+		if _, err := os.Stat(ts); err != nil {
+			add("request.trust-store", "trust store does not exist: %q", ts)
+		}
+	}
+
+	if strings.Contains(t.Label, "/") {
+		add("label", "label must not contain '/': %q", t.Label)
+	}
+
+	return problems
+}
+
+// Returns a description of each name of the target which is also in another
+// target with the same label, priority and number of names. A name in several
+// targets is normally linked to the certificate of the target with the highest
+// priority or, failing that, the most names, so a conflict only arises if
+// these are equal.
+func labelConflicts(t *Target, targets []*Target) []string {
+	var conflicts []string
+	for _, ot := range targets {
+		if ot.Filename == t.Filename || ot.PackedFrom == t.Filename || ot.Label != t.Label || ot.Priority != t.Priority ||
+			len(ot.Satisfy.Names) != len(t.Satisfy.Names) {
+			continue
+		}
+
+		filename := ot.Filename
+		if ot.PackedFrom != "" {
+			filename = ot.PackedFrom
+		}
+
+		for _, name := range t.Satisfy.Names {
+			if containsName(ot.Satisfy.Names, name) {
+				conflicts = append(conflicts, fmt.Sprintf("%q is also in target %q with label %q, priority %d and %d names", name, filename, t.Label, t.Priority, len(t.Satisfy.Names)))
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// Returns a problem located at the given setting in the file with the given
+// origin. b is the content of the file, or nil to find it among the layers.
+func (s *fdbStore) problemAt(layers []targetLayer, origin string, b []byte, setting, message string) *TargetProblem {
+	if b == nil {
+		for _, layer := range layers {
+			if layer.Origin == origin {
+				b = layer.Data
+			}
+		}
+	}
+
+	line, col := locateSetting(b, strings.Split(setting, "."))
+	return &TargetProblem{Origin: origin, Line: line, Column: col, Message: message}
+}
+
+var reYAMLLine = regexp.MustCompile(`line (\d+): (.*)`)
+var reYAMLUnknownField = regexp.MustCompile(`^field (\S+) not found`)
+
+// Converts a YAML decoding error into problems, extracting the line numbers
+// yaml reports. For unknown fields, the column of the field is also found.
+func yamlProblems(layer targetLayer, err error) []*TargetProblem {
+	var msgs []string
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	} else {
+		msgs = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	lines := strings.Split(string(layer.Data), "\n")
+
+	var problems []*TargetProblem
+	for _, msg := range msgs {
+		p := &TargetProblem{Origin: layer.Origin, Message: msg}
+		if m := reYAMLLine.FindStringSubmatch(msg); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			p.Message = m[2]
+
+			if p.Line > 0 && p.Line <= len(lines) {
+				text := lines[p.Line-1]
+				p.Column = len(text) - len(strings.TrimLeft(text, " \t")) + 1
+				if fm := reYAMLUnknownField.FindStringSubmatch(p.Message); fm != nil {
+					if i := strings.Index(text, fm[1]); i >= 0 {
+						p.Column = i + 1
+					}
+				}
+			}
+		}
+
+		problems = append(problems, p)
+	}
+
+	return problems
+}
+
+// Finds the line and column of the key of a setting in a YAML file written in
+// block style. Returns zeroes if it cannot be found.
+func locateSetting(b []byte, path []string) (line, col int) {
+	type key struct {
+		indent int
+		name   string
+	}
+
+	var stack []key
+	for i, text := range strings.Split(string(b), "\n") {
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+
+		colon := strings.Index(trimmed, ":")
+		if colon < 0 {
+			continue
+		}
+
+		indent := len(text) - len(trimmed)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		stack = append(stack, key{indent, strings.Trim(strings.TrimSpace(trimmed[:colon]), `"'`)})
+		if len(stack) != len(path) {
+			continue
+		}
+
+		match := true
+		for j := range path {
+			if stack[j].name != path[j] {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return i + 1, indent + 1
+		}
+	}
+
+	return 0, 0
+}
+
+// Returns the targets as they would be after the target files in changes were
+// written to the desired directory, or removed where the data is nil. Target
+// files which cannot be parsed are omitted.
+func (s *fdbStore) plannedTargets(changes map[string][]byte) []*Target {
+	var targets []*Target
+	for _, t := range s.targets {
+		filename := t.Filename
+		if t.PackedFrom != "" {
+			filename = t.PackedFrom
+		}
+
+		if _, ok := changes[filename]; !ok {
+			targets = append(targets, t)
+		}
+	}
+
+	for filename, b := range changes {
+		if b == nil {
+			continue
+		}
+
+		t, err := s.parseTarget(filename, b, false)
+		if err != nil {
+			continue
+		}
+
+		if t.Pack.IsSet() {
+			targets = append(targets, s.packTarget(t)...)
+		} else {
+			targets = append(targets, t)
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSettingProblems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetool-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	tgt := &Target{}
+	tgt.Request.Provider = "https://ca.example.com/directory"
+	tgt.Request.Key.Type = "ecdsa"
+	tgt.Request.Key.ECDSACurve = "nistp384"
+	tgt.Request.Key.RSASize = 4096
+	tgt.Request.Challenge.WebrootPaths = []string{dir}
+	tgt.Request.TrustStore = "system"
+	tgt.Label = "foo"
+	if problems := tgt.settingProblems(); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	tgt = &Target{}
+	tgt.Request.Provider = "http://ca.example.com/directory"
+	tgt.Request.Providers = []string{"https://ca.example.com/directory", "ca.example.net"}
+	tgt.Request.Key.Type = "dsa"
+	tgt.Satisfy.Key.Type = "ed25519"
+	tgt.Request.Key.ECDSACurve = "nistp999"
+	tgt.Request.Key.RSASize = 512
+	tgt.Satisfy.Margin = -1
+	tgt.Request.Challenge.WebrootPaths = []string{filepath.Join(dir, "missing"), file}
+	tgt.Request.TrustStore = filepath.Join(dir, "missing.pem")
+	tgt.Label = "foo/bar"
+
+	expected := []string{
+		"request.provider",
+		"request.providers",
+		"request.key.type",
+		"satisfy.key.type",
+		"request.key.ecdsa-curve",
+		"request.key.rsa-size",
+		"satisfy.margin",
+		"request.challenge.webroot-paths",
+		"request.challenge.webroot-paths",
+		"request.trust-store",
+		"label",
+	}
+
+	problems := tgt.settingProblems()
+	if len(problems) != len(expected) {
+		t.Fatalf("got problems %v, expected problems with %v", problems, expected)
+	}
+
+	for i, p := range problems {
+		if p.setting != expected[i] || p.message == "" {
+			t.Fatalf("got problems %v, expected problems with %v", problems, expected)
+		}
+	}
+}
+
+func TestLabelConflicts(t *testing.T) {
+	newTarget := func(filename, label string, priority int, names ...string) *Target {
+		tgt := &Target{Filename: filename, Label: label, Priority: priority}
+		tgt.Satisfy.Names = names
+		return tgt
+	}
+
+	tgt := newTarget("a", "", 0, "x.example.com", "y.example.com")
+
+	packed := newTarget("pack-1", "", 0, "y.example.com", "v.example.com")
+	packed.PackedFrom = "pack"
+
+	ownPacked := newTarget("a-1", "", 0, "x.example.com", "y.example.com")
+	ownPacked.PackedFrom = "a"
+
+	targets := []*Target{
+		tgt,
+		ownPacked,
+		newTarget("b", "", 0, "x.example.com", "z.example.com"),
+		// Different number of names, priority or label.
+		newTarget("c", "", 0, "x.example.com"),
+		newTarget("d", "", 1, "y.example.com", "w.example.com"),
+		newTarget("e", "other", 0, "y.example.com", "w.example.com"),
+		packed,
+	}
+
+	conflicts := labelConflicts(tgt, targets)
+	if len(conflicts) != 2 ||
+		!strings.HasPrefix(conflicts[0], `"x.example.com" is also in target "b"`) ||
+		!strings.HasPrefix(conflicts[1], `"y.example.com" is also in target "pack"`) {
+		t.Fatalf("unexpected conflicts: %q", conflicts)
+	}
+
+	if conflicts := labelConflicts(tgt, targets[3:6]); len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %q", conflicts)
+	}
+}
+
+func TestLocateSetting(t *testing.T) {
+	b := []byte(`satisfy:
+  names:
+    - example.com
+request:
+  # comment
+  provider: https://ca.example.com/directory
+  key:
+    type: rsa
+  "ocsp-must-staple": true
+label: foo
+`)
+
+	tests := []struct {
+		setting   string
+		line, col int
+	}{
+		{"satisfy.names", 2, 3},
+		{"request.provider", 6, 3},
+		{"request.key.type", 8, 5},
+		{"request.ocsp-must-staple", 9, 3},
+		{"label", 10, 1},
+		{"request.key.rsa-size", 0, 0},
+		{"key.type", 0, 0},
+		{"request", 4, 1},
+	}
+
+	for _, tst := range tests {
+		line, col := locateSetting(b, strings.Split(tst.setting, "."))
+		if line != tst.line || col != tst.col {
+			t.Fatalf("locateSetting(%q) = %d, %d, expected %d, %d", tst.setting, line, col, tst.line, tst.col)
+		}
+	}
+}
+
+// Problems are reported with the position of the setting responsible, as
+// shown by "acmetool lint".
+func TestLintTarget(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	tests := []struct {
+		data     string
+		problems []string
+	}{
+		{"satisfy:\n  names:\n    - example.com\n", nil},
+		{"satisfy:\n  names:\n    - example.com\nrequest:\n  colour: blue\n", []string{
+			"desired/example.com:5:3: field colour not found",
+		}},
+		{"satisfy:\n  names:\n    - example.com\nrequest:\n  key:\n    rsa-size: 512\n  provider: http://ca.example.com/\n", []string{
+			"desired/example.com:6:5: RSA key size must be between",
+			"desired/example.com:7:3: invalid provider URL",
+		}},
+	}
+
+	for i, tst := range tests {
+		problems := s.LintTarget("example.com", "desired/example.com", []byte(tst.data))
+		if len(problems) != len(tst.problems) {
+			t.Fatalf("%d: got problems %v, expected %q", i, problems, tst.problems)
+		}
+
+		// The order of setting problems is not significant.
+		for _, expected := range tst.problems {
+			found := false
+			for _, p := range problems {
+				if strings.HasPrefix(p.Error(), expected) {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Fatalf("%d: got problems %v, expected %q", i, problems, tst.problems)
+			}
+		}
+	}
+}
+
+// A target file with an unknown setting is not loaded, and the error is
+// reported rather than the target being silently ignored.
+func TestTargetErrors(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for filename, data := range map[string]string{
+		"good.example.com": "satisfy:\n  names:\n    - good.example.com\n",
+		"bad.example.com":  "satisfy:\n  names:\n    - bad.example.com\nobsolete: true\n",
+	} {
+		err := ioutil.WriteFile(filepath.Join(s.Path(), "desired", filename), []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	err := s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if s.TargetByFilename("good.example.com") == nil {
+		t.Fatalf("valid target not loaded")
+	}
+
+	if s.TargetByFilename("bad.example.com") != nil {
+		t.Fatalf("invalid target loaded")
+	}
+
+	errs := s.TargetErrors()
+	if len(errs) != 1 || errs["bad.example.com"] == nil || !strings.Contains(errs["bad.example.com"].Error(), "obsolete") {
+		t.Fatalf("unexpected target errors: %v", errs)
+	}
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The maximum number of names placed in a certificate by a pack target if
+// pack.max-names is not set. This is the SAN limit of Let's Encrypt.
+const DefaultPackMaxNames = 100
+
+// Settings for a pack target. The names of a pack target are divided among as
+// few generated targets as possible, each of which has at most MaxNames names,
+// so that one certificate is requested per generated target.
+type TargetPack struct {
+	// N. Names to be packed.
+	Names []string `yaml:"names,omitempty"`
+
+	// N. Path to a directory, each entry of which is named after a name to be
+	// packed. Relative paths are relative to the state directory.
+	Directory string `yaml:"directory,omitempty"`
+
+	// N. The maximum number of names per certificate. Defaults to
+	// DefaultPackMaxNames.
+	MaxNames int `yaml:"max-names,omitempty"`
+}
+
+// Returns true iff the target is a pack target.
+func (p *TargetPack) IsSet() bool {
+	return len(p.Names) > 0 || p.Directory != ""
+}
+
+func (p *TargetPack) maxNames() int {
+	if p.MaxNames <= 0 {
+		return DefaultPackMaxNames
+	}
+
+	return p.MaxNames
+}
+
+// Determines the full list of names of a pack target from its names list and
+// directory.
+func (s *fdbStore) loadPackNames(t *Target) ([]string, error) {
+	if len(t.Satisfy.Names) > 0 || len(t.Request.Names) > 0 || len(t.LegacyNames) > 0 {
+		return nil, fmt.Errorf("a pack target cannot also specify names to be satisfied or requested")
+	}
+
+	if t.Pack.MaxNames < 0 {
+		return nil, fmt.Errorf("pack.max-names must not be negative")
+	}
+
+	names := append([]string(nil), t.Pack.Names...)
+	err := normalizeNames(names)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Pack.Directory != "" {
+		dir := t.Pack.Directory
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(s.path, dir)
+		}
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+
+			name, err := NormalizeName(e.Name())
+			if err != nil {
+				log.Warnf("ignoring invalid name in pack directory %q: %v", dir, err)
+				continue
+			}
+
+			names = append(names, name)
+		}
+	}
+
+	seen := map[string]struct{}{}
+	var unique []string
+	for _, name := range names {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			unique = append(unique, name)
+		}
+	}
+
+	sort.Strings(unique)
+	return unique, nil
+}
+
+// Generates the targets among which the names of a pack target are divided.
+// Names which are currently served by the same preferred certificate are kept
+// together so that packing does not cause certificates to be reissued
+// needlessly.
+func (s *fdbStore) packTarget(t *Target) []*Target {
+	current := map[string]string{}
+	for _, name := range t.Satisfy.Names {
+		if c := s.preferred[LiveName(name, t.Label)]; c != nil {
+			current[name] = c.ID()
+		}
+	}
+
+	var targets []*Target
+	for i, names := range packNames(t.Satisfy.Names, current, t.Pack.maxNames()) {
+		pt := t.Copy()
+		pt.Pack = TargetPack{}
+		pt.PackedFrom = t.Filename
+		pt.Filename = fmt.Sprintf("%s#%d", t.Filename, i+1)
+		pt.Satisfy.Names = names
+		pt.Request.Names = names
+		pt.Request.implicitNames = true
+		targets = append(targets, pt)
+	}
+
+	return targets
+}
+
+// Divides names into groups of at most maxNames names with as little change
+// to the existing groups as possible. current maps names to an identifier for
+// the group they are currently in, i.e. the certificate currently serving
+// them; names not in it are new.
+//
+// Existing groups are kept (less any names which have been removed), new names
+// are added to the groups with the most room first, and new groups are only
+// created when the existing groups are full. Finally, the smallest groups are
+// merged while they fit together, so that a group only changes when doing so
+// reduces the number of certificates. Returns the groups, each sorted, in
+// order of their first name.
+func packNames(names []string, current map[string]string, maxNames int) [][]string {
+	var groups [][]string
+	var unassigned []string
+	groupIndex := map[string]int{}
+	for _, name := range names {
+		id, ok := current[name]
+		if !ok {
+			unassigned = append(unassigned, name)
+			continue
+		}
+
+		i, ok := groupIndex[id]
+		if !ok {
+			i = len(groups)
+			groupIndex[id] = i
+			groups = append(groups, nil)
+		}
+
+		groups[i] = append(groups[i], name)
+	}
+
+	// Split groups which are too large, e.g. because max-names was lowered.
+	for i := range groups {
+		sort.Strings(groups[i])
+		if len(groups[i]) > maxNames {
+			unassigned = append(unassigned, groups[i][maxNames:]...)
+			groups[i] = groups[i][:maxNames]
+		}
+	}
+
+	sort.Strings(unassigned)
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i]) < len(groups[j])
+	})
+
+	for i := 0; len(unassigned) > 0; i++ {
+		if i == len(groups) {
+			groups = append(groups, nil)
+		}
+
+		n := maxNames - len(groups[i])
+		if n > len(unassigned) {
+			n = len(unassigned)
+		}
+
+		groups[i] = append(groups[i], unassigned[:n]...)
+		unassigned = unassigned[n:]
+	}
+
+	for {
+		sort.SliceStable(groups, func(i, j int) bool {
+			return len(groups[i]) < len(groups[j])
+		})
+
+		if len(groups) < 2 || len(groups[0])+len(groups[1]) > maxNames {
+			break
+		}
+
+		groups[1] = append(groups[1], groups[0]...)
+		groups = groups[1:]
+	}
+
+	for _, g := range groups {
+		sort.Strings(g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0] < groups[j][0]
+	})
+
+	return groups
+}
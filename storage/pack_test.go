@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackNames(t *testing.T) {
+	tests := []struct {
+		names    []string
+		current  map[string]string
+		maxNames int
+		groups   [][]string
+	}{
+		// Initial packing.
+		{
+			names:    []string{"a", "b", "c", "d", "e"},
+			maxNames: 2,
+			groups:   [][]string{{"a", "b"}, {"c", "d"}, {"e"}},
+		},
+		// A new name goes into the group with room rather than a new group.
+		{
+			names:    []string{"a", "b", "c", "d", "e", "f"},
+			current:  map[string]string{"a": "1", "b": "1", "c": "2", "d": "2", "e": "3"},
+			maxNames: 2,
+			groups:   [][]string{{"a", "b"}, {"c", "d"}, {"e", "f"}},
+		},
+		// Removing a name leaves the other groups alone.
+		{
+			names:    []string{"a", "c", "d", "e", "f"},
+			current:  map[string]string{"a": "1", "b": "1", "c": "2", "d": "2", "e": "3", "f": "3"},
+			maxNames: 2,
+			groups:   [][]string{{"a"}, {"c", "d"}, {"e", "f"}},
+		},
+		// Groups are merged when they fit together.
+		{
+			names:    []string{"a", "c", "e", "f"},
+			current:  map[string]string{"a": "1", "c": "2", "e": "3", "f": "3"},
+			maxNames: 3,
+			groups:   [][]string{{"a", "c"}, {"e", "f"}},
+		},
+		// Groups which are too large are split.
+		{
+			names:    []string{"a", "b", "c"},
+			current:  map[string]string{"a": "1", "b": "1", "c": "1"},
+			maxNames: 2,
+			groups:   [][]string{{"a", "b"}, {"c"}},
+		},
+	}
+
+	for i, tst := range tests {
+		groups := packNames(tst.names, tst.current, tst.maxNames)
+		if !reflect.DeepEqual(groups, tst.groups) {
+			t.Errorf("%d: got %v, expected %v", i, groups, tst.groups)
+		}
+	}
+}
@@ -9,17 +9,23 @@ import (
 	"github.com/hlandau/acmetool/fdb"
 	"github.com/hlandau/acmetool/util"
 	"github.com/hlandau/xlog"
+	"github.com/jmhodges/clock"
 	"gopkg.in/hlandau/acmeapi.v2"
 	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
 	"gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 var log, Log = xlog.New("acme.storage")
 
+// Internal use only. Used for testing purposes. Do not change.
+var InternalClock = clock.Default()
+
 // ACME client store. {{{1
 type fdbStore struct {
 	db *fdb.DB
@@ -29,23 +35,41 @@ type fdbStore struct {
 	accounts      map[string]*Account     // key: account ID
 	keys          map[string]*Key         // key: key ID
 	targets       map[string]*Target      // key: target filename
+	packs         map[string]*Target      // key: pack target filename
 	preferred     map[string]*Certificate // key: hostname
+	compromised   map[string]struct{}     // key: key ID
 	defaultTarget *Target                 // from conf
+
+	// Compromised keys which are still in the keys directory, but are no
+	// longer loaded because every certificate using them has been revoked.
+	compromisedKeys map[string]struct{} // key: key ID
+
+	// The error which occurred loading the default target, if any.
+	defaultTargetErr error
+
+	// The errors which occurred loading target files.
+	targetErrs map[string]error // key: target filename
 }
 
 func (s *fdbStore) WriteMiscellaneousConfFile(filename string, data []byte) error {
 	return fdb.WriteBytes(s.db.Collection("conf"), filename, data)
 }
 
+func (s *fdbStore) ReadMiscellaneousConfFile(filename string) ([]byte, error) {
+	return fdb.Bytes(s.db.Collection("conf").Open(filename))
+}
+
 // Trivial accessors. {{{1
 
 func (s *fdbStore) AccountByID(accountID string) *Account {
 	return s.accounts[accountID]
 }
 
+// Only accounts without a label are returned, since labelled accounts are only
+// for the targets which select them.
 func (s *fdbStore) AccountByDirectoryURL(directoryURL string) *Account {
 	for _, a := range s.accounts {
-		if a.MatchesURL(directoryURL) {
+		if a.Label == "" && a.MatchesURL(directoryURL) {
 			return a
 		}
 	}
@@ -53,6 +77,23 @@ func (s *fdbStore) AccountByDirectoryURL(directoryURL string) *Account {
 	return nil
 }
 
+// If directoryURL is "", accounts for any provider match. If several accounts
+// match, the one with the lowest ID is returned.
+func (s *fdbStore) AccountByLabel(label, directoryURL string) *Account {
+	var found *Account
+	for id, a := range s.accounts {
+		if a.Label != label || (directoryURL != "" && !a.MatchesURL(directoryURL)) {
+			continue
+		}
+
+		if found == nil || id < found.ID() {
+			found = a
+		}
+	}
+
+	return found
+}
+
 func (s *fdbStore) VisitAccounts(f func(a *Account) error) error {
 	for _, a := range s.accounts {
 		err := f(a)
@@ -80,7 +121,11 @@ func (s *fdbStore) VisitCertificates(f func(c *Certificate) error) error {
 }
 
 func (s *fdbStore) TargetByFilename(filename string) *Target {
-	return s.targets[filename]
+	if t, ok := s.targets[filename]; ok {
+		return t
+	}
+
+	return s.packs[filename]
 }
 
 func (s *fdbStore) VisitTargets(f func(t *Target) error) error {
@@ -99,6 +144,18 @@ func (s *fdbStore) DefaultTarget() *Target {
 	return s.defaultTarget
 }
 
+// If the default target file exists but could not be loaded, returns the
+// error. An empty default target is used in its place.
+func (s *fdbStore) DefaultTargetError() error {
+	return s.defaultTargetErr
+}
+
+// Returns the errors which prevented target files in the desired directory
+// from being loaded, keyed by filename.
+func (s *fdbStore) TargetErrors() map[string]error {
+	return s.targetErrs
+}
+
 func (s *fdbStore) KeyByID(keyID string) *Key {
 	return s.keys[keyID]
 }
@@ -114,6 +171,17 @@ func (s *fdbStore) VisitKeys(f func(k *Key) error) error {
 	return nil
 }
 
+func (s *fdbStore) VisitCompromisedKeys(f func(keyID string) error) error {
+	for keyID := range s.compromisedKeys {
+		err := f(keyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (s *fdbStore) loadPreferred() error {
 	s.preferred = map[string]*Certificate{}
 
@@ -173,6 +241,76 @@ func (s *fdbStore) SetPreferredCertificateForHostname(hostname string, c *Certif
 	return nil
 }
 
+// Links the certificate files and private key of certificate kc from the
+// directory of certificate c, as "cert-TYPE", "chain-TYPE", "fullchain-TYPE"
+// and "privkey-TYPE". This is used to expose a certificate for each key type
+// requested by a target under the same live/ symlink.
+func (s *fdbStore) SetCertificateForKeyType(c *Certificate, keyType string, kc *Certificate) error {
+	if !IsSupportedKeyType(keyType) {
+		return fmt.Errorf("unsupported key type: %q", keyType)
+	}
+
+	if kc.Key == nil {
+		return fmt.Errorf("cannot link %v for key type %q because its key is not available", kc, keyType)
+	}
+
+	coll := s.db.Collection("certs/" + c.ID())
+	for _, name := range []string{"chain", "fullchain"} {
+		err := coll.WriteLink(name+"-"+keyType, fdb.Link{Target: "certs/" + kc.ID() + "/" + name})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := coll.WriteLink("privkey-"+keyType, fdb.Link{Target: "keys/" + kc.Key.ID + "/privkey"})
+	if err != nil {
+		return err
+	}
+
+	// Written last, as this is the link used to determine the linked
+	// certificate when loading.
+	err = coll.WriteLink("cert-"+keyType, fdb.Link{Target: "certs/" + kc.ID() + "/cert"})
+	if err != nil {
+		return err
+	}
+
+	if c.KeyTypeCertificateIDs == nil {
+		c.KeyTypeCertificateIDs = map[string]string{}
+	}
+	c.KeyTypeCertificateIDs[keyType] = kc.ID()
+	return nil
+}
+
+// Removes the links for the given key type from the directory of certificate
+// c, e.g. because its target no longer requests the key type.
+func (s *fdbStore) RemoveCertificateForKeyType(c *Certificate, keyType string) error {
+	coll := s.db.Collection("certs/" + c.ID())
+
+	// Removed first, as this is the link used to determine the linked
+	// certificate when loading.
+	for _, name := range []string{"cert", "chain", "fullchain", "privkey"} {
+		err := coll.Delete(name + "-" + keyType)
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(c.KeyTypeCertificateIDs, keyType)
+	return nil
+}
+
+// Records k as the key pregenerated for use by the successor of certificate
+// c. The key is linked from the certificate directory as "nextkey".
+func (s *fdbStore) SetNextKey(c *Certificate, k *Key) error {
+	err := s.db.Collection("certs/"+c.ID()).WriteLink("nextkey", fdb.Link{Target: "keys/" + k.ID + "/privkey"})
+	if err != nil {
+		return err
+	}
+
+	c.NextKey = k
+	return nil
+}
+
 // Default paths and permissions. {{{1
 
 // The recommended path is the hardcoded, default, recommended path to be used
@@ -254,6 +392,11 @@ func (s *fdbStore) Reload() error {
 			return err
 		}
 
+		err = s.loadCompromisedKeys()
+		if err != nil {
+			return err
+		}
+
 		err = s.loadKeys()
 		if err != nil {
 			return err
@@ -263,21 +406,20 @@ func (s *fdbStore) Reload() error {
 		if err != nil {
 			return err
 		}
-	}
 
-	err := s.loadTargets()
-	if err != nil {
-		return err
+		s.unloadCompromisedKeys()
 	}
 
+	// Preferred certificates are loaded first because they determine how the
+	// names of pack targets are divided.
 	if !isNeutered {
-		err = s.loadPreferred()
+		err := s.loadPreferred()
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return s.loadTargets()
 }
 
 func (s *fdbStore) loadAccounts() error {
@@ -339,9 +481,15 @@ func (s *fdbStore) validateAccount(serverName, accountName string, c *fdb.Collec
 		return err
 	}
 
+	label, err := fdb.String(c.Open("label"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	account := &Account{
 		PrivateKey:   pk,
 		DirectoryURL: directoryURL,
+		Label:        strings.TrimSpace(label),
 	}
 
 	accountID := account.ID()
@@ -357,6 +505,7 @@ func (s *fdbStore) validateAccount(serverName, accountName string, c *fdb.Collec
 
 func (s *fdbStore) loadKeys() error {
 	s.keys = map[string]*Key{}
+	s.compromisedKeys = map[string]struct{}{}
 
 	c := s.db.Collection("keys")
 
@@ -379,6 +528,34 @@ func (s *fdbStore) loadKeys() error {
 	return nil
 }
 
+// Compromised keys are loaded so that they can be used to sign the
+// revocation requests of the certificates using them. Once every certificate
+// using a compromised key has been revoked, the key is unloaded.
+func (s *fdbStore) unloadCompromisedKeys() {
+	unrevoked := map[string]struct{}{}
+	for _, c := range s.certs {
+		if c.Key != nil && c.Key.Compromised && !c.Revoked {
+			unrevoked[c.Key.ID] = struct{}{}
+		}
+	}
+
+	for keyID, k := range s.keys {
+		if _, ok := unrevoked[keyID]; ok || !k.Compromised {
+			continue
+		}
+
+		log.Debugf("not loading compromised key %q", keyID)
+		delete(s.keys, keyID)
+		s.compromisedKeys[keyID] = struct{}{}
+	}
+
+	for _, c := range s.certs {
+		if c.Key != nil && s.keys[c.Key.ID] == nil {
+			c.Key = nil
+		}
+	}
+}
+
 func (s *fdbStore) validateKey(keyID string, kc *fdb.Collection) error {
 	f, err := kc.Open("privkey")
 	if err != nil {
@@ -406,9 +583,25 @@ func (s *fdbStore) validateKey(keyID string, kc *fdb.Collection) error {
 		return fmt.Errorf("key ID mismatch: %#v != %#v", keyID, actualKeyID)
 	}
 
+	_, compromised := s.compromised[actualKeyID]
 	k := &Key{
-		ID:         actualKeyID,
-		PrivateKey: pk,
+		ID:          actualKeyID,
+		PrivateKey:  pk,
+		Compromised: compromised,
+	}
+
+	created, err := fdb.String(kc.Open("created"))
+	if err == nil {
+		k.Created, err = time.Parse(time.RFC3339, strings.TrimSpace(created))
+		if err != nil {
+			return fmt.Errorf("malformed key creation time: %q: %v", keyID, err)
+		}
+	} else {
+		// Keys created before the creation time was recorded.
+		fi, err := os.Stat(kc.OSPath("privkey"))
+		if err == nil {
+			k.Created = fi.ModTime()
+		}
 	}
 
 	s.keys[actualKeyID] = k
@@ -416,6 +609,34 @@ func (s *fdbStore) validateKey(keyID string, kc *fdb.Collection) error {
 	return nil
 }
 
+// The list of compromised key IDs is stored in conf/compromised-keys, one per
+// line.
+func (s *fdbStore) loadCompromisedKeys() error {
+	s.compromised = map[string]struct{}{}
+
+	ss, err := fdb.String(s.db.Collection("conf").Open("compromised-keys"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(ss, "\n") {
+		keyID := strings.TrimSpace(line)
+		if keyID == "" || strings.HasPrefix(keyID, "#") {
+			continue
+		}
+
+		if !IsWellFormattedCertificateOrKeyID(keyID) {
+			return fmt.Errorf("malformed key ID in compromised key list: %q", keyID)
+		}
+
+		s.compromised[keyID] = struct{}{}
+	}
+
+	return nil
+}
+
 func (s *fdbStore) loadCerts() error {
 	s.certs = map[string]*Certificate{}
 
@@ -431,7 +652,7 @@ func (s *fdbStore) loadCerts() error {
 
 		err := s.validateCert(certID, kc)
 		log.Errore(err, "failed to load certificate ", certID)
-		if err != nil && IsWellFormattedCertificateOrKeyID(certID) {
+		if err != nil && IsWellFormattedCertificateID(certID) {
 			// If the certificate fails to load and it has an invalid cert ID,
 			// ignore errors.
 			return err
@@ -442,29 +663,46 @@ func (s *fdbStore) loadCerts() error {
 }
 
 func (s *fdbStore) validateCert(certID string, c *fdb.Collection) error {
-	ss, err := fdb.String(c.Open("url"))
-	if err != nil {
-		return err
-	}
-
-	ss = strings.TrimSpace(ss)
-	if !acmeapi.ValidURL(ss) {
-		return fmt.Errorf("certificate order has invalid URI")
-	}
-
-	actualCertID := determineCertificateID(ss)
-	if certID != actualCertID {
-		return fmt.Errorf("cert ID mismatch: %#v != %#v", certID, actualCertID)
-	}
-
 	crt := &Certificate{
-		URL:               ss,
 		Certificates:      nil,
 		Cached:            false,
+		External:          fdb.Exists(c, "external"),
 		RevocationDesired: fdb.Exists(c, "revoke"),
 		Revoked:           fdb.Exists(c, "revoked"),
 	}
 
+	if crt.RevocationDesired {
+		// The revoke file is either empty or contains the reason code.
+		reason, err := fdb.Uint(c, "revoke", 8)
+		if err == nil {
+			crt.RevocationReason = int(reason)
+		}
+	}
+
+	if !crt.External {
+		ss, err := fdb.String(c.Open("url"))
+		if err != nil {
+			return err
+		}
+
+		ss = strings.TrimSpace(ss)
+		if !acmeapi.ValidURL(ss) {
+			return fmt.Errorf("certificate order has invalid URI")
+		}
+
+		actualCertID := determineCertificateID(ss)
+		if certID != actualCertID {
+			return fmt.Errorf("cert ID mismatch: %#v != %#v", certID, actualCertID)
+		}
+
+		crt.URL = ss
+
+		certURL, err := fdb.String(c.Open("cert-url"))
+		if err == nil {
+			crt.CertificateURL = strings.TrimSpace(certURL)
+		}
+	}
+
 	fullchain, err := fdb.Bytes(c.Open("fullchain"))
 	if err == nil {
 		certs, err := acmeutils.LoadCertificates(fullchain)
@@ -491,6 +729,38 @@ func (s *fdbStore) validateCert(certID string, c *fdb.Collection) error {
 		crt.Cached = true
 	}
 
+	for i := 0; ; i++ {
+		b, err := fdb.Bytes(c.Open(fmt.Sprintf("chain-%d", i)))
+		if err != nil {
+			break
+		}
+
+		chain, err := acmeutils.LoadCertificates(b)
+		if err != nil {
+			return err
+		}
+
+		crt.Chains = append(crt.Chains, chain)
+	}
+
+	ocspResponse, err := fdb.Bytes(c.Open("ocsp"))
+	if err == nil {
+		crt.OCSPResponse = ocspResponse
+	}
+
+	if crt.External {
+		// There is no way to retrieve an external certificate, so it must be
+		// present.
+		if !crt.Cached {
+			return fmt.Errorf("external certificate has no certificate data: %q", certID)
+		}
+
+		actualCertID := crt.ID()
+		if certID != actualCertID {
+			return fmt.Errorf("cert ID mismatch: %#v != %#v", certID, actualCertID)
+		}
+	}
+
 	acctLink, err := c.ReadLink("account")
 	if err == nil {
 		if !strings.HasPrefix(acctLink.Target, "accounts/") {
@@ -503,6 +773,40 @@ func (s *fdbStore) validateCert(certID string, c *fdb.Collection) error {
 		}
 	}
 
+	provider, err := fdb.String(c.Open("provider"))
+	if err == nil {
+		crt.Provider = strings.TrimSpace(provider)
+	} else if crt.Account != nil {
+		crt.Provider = crt.Account.DirectoryURL
+	}
+
+	nextKeyLink, err := c.ReadLink("nextkey")
+	if err == nil {
+		parts := strings.Split(nextKeyLink.Target, "/")
+		if len(parts) != 3 || parts[0] != "keys" {
+			return fmt.Errorf("malformed certificate next key symlink: %q %q", certID, nextKeyLink.Target)
+		}
+
+		crt.NextKey = s.keys[parts[1]]
+	}
+
+	for _, keyType := range supportedKeyTypes {
+		link, err := c.ReadLink("cert-" + keyType)
+		if err != nil {
+			continue
+		}
+
+		parts := strings.Split(link.Target, "/")
+		if len(parts) != 3 || parts[0] != "certs" {
+			return fmt.Errorf("malformed certificate key type symlink: %q %q", certID, link.Target)
+		}
+
+		if crt.KeyTypeCertificateIDs == nil {
+			crt.KeyTypeCertificateIDs = map[string]string{}
+		}
+		crt.KeyTypeCertificateIDs[keyType] = parts[1]
+	}
+
 	s.certs[certID] = crt
 
 	return nil
@@ -510,10 +814,13 @@ func (s *fdbStore) validateCert(certID string, c *fdb.Collection) error {
 
 func (s *fdbStore) loadTargets() error {
 	s.targets = map[string]*Target{}
+	s.packs = map[string]*Target{}
+	s.targetErrs = map[string]error{}
 
 	// default target
 	confc := s.db.Collection("conf")
 
+	s.defaultTargetErr = nil
 	dtgt, err := s.validateTargetInner("target", confc, true)
 	if err == nil {
 		dtgt.genericise()
@@ -521,6 +828,7 @@ func (s *fdbStore) loadTargets() error {
 	} else {
 		if !os.IsNotExist(err) {
 			log.Errore(err, "error loading default target file")
+			s.defaultTargetErr = fmt.Errorf("cannot load default target file conf/target: %v", err)
 		}
 		s.defaultTarget = &Target{}
 	}
@@ -541,7 +849,11 @@ func (s *fdbStore) loadTargets() error {
 	for _, desiredKey := range desiredKeys {
 		err := s.validateTarget(desiredKey, c)
 		log.Errore(err, "failed to load target ", desiredKey)
-		// Ignore errors, best effort.
+		// Other targets are still loaded, but the error is recorded so that it
+		// can be reported.
+		if err != nil {
+			s.targetErrs[desiredKey] = err
+		}
 	}
 
 	return nil
@@ -553,7 +865,16 @@ func (s *fdbStore) validateTarget(desiredKey string, c *fdb.Collection) error {
 		return err
 	}
 
-	s.targets[desiredKey] = tgt
+	if !tgt.Pack.IsSet() {
+		s.targets[desiredKey] = tgt
+		return nil
+	}
+
+	s.packs[desiredKey] = tgt
+	for _, pt := range s.packTarget(tgt) {
+		s.targets[pt.Filename] = pt
+	}
+
 	return nil
 }
 
@@ -563,21 +884,35 @@ func (s *fdbStore) validateTargetInner(desiredKey string, c *fdb.Collection, loa
 		return nil, err
 	}
 
+	return s.parseTarget(desiredKey, b, loadingDefault)
+}
+
+// Decodes a target file. Unknown settings are an error.
+func (s *fdbStore) parseTarget(desiredKey string, b []byte, loadingDefault bool) (*Target, error) {
+	var err error
 	var tgt *Target
 	if loadingDefault {
 		tgt = &Target{}
 	} else {
-		tgt = s.defaultTarget.CopyGeneric()
+		tgt, err = s.applyTemplates(s.defaultTarget.CopyGeneric(), b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target: %s: %v", desiredKey, err)
+		}
 	}
 
 	tgt.Filename = desiredKey
 
-	err = yaml.Unmarshal(b, tgt)
+	err = unmarshalTargetLayer(b, tgt)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(tgt.Satisfy.Names) == 0 {
+	if !loadingDefault && tgt.Pack.IsSet() {
+		tgt.Satisfy.Names, err = s.loadPackNames(tgt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pack target: %s: %v", desiredKey, err)
+		}
+	} else if len(tgt.Satisfy.Names) == 0 {
 		if len(tgt.LegacyNames) > 0 {
 			tgt.Satisfy.Names = tgt.LegacyNames
 		} else {
@@ -594,6 +929,15 @@ func (s *fdbStore) validateTargetInner(desiredKey string, c *fdb.Collection, loa
 		return nil, fmt.Errorf("invalid target: %s: %v", desiredKey, err)
 	}
 
+	for i := range tgt.Request.Key.Types {
+		tgt.Request.Key.Types[i] = strings.ToLower(strings.TrimSpace(tgt.Request.Key.Types[i]))
+	}
+
+	err = tgt.validateKeyTypes()
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %s: %v", desiredKey, err)
+	}
+
 	if len(tgt.Request.Names) == 0 {
 		tgt.Request.Names = tgt.Satisfy.Names
 		tgt.Request.implicitNames = true
@@ -604,6 +948,33 @@ func (s *fdbStore) validateTargetInner(desiredKey string, c *fdb.Collection, loa
 	return tgt, nil
 }
 
+// Decodes a target file or template into tgt, which contains the settings
+// inherited by it. A provider set by the file overrides an inherited list of
+// providers, unless the file also sets a list of providers.
+func unmarshalTargetLayer(b []byte, tgt *Target) error {
+	err := yaml.UnmarshalStrict(b, tgt)
+	if err != nil {
+		return err
+	}
+
+	var layer struct {
+		Request struct {
+			Provider  string   `yaml:"provider"`
+			Providers []string `yaml:"providers"`
+		} `yaml:"request"`
+	}
+	err = yaml.Unmarshal(b, &layer)
+	if err != nil {
+		return err
+	}
+
+	if layer.Request.Provider != "" && len(layer.Request.Providers) == 0 {
+		tgt.Request.Providers = nil
+	}
+
+	return nil
+}
+
 // Saving {{{1
 
 // Serializes the target to disk. Call after changing any settings.
@@ -614,6 +985,10 @@ func (s *fdbStore) SaveTarget(t *Target) error {
 		return err
 	}
 
+	if t.PackedFrom != "" {
+		return fmt.Errorf("target %q is generated from pack target %q and cannot be saved", t.Filename, t.PackedFrom)
+	}
+
 	if t != s.defaultTarget {
 		t.ensureFilename()
 	}
@@ -629,6 +1004,11 @@ func (s *fdbStore) SaveTarget(t *Target) error {
 		tcopy.Request.Names = nil
 	}
 
+	// the names of a pack target are determined from its pack settings
+	if tcopy.Pack.IsSet() {
+		tcopy.Satisfy.Names = nil
+	}
+
 	b, err := yaml.Marshal(&tcopy)
 	if err != nil {
 		return err
@@ -646,11 +1026,30 @@ func (s *fdbStore) RemoveTarget(filename string) error {
 	return s.db.Collection("desired").Delete(filename)
 }
 
+func (s *fdbStore) ListTargetFiles() ([]string, error) {
+	return s.db.Collection("desired").List()
+}
+
+func (s *fdbStore) ReadTargetFile(filename string) ([]byte, error) {
+	return fdb.Bytes(s.db.Collection("desired").Open(filename))
+}
+
+func (s *fdbStore) WriteTargetFile(filename string, data []byte) error {
+	return fdb.WriteBytes(s.db.Collection("desired"), filename, data)
+}
+
 func (s *fdbStore) SaveCertificate(cert *Certificate) error {
-	c := s.db.Collection("certs/" + cert.ID())
+	return saveCertificate(s.db.Collection("certs/"+cert.ID()), cert)
+}
 
+func saveCertificate(c *fdb.Collection, cert *Certificate) error {
 	if cert.RevocationDesired {
-		err := fdb.CreateEmpty(c, "revoke")
+		var reason []byte
+		if cert.RevocationReason != 0 {
+			reason = []byte(fmt.Sprintf("%d\n", cert.RevocationReason))
+		}
+
+		err := fdb.WriteBytes(c, "revoke", reason)
 		if err != nil {
 			return err
 		}
@@ -701,6 +1100,63 @@ func (s *fdbStore) SaveCertificate(cert *Certificate) error {
 	fchain.Close()
 	ffullchain.Close()
 
+	if cert.CertificateURL != "" {
+		err = fdb.WriteBytes(c, "cert-url", []byte(cert.CertificateURL))
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, chain := range cert.Chains {
+		err = saveCertificateChain(c, fmt.Sprintf("chain-%d", i), chain)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A previous download may have offered more chains. As chains are loaded
+	// until one is missing, those not offered now are removed.
+	for i := len(cert.Chains); ; i++ {
+		name := fmt.Sprintf("chain-%d", i)
+		if _, err := os.Lstat(c.OSPath(name)); err != nil {
+			break
+		}
+
+		err = c.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func saveCertificateChain(c *fdb.Collection, name string, chain [][]byte) error {
+	f, err := c.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.CloseAbort()
+
+	for _, ec := range chain {
+		err = acmeutils.SaveCertificates(f, ec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// Stores a DER-encoded OCSP response for a certificate as "ocsp" in its
+// certificate directory.
+func (s *fdbStore) SaveOCSPResponse(cert *Certificate, ocspResponse []byte) error {
+	err := fdb.WriteBytes(s.db.Collection("certs/"+cert.ID()), "ocsp", ocspResponse)
+	if err != nil {
+		return err
+	}
+
+	cert.OCSPResponse = ocspResponse
 	return nil
 }
 
@@ -719,6 +1175,16 @@ func (s *fdbStore) SaveAccount(a *Account) error {
 
 	w.Close()
 
+	if a.Label != "" {
+		err = fdb.WriteBytes(coll, "label", []byte(a.Label+"\n"))
+	} else {
+		err = coll.Delete("label")
+	}
+	if err != nil {
+		return err
+	}
+
+	s.accounts[a.ID()] = a
 	return nil
 }
 
@@ -740,8 +1206,7 @@ func (s *fdbStore) RemoveCertificate(certificateID string) error {
 }
 
 func (s *fdbStore) RemoveKey(keyID string) error {
-	_, ok := s.keys[keyID]
-	if !ok {
+	if !s.keyExists(keyID) {
 		return fmt.Errorf("key does not exist: %s", keyID)
 	}
 
@@ -751,9 +1216,71 @@ func (s *fdbStore) RemoveKey(keyID string) error {
 	}
 
 	delete(s.keys, keyID)
+	delete(s.compromisedKeys, keyID)
+	return nil
+}
+
+// Returns true if the key is loaded or is a compromised key which has not yet
+// been removed.
+func (s *fdbStore) keyExists(keyID string) bool {
+	_, loaded := s.keys[keyID]
+	_, compromised := s.compromisedKeys[keyID]
+	return loaded || compromised
+}
+
+// Like RemoveKey, but overwrites the private key file before removing the key
+// directory. This offers limited assurance on copy-on-write or journalling
+// filesystems and on flash storage.
+func (s *fdbStore) EraseKey(keyID string) error {
+	if !s.keyExists(keyID) {
+		return fmt.Errorf("key does not exist: %s", keyID)
+	}
+
+	err := overwriteFile(s.db.Collection("keys/" + keyID).OSPath("privkey"))
+	if err != nil {
+		return err
+	}
+
+	return s.RemoveKey(keyID)
+}
+
+// Marks a key as compromised by adding it to the compromised key list. The
+// key cannot be imported again. It remains loaded, marked as compromised,
+// while any certificate using it has not been revoked, so that it can be used
+// to request revocation.
+func (s *fdbStore) MarkKeyCompromised(keyID string) error {
+	if !IsWellFormattedCertificateOrKeyID(keyID) {
+		return fmt.Errorf("malformed key ID: %q", keyID)
+	}
+
+	if _, ok := s.compromised[keyID]; !ok {
+		var keyIDs []string
+		for k := range s.compromised {
+			keyIDs = append(keyIDs, k)
+		}
+		keyIDs = append(keyIDs, keyID)
+		sort.Strings(keyIDs)
+
+		err := fdb.WriteBytes(s.db.Collection("conf"), "compromised-keys", []byte(strings.Join(keyIDs, "\n")+"\n"))
+		if err != nil {
+			return err
+		}
+
+		s.compromised[keyID] = struct{}{}
+	}
+
+	if k, ok := s.keys[keyID]; ok {
+		k.Compromised = true
+	}
+
 	return nil
 }
 
+func (s *fdbStore) IsKeyCompromised(keyID string) bool {
+	_, ok := s.compromised[keyID]
+	return ok
+}
+
 // Importing {{{1
 
 // Give a PEM-encoded key file, imports the key into the store. If the key is
@@ -764,6 +1291,10 @@ func (s *fdbStore) ImportKey(privateKey crypto.PrivateKey) (*Key, error) {
 		return nil, err
 	}
 
+	if s.IsKeyCompromised(keyID) {
+		return nil, fmt.Errorf("key %q has been marked as compromised and cannot be imported", keyID)
+	}
+
 	k, ok := s.keys[keyID]
 	if ok {
 		return k, nil
@@ -775,9 +1306,18 @@ func (s *fdbStore) ImportKey(privateKey crypto.PrivateKey) (*Key, error) {
 		return nil, err
 	}
 
+	// The creation time is recorded rather than taken from the modification
+	// time of the key file, which is not preserved when files are copied.
+	created := InternalClock.Now().UTC().Truncate(time.Second)
+	err = fdb.WriteBytes(c, "created", []byte(created.Format(time.RFC3339)+"\n"))
+	if err != nil {
+		return nil, err
+	}
+
 	k = &Key{
 		PrivateKey: privateKey,
 		ID:         keyID,
+		Created:    created,
 	}
 
 	s.keys[keyID] = k
@@ -805,9 +1345,82 @@ func (s *fdbStore) ImportCertificate(acct *Account, url string) (*Certificate, e
 		return nil, err
 	}
 
+	err = fdb.WriteBytes(coll, "provider", []byte(acct.DirectoryURL))
+	if err != nil {
+		return nil, err
+	}
+
 	c = &Certificate{
-		URL:     url,
-		Account: acct,
+		URL:      url,
+		Account:  acct,
+		Provider: acct.DirectoryURL,
+	}
+
+	s.certs[certID] = c
+	return c, nil
+}
+
+// Given a certificate chain (end certificate first) which was not obtained via
+// ACME by this store, imports it as an external certificate. The private key
+// must already have been imported for the certificate to be usable. If the
+// certificate has already been imported, returns the existing certificate.
+func (s *fdbStore) ImportExternalCertificate(certs [][]byte) (*Certificate, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates given")
+	}
+
+	xcrt, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Certificate{
+		External:     true,
+		Certificates: certs,
+		Cached:       true,
+	}
+
+	certID := c.ID()
+	if existing, ok := s.certs[certID]; ok {
+		return existing, nil
+	}
+
+	// The certificate is written to a hidden staging directory, which is not
+	// loaded, and renamed into place once complete, so that an interrupted
+	// import cannot leave behind a certificate directory which fails to load.
+	certsColl := s.db.Collection("certs")
+	stagingName := ".import-" + certID
+	err = certsColl.Delete(stagingName)
+	if err != nil {
+		return nil, err
+	}
+	defer certsColl.Delete(stagingName)
+
+	staging := certsColl.Collection(stagingName)
+	err = fdb.CreateEmpty(staging, "external")
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := determineKeyIDFromCert(xcrt)
+	c.Key = s.keys[keyID]
+	if c.Key != nil {
+		err = staging.WriteLink("privkey", fdb.Link{Target: "keys/" + keyID + "/privkey"})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Warnf("importing external certificate %q but its private key has not been imported; it will not be used", certID)
+	}
+
+	err = saveCertificate(staging, c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(staging.OSPath(""), certsColl.OSPath(certID))
+	if err != nil {
+		return nil, err
 	}
 
 	s.certs[certID] = c
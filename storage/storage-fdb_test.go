@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"github.com/hlandau/acmetool/fdb"
+	"github.com/jmhodges/clock"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*fdbStore, func()) {
+	dir, err := ioutil.TempDir("", "acmetool-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFDB(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("error: %v", err)
+	}
+
+	return s.(*fdbStore), func() { os.RemoveAll(dir) }
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return pk
+}
+
+// Stores a self-signed certificate for the given key.
+func newTestCertificate(t *testing.T, s *fdbStore, pk *ecdsa.PrivateKey, url string) *Certificate {
+	acct, err := s.ImportAccount("https://ca.example.com/directory", newTestKey(t))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c, err := s.ImportCertificate(acct, url)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &pk.PublicKey, pk)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c.Certificates = [][]byte{der}
+	c.Cached = true
+	err = s.SaveCertificate(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return c
+}
+
+// A compromised key remains loaded until the certificates using it have been
+// revoked, so that a failed revocation can be retried using the key.
+func TestCompromisedKeyLoadedUntilRevoked(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pk := newTestKey(t)
+	k, err := s.ImportKey(pk)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c := newTestCertificate(t, s, pk, "https://ca.example.com/cert/1")
+
+	err = s.MarkKeyCompromised(k.ID)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	k = s.KeyByID(k.ID)
+	if k == nil || !k.Compromised {
+		t.Fatalf("compromised key of unrevoked certificate not loaded as compromised: %v", k)
+	}
+
+	c = s.CertificateByID(c.ID())
+	if c.Key != k {
+		t.Fatalf("certificate not linked to compromised key")
+	}
+
+	_, err = s.ImportKey(pk)
+	if err == nil {
+		t.Fatalf("compromised key imported")
+	}
+
+	c.Revoked = true
+	err = s.SaveCertificate(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if s.KeyByID(k.ID) != nil {
+		t.Fatalf("compromised key loaded after its certificate was revoked")
+	}
+
+	if c := s.CertificateByID(c.ID()); c.Key != nil {
+		t.Fatalf("certificate linked to unloaded compromised key")
+	}
+
+	var compromisedKeys []string
+	s.VisitCompromisedKeys(func(keyID string) error {
+		compromisedKeys = append(compromisedKeys, keyID)
+		return nil
+	})
+	if len(compromisedKeys) != 1 || compromisedKeys[0] != k.ID {
+		t.Fatalf("unloaded compromised key not visited: %v", compromisedKeys)
+	}
+
+	err = s.RemoveKey(k.ID)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+}
+
+func TestImportExternalCertificate(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pk := newTestKey(t)
+	k, err := s.ImportKey(pk)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &pk.PublicKey, pk)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	certID := determineExternalCertificateID(der)
+
+	// An import interrupted before the certificate was moved into place does
+	// not prevent the store from loading or the import from being retried.
+	staging := s.db.Collection("certs/.import-" + certID)
+	err = fdb.CreateEmpty(staging, "external")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c, err := s.ImportExternalCertificate([][]byte{der})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if c.ID() != certID {
+		t.Fatalf("unexpected certificate ID: %q", c.ID())
+	}
+
+	if _, err := os.Lstat(staging.OSPath("")); !os.IsNotExist(err) {
+		t.Fatalf("staging directory left behind")
+	}
+
+	c2, err := s.ImportExternalCertificate([][]byte{der})
+	if err != nil || c2 != c {
+		t.Fatalf("reimport did not return existing certificate: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c = s.CertificateByID(certID)
+	if c == nil || !c.External || !c.Cached || c.URL != "" {
+		t.Fatalf("external certificate not loaded: %v", c)
+	}
+
+	if c.Key == nil || c.Key.ID != k.ID {
+		t.Fatalf("external certificate not linked to its key")
+	}
+}
+
+// All chains offered are stored and loaded again, and chains no longer
+// offered when the certificate is downloaded again are removed.
+func TestCertificateChains(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	pk := newTestKey(t)
+	_, err := s.ImportKey(pk)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c := newTestCertificate(t, s, pk, "https://ca.example.com/order/1")
+	der := c.Certificates[0]
+
+	// The chains are distinguished by their lengths.
+	for _, numChains := range []int{3, 1, 2, 0} {
+		c = s.CertificateByID(c.ID())
+		c.Chains = nil
+		for i := 0; i < numChains; i++ {
+			var chain [][]byte
+			for j := 0; j <= i; j++ {
+				chain = append(chain, der)
+			}
+			c.Chains = append(c.Chains, chain)
+		}
+
+		err = s.SaveCertificate(c)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = s.Reload()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		c = s.CertificateByID(c.ID())
+		if c == nil || len(c.Chains) != numChains {
+			t.Fatalf("expected %d chains to be loaded: %v", numChains, c)
+		}
+
+		for i, chain := range c.Chains {
+			if len(chain) != i+1 {
+				t.Fatalf("chain %d not loaded: %d certificates", i, len(chain))
+			}
+		}
+
+		coll := s.db.Collection("certs/" + c.ID())
+		if _, err := os.Lstat(coll.OSPath(fmt.Sprintf("chain-%d", numChains))); !os.IsNotExist(err) {
+			t.Fatalf("chain-%d left behind", numChains)
+		}
+	}
+}
+
+// Labelled accounts are found by label and provider, and are never used as
+// the account for a provider by default.
+func TestAccountByLabel(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	const ca1, ca2 = "https://ca1.example.com/directory", "https://ca2.example.com/directory"
+	accounts := map[string]*Account{
+		"customer1":   {DirectoryURL: ca1, Label: "customer"},
+		"customer2":   {DirectoryURL: ca2, Label: "customer"},
+		"unlabelled1": {DirectoryURL: ca1},
+		"other2":      {DirectoryURL: ca2, Label: "other"},
+	}
+	for _, a := range accounts {
+		a.PrivateKey = newTestKey(t)
+		err := s.SaveAccount(a)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	lowest := accounts["customer1"]
+	if accounts["customer2"].ID() < lowest.ID() {
+		lowest = accounts["customer2"]
+	}
+
+	for i := 0; i < 2; i++ {
+		tests := []struct {
+			got, expected *Account
+		}{
+			{s.AccountByLabel("customer", ca1), accounts["customer1"]},
+			{s.AccountByLabel("customer", ca2), accounts["customer2"]},
+			{s.AccountByLabel("customer", ""), lowest},
+			{s.AccountByLabel("other", ""), accounts["other2"]},
+			{s.AccountByLabel("other", ca1), nil},
+			{s.AccountByLabel("nonexistent", ""), nil},
+			{s.AccountByDirectoryURL(ca1), accounts["unlabelled1"]},
+			{s.AccountByDirectoryURL(ca2), nil},
+		}
+
+		for j, test := range tests {
+			if (test.got == nil) != (test.expected == nil) || (test.got != nil && test.got.ID() != test.expected.ID()) {
+				t.Fatalf("%d/%d: got account %v, expected %v", i, j, test.got, test.expected)
+			}
+		}
+
+		// The labels are loaded again.
+		err := s.Reload()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	if a := s.AccountByID(accounts["customer1"].ID()); a == nil || a.Label != "customer" {
+		t.Fatalf("label not loaded: %v", a)
+	}
+}
+
+// The creation time of an imported key is taken from the store's clock and
+// persists across reloads.
+func TestImportKeyCreated(t *testing.T) {
+	defer func(c clock.Clock) { InternalClock = c }(InternalClock)
+	fc := clock.NewFake()
+	fc.Set(time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC))
+	InternalClock = fc
+
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	k, err := s.ImportKey(newTestKey(t))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	expected := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !k.Created.Equal(expected) {
+		t.Fatalf("key created at %v, expected %v", k.Created, expected)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if k := s.KeyByID(k.ID); k == nil || !k.Created.Equal(expected) {
+		t.Fatalf("creation time not persisted: %v", k)
+	}
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/hlandau/acmetool/fdb"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Templates are stored in this collection under the conf directory. A target
+// which specifies "template: foo" inherits the settings of conf/templates/foo.
+const templatesCollection = "templates"
+
+// A template may itself specify a template; this limits the depth of the
+// resulting chain.
+const maxTemplateDepth = 8
+
+// A layer of settings from which a target is built.
+type targetLayer struct {
+	Origin string // Path of the file relative to the state directory.
+	Data   []byte
+}
+
+func readTemplateName(b []byte) (string, error) {
+	var ref struct {
+		Template string `yaml:"template"`
+	}
+
+	err := yaml.Unmarshal(b, &ref)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.ContainsAny(ref.Template, "/\\") || strings.HasPrefix(ref.Template, ".") {
+		return "", fmt.Errorf("invalid template name: %q", ref.Template)
+	}
+
+	return ref.Template, nil
+}
+
+// Returns the templates used by a target file, the most general first.
+func (s *fdbStore) loadTemplateLayers(b []byte) ([]targetLayer, error) {
+	c := s.db.Collection("conf").Collection(templatesCollection)
+
+	var layers []targetLayer
+	seen := map[string]struct{}{}
+	for {
+		name, err := readTemplateName(b)
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "" {
+			return layers, nil
+		}
+
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("template %q includes itself", name)
+		}
+
+		if len(seen) == maxTemplateDepth {
+			return nil, fmt.Errorf("templates nested too deeply")
+		}
+
+		seen[name] = struct{}{}
+
+		b, err = fdb.Bytes(c.Open(name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("template not found: %q", name)
+			}
+
+			return nil, fmt.Errorf("cannot load template %q: %v", name, err)
+		}
+
+		layers = append([]targetLayer{{Origin: "conf/" + templatesCollection + "/" + name, Data: b}}, layers...)
+	}
+}
+
+// Applies the templates used by a target file to tgt, which already contains
+// the settings of the default target. Mappings are merged, so a template need
+// only specify the settings it changes; any other value, including a list,
+// replaces the value inherited.
+func (s *fdbStore) applyTemplates(tgt *Target, b []byte) (*Target, error) {
+	layers, err := s.loadTemplateLayers(b)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range layers {
+		err = unmarshalTargetLayer(layer.Data, tgt)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", layer.Origin, err)
+		}
+
+		// Names and pack settings are never inherited, and settings such as
+		// environment variables are moved to their inherited form as when copying
+		// the default target.
+		tgt = tgt.CopyGeneric()
+	}
+
+	return tgt, nil
+}
+
+// Describes where the effective value of a target setting came from.
+type TargetSettingOrigin struct {
+	// The setting, as a dotted path of keys, e.g. "request.key.type".
+	Setting string
+
+	// The value of the setting as it appears in the file it came from.
+	Value interface{}
+
+	// The file the setting came from, relative to the state directory, e.g.
+	// "conf/target", "conf/templates/foo" or "desired/example.com".
+	Origin string
+}
+
+// Returns the settings specified for the target with the given filename and
+// the file each setting came from, sorted by setting. Settings not specified
+// in any file take their default values and are not listed.
+func (s *fdbStore) ExplainTarget(filename string) ([]TargetSettingOrigin, error) {
+	if t := s.targets[filename]; t != nil && t.PackedFrom != "" {
+		filename = t.PackedFrom
+	}
+
+	b, err := fdb.Bytes(s.db.Collection("desired").Open(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := s.targetLayers("desired/"+filename, b)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := s.explainLayers(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	var origins []TargetSettingOrigin
+	for _, v := range settings {
+		origins = append(origins, v)
+	}
+
+	sort.Slice(origins, func(i, j int) bool {
+		return origins[i].Setting < origins[j].Setting
+	})
+
+	return origins, nil
+}
+
+// Returns the layers from which a target file is built: the default target,
+// the templates used and the target file itself, which is given the specified
+// origin.
+func (s *fdbStore) targetLayers(origin string, b []byte) ([]targetLayer, error) {
+	var layers []targetLayer
+	db, err := fdb.Bytes(s.db.Collection("conf").Open("target"))
+	if err == nil {
+		layers = append(layers, targetLayer{Origin: "conf/target", Data: db})
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	tlayers, err := s.loadTemplateLayers(b)
+	if err != nil {
+		return nil, err
+	}
+
+	layers = append(layers, tlayers...)
+	layers = append(layers, targetLayer{Origin: origin, Data: b})
+	return layers, nil
+}
+
+// Determines the file each setting of a target comes from. The last layer is
+// the target file itself.
+func (s *fdbStore) explainLayers(layers []targetLayer) (map[string]TargetSettingOrigin, error) {
+	settings := map[string]TargetSettingOrigin{}
+	for i, layer := range layers {
+		var m map[interface{}]interface{}
+		err := yaml.Unmarshal(layer.Data, &m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", layer.Origin, err)
+		}
+
+		// Names and pack settings are not inherited from the default target or
+		// templates.
+		if i < len(layers)-1 {
+			delete(m, "names")
+			delete(m, "pack")
+			if sm, ok := m["satisfy"].(map[interface{}]interface{}); ok {
+				delete(sm, "names")
+			}
+			if rm, ok := m["request"].(map[interface{}]interface{}); ok {
+				delete(rm, "names")
+			}
+		}
+
+		flattenSettings("", m, layer.Origin, settings)
+
+		// As in unmarshalTargetLayer, a provider overrides an inherited list of
+		// providers unless the layer also sets a list of providers.
+		if rm, ok := m["request"].(map[interface{}]interface{}); ok {
+			provider, _ := rm["provider"].(string)
+			providers, _ := rm["providers"].([]interface{})
+			if provider != "" && len(providers) == 0 {
+				delete(settings, "request.providers")
+			}
+		}
+	}
+
+	// Settings taken from legacy configuration files.
+	dt := s.defaultTarget
+	if _, ok := settings["request.challenge.webroot-paths"]; !ok && len(dt.Request.Challenge.WebrootPaths) > 0 {
+		settings["request.challenge.webroot-paths"] = TargetSettingOrigin{Setting: "request.challenge.webroot-paths", Value: dt.Request.Challenge.WebrootPaths, Origin: "conf/webroot-path"}
+	}
+	if _, ok := settings["request.key.rsa-size"]; !ok && dt.Request.Key.RSASize != 0 {
+		settings["request.key.rsa-size"] = TargetSettingOrigin{Setting: "request.key.rsa-size", Value: dt.Request.Key.RSASize, Origin: "conf/rsa-key-size"}
+	}
+
+	return settings, nil
+}
+
+func flattenSettings(prefix string, m map[interface{}]interface{}, origin string, settings map[string]TargetSettingOrigin) {
+	for k, v := range m {
+		setting := fmt.Sprintf("%s%v", prefix, k)
+		if vm, ok := v.(map[interface{}]interface{}); ok && len(vm) > 0 {
+			flattenSettings(setting+".", vm, origin, settings)
+			continue
+		}
+
+		settings[setting] = TargetSettingOrigin{Setting: setting, Value: v, Origin: origin}
+	}
+}
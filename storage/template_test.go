@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes files relative to the state directory and reloads the store.
+func writeTestFiles(t *testing.T, s *fdbStore, files map[string]string) {
+	for name, data := range files {
+		fn := filepath.Join(s.Path(), filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = ioutil.WriteFile(fn, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	err := s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+}
+
+var testTemplateFiles = map[string]string{
+	"conf/target":              "request:\n  provider: https://default.example.com/directory\n  key:\n    type: rsa\n    rsa-size: 3072\n",
+	"conf/templates/base":      "satisfy:\n  names:\n    - base.example.com\nrequest:\n  key:\n    type: ecdsa\n  ocsp-must-staple: true\n",
+	"conf/templates/customer":  "template: base\nrequest:\n  provider: https://customer.example.com/directory\n  ocsp-must-staple: false\n",
+	"desired/example.com":      "template: customer\nsatisfy:\n  names:\n    - example.com\nrequest:\n  key:\n    ecdsa-curve: nistp384\n",
+	"desired/base.example.net": "template: base\n",
+}
+
+// The default target, then each template, the most general first, then the
+// target file are applied in turn.
+func TestTemplates(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestFiles(t, s, testTemplateFiles)
+
+	tgt := s.TargetByFilename("example.com")
+	if tgt == nil {
+		t.Fatalf("target not loaded: %v", s.TargetErrors())
+	}
+
+	r := &tgt.Request
+	if r.Provider != "https://customer.example.com/directory" || r.Key.Type != "ecdsa" || r.Key.RSASize != 3072 ||
+		r.Key.ECDSACurve != "nistp384" || r.OCSPMustStaple {
+		t.Fatalf("settings not layered: %#v", r)
+	}
+
+	// Names are not inherited from templates.
+	if len(tgt.Satisfy.Names) != 1 || tgt.Satisfy.Names[0] != "example.com" {
+		t.Fatalf("unexpected names: %v", tgt.Satisfy.Names)
+	}
+
+	tgt = s.TargetByFilename("base.example.net")
+	if tgt == nil {
+		t.Fatalf("target not loaded: %v", s.TargetErrors())
+	}
+
+	if len(tgt.Satisfy.Names) != 1 || tgt.Satisfy.Names[0] != "base.example.net" || !tgt.Request.OCSPMustStaple {
+		t.Fatalf("unexpected target: %#v", tgt)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"conf/templates/a":       "template: b\n",
+		"conf/templates/b":       "template: a\n",
+		"conf/templates/self":    "template: self\n",
+		"desired/cycle":          "template: a\n",
+		"desired/self":           "template: self\n",
+		"desired/missing":        "template: nonexistent\n",
+		"desired/invalid":        "template: ../target\n",
+		"desired/deep":           "template: t0\n",
+		"desired/deep-enough":    "template: t2\n",
+		"desired/bad-template":   "template: bad\n",
+		"conf/templates/bad":     "request:\n  colour: blue\n",
+		"desired/ok.example.com": "satisfy:\n  names:\n    - ok.example.com\n",
+	}
+
+	// A chain of ten templates, of which the last eight may be used.
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("conf/templates/t%d", i)] = fmt.Sprintf("template: t%d\n", i+1)
+	}
+	files["conf/templates/t9"] = "request:\n  ocsp-must-staple: true\n"
+
+	writeTestFiles(t, s, files)
+
+	expected := map[string]string{
+		"cycle":        `template "a" includes itself`,
+		"self":         `template "self" includes itself`,
+		"missing":      `template not found: "nonexistent"`,
+		"invalid":      `invalid template name: "../target"`,
+		"deep":         "templates nested too deeply",
+		"bad-template": "conf/templates/bad: ",
+	}
+
+	errs := s.TargetErrors()
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected target errors: %v", errs)
+	}
+
+	for filename, msg := range expected {
+		if errs[filename] == nil || !strings.Contains(errs[filename].Error(), msg) {
+			t.Fatalf("target %q: got error %v, expected %q", filename, errs[filename], msg)
+		}
+
+		if s.TargetByFilename(filename) != nil {
+			t.Fatalf("invalid target %q loaded", filename)
+		}
+	}
+
+	if tgt := s.TargetByFilename("deep-enough"); tgt == nil || !tgt.Request.OCSPMustStaple {
+		t.Fatalf("target with templates nested %d deep not loaded: %v", maxTemplateDepth, tgt)
+	}
+
+	if s.TargetByFilename("ok.example.com") == nil {
+		t.Fatalf("valid target not loaded")
+	}
+}
+
+// Each setting is attributed to the last file which specifies it.
+func TestExplainTarget(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestFiles(t, s, testTemplateFiles)
+
+	origins, err := s.ExplainTarget("example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	expected := map[string]string{
+		"request.provider":         "conf/templates/customer",
+		"request.key.type":         "conf/templates/base",
+		"request.key.rsa-size":     "conf/target",
+		"request.key.ecdsa-curve":  "desired/example.com",
+		"request.ocsp-must-staple": "conf/templates/customer",
+		"satisfy.names":            "desired/example.com",
+		"template":                 "desired/example.com",
+	}
+
+	if len(origins) != len(expected) {
+		t.Fatalf("unexpected settings: %v", origins)
+	}
+
+	for i, o := range origins {
+		if i > 0 && origins[i-1].Setting >= o.Setting {
+			t.Fatalf("settings not sorted: %v", origins)
+		}
+
+		if expected[o.Setting] != o.Origin {
+			t.Fatalf("setting %q from %q, expected %q", o.Setting, o.Origin, expected[o.Setting])
+		}
+	}
+
+	// The names of a template are not attributed to a target which inherits
+	// from it.
+	origins, err = s.ExplainTarget("base.example.net")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, o := range origins {
+		if o.Setting == "satisfy.names" {
+			t.Fatalf("names attributed to %q", o.Origin)
+		}
+	}
+}
+
+// A provider set by a later layer overrides an inherited list of providers,
+// so the list is not attributed to the layer which set it.
+func TestExplainTargetProviders(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestFiles(t, s, map[string]string{
+		"conf/target":                "request:\n  providers:\n    - https://a.example.com/directory\n    - https://b.example.com/directory\n",
+		"conf/templates/single":      "request:\n  provider: https://c.example.com/directory\n",
+		"desired/single.example.com": "template: single\nsatisfy:\n  names:\n    - single.example.com\n",
+		"desired/list.example.com":   "satisfy:\n  names:\n    - list.example.com\n",
+	})
+
+	tests := []struct {
+		filename  string
+		settings  map[string]string
+		providers int
+	}{
+		{"single.example.com", map[string]string{"request.provider": "conf/templates/single"}, 0},
+		{"list.example.com", map[string]string{"request.providers": "conf/target"}, 2},
+	}
+
+	for i, test := range tests {
+		tgt := s.TargetByFilename(test.filename)
+		if tgt == nil {
+			t.Fatalf("%d: target not loaded: %v", i, s.TargetErrors())
+		}
+
+		if len(tgt.Request.Providers) != test.providers {
+			t.Fatalf("%d: unexpected providers: %v", i, tgt.Request.Providers)
+		}
+
+		origins, err := s.ExplainTarget(test.filename)
+		if err != nil {
+			t.Fatalf("%d: error: %v", i, err)
+		}
+
+		found := map[string]string{}
+		for _, o := range origins {
+			if strings.HasPrefix(o.Setting, "request.provider") {
+				found[o.Setting] = o.Origin
+			}
+		}
+
+		if fmt.Sprint(found) != fmt.Sprint(test.settings) {
+			t.Fatalf("%d: provider settings from %v, expected %v", i, found, test.settings)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/satori/go.uuid"
 	"gopkg.in/hlandau/acmeapi.v2"
 	"strings"
+	"time"
 )
 
 // Represents stored account data.
@@ -19,6 +20,10 @@ type Account struct {
 	// N. Server directory URL.
 	DirectoryURL string
 
+	// N. Optional name by which targets can select the account, e.g. the name
+	// of a customer. Stored in the label file of the account directory.
+	Label string
+
 	// ID: determined from DirectoryURL and PrivateKey.
 	// Path: formed from ID.
 	// Registration URL: can be recovered automatically.
@@ -38,6 +43,10 @@ func (a *Account) MatchesURL(p string) bool {
 }
 
 func (a *Account) String() string {
+	if a.Label != "" {
+		return fmt.Sprintf("Account(%v;%s)", a.ID(), a.Label)
+	}
+
 	return fmt.Sprintf("Account(%v)", a.ID())
 }
 
@@ -84,12 +93,23 @@ type TargetRequest struct {
 	implicitNames bool
 
 	// N. Currently, this is the provider directory URL. An account matching it
-	// will be used. At some point, a way to specify a particular account should
-	// probably be added.
+	// will be used, unless AccountName is set.
 	Provider string `yaml:"provider,omitempty"`
 
+	// N. If set, the directory URLs of the providers to request certificates
+	// from, overriding Provider. The first is the primary provider; the others
+	// are tried in order if a request fails due to a server, rate limiting or
+	// network error, but not if it fails validation. A Provider set by a
+	// target file or template clears the Providers it inherits.
+	Providers []string `yaml:"providers,omitempty"`
+
+	// N. The label or ID of the account to use. If no account has this label
+	// or ID, an account with this label is created for the provider.
+	AccountName string `yaml:"account,omitempty"`
+
 	// D. Account to use. The storage package does not set this; it is for the
-	// convenience of consuming code. To be determined via Provider string.
+	// convenience of consuming code. To be determined via AccountName and
+	// Provider.
 	Account *Account `yaml:"-"`
 
 	// Settings relating to the creation of new keys used to request
@@ -101,6 +121,33 @@ type TargetRequest struct {
 
 	// N. Request OCSP Must Staple in CSRs?
 	OCSPMustStaple bool `yaml:"ocsp-must-staple,omitempty"`
+
+	// N. If set, the name of the ACME certificate profile to request in new
+	// orders, e.g. "shortlived". The profiles available are determined by the
+	// CA.
+	Profile string `yaml:"profile,omitempty"`
+
+	// N. If the CA offers alternate certificate chains, use the first chain
+	// whose root or one of whose issuers has this common name (e.g. "ISRG Root
+	// X1") for the chain and fullchain files. If empty or if no chain matches,
+	// the default chain is used.
+	PreferredChain string `yaml:"preferred-chain,omitempty"`
+
+	// N. Path to a file of PEM-encoded root certificates to which the chain of
+	// a newly issued certificate must build, or "system" to use the system
+	// trust store. If empty, the chain need only be internally consistent.
+	TrustStore string `yaml:"trust-store,omitempty"`
+}
+
+// Returns the directory URLs of the providers to request certificates from,
+// in the order to try them. If no provider is specified, returns a single
+// empty URL, meaning the default provider.
+func (tr *TargetRequest) ProviderURLs() []string {
+	if len(tr.Providers) > 0 {
+		return tr.Providers
+	}
+
+	return []string{tr.Provider}
 }
 
 // Settings for keys generated as part of certificate requests.
@@ -108,6 +155,12 @@ type TargetRequestKey struct {
 	// N. Key type to use in making a request. "rsa" or "ecdsa". Default "rsa".
 	Type string `yaml:"type,omitempty"`
 
+	// N. If set, a certificate is obtained and tracked separately for each of
+	// the listed key types, e.g. ["ecdsa", "rsa"]. The first type listed is the
+	// primary type and is used for the default files under live/. Overrides
+	// Type.
+	Types []string `yaml:"types,omitempty"`
+
 	// N. RSA key size to use for new RSA keys. Defaults to 2048 bits.
 	RSASize int `yaml:"rsa-size,omitempty"`
 
@@ -115,8 +168,93 @@ type TargetRequestKey struct {
 	ECDSACurve string `yaml:"ecdsa-curve,omitempty"`
 
 	// N. The key ID of an existing key to use for the purposes of making
-	// requests. If not set, always generate a new key.
+	// requests. If not set, the rotation policy determines whether a new key
+	// is generated.
 	ID string `yaml:"id,omitempty"`
+
+	// N. Key rotation policy. Controls whether the key of the previous
+	// certificate is reused when renewing. Defaults to generating a new key
+	// on every renewal.
+	Rotate KeyRotation `yaml:"rotate,omitempty"`
+
+	// N. If true, the key to be used for the next certificate is generated in
+	// advance and exposed as "nextkey" in the certificate directory, so that
+	// e.g. TLSA records can be published ahead of time.
+	PregenerateNext bool `yaml:"pregenerate-next,omitempty"`
+}
+
+// Key rotation policies.
+const (
+	KeyRotateEveryRenewal = "every-renewal"
+	KeyRotateNever        = "never"
+	KeyRotateAfter        = "after"
+)
+
+// Key rotation policy. In a target file, this is expressed either as the
+// string "never" or "every-renewal", or as a mapping of the form
+// "after: 180d".
+type KeyRotation struct {
+	// N. One of the KeyRotate constants. "" means KeyRotateEveryRenewal.
+	Policy string
+
+	// N. For KeyRotateAfter, the age after which a key is replaced.
+	After time.Duration
+}
+
+func (kr *KeyRotation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var policy string
+	err := unmarshal(&policy)
+	if err == nil {
+		switch policy {
+		case "", KeyRotateEveryRenewal, KeyRotateNever:
+			*kr = KeyRotation{Policy: policy}
+			return nil
+		default:
+			return fmt.Errorf("unknown key rotation policy: %q", policy)
+		}
+	}
+
+	var m struct {
+		After string `yaml:"after"`
+	}
+	err = unmarshal(&m)
+	if err != nil {
+		return err
+	}
+
+	after, err := ParseDays(m.After)
+	if err != nil {
+		return fmt.Errorf("invalid key rotation age: %v", err)
+	}
+
+	if after <= 0 {
+		return fmt.Errorf("key rotation age must be positive: %q", m.After)
+	}
+
+	*kr = KeyRotation{Policy: KeyRotateAfter, After: after}
+	return nil
+}
+
+func (kr KeyRotation) MarshalYAML() (interface{}, error) {
+	if kr.Policy != KeyRotateAfter {
+		return kr.Policy, nil
+	}
+
+	return map[string]string{
+		"after": FormatDays(kr.After),
+	}, nil
+}
+
+// Returns true iff a key of the given age should be replaced when renewing.
+func (kr *KeyRotation) ShouldRotate(age time.Duration) bool {
+	switch kr.Policy {
+	case KeyRotateNever:
+		return false
+	case KeyRotateAfter:
+		return age >= kr.After
+	default:
+		return true
+	}
 }
 
 func (k *TargetRequestKey) String() string {
@@ -162,6 +300,18 @@ type Target struct {
 	// N. Label. Controls symlink generation. See state storage specification.
 	Label string `yaml:"label,omitempty"`
 
+	// N. The name of a template in conf/templates from which settings are
+	// inherited.
+	Template string `yaml:"template,omitempty"`
+
+	// N. If set, the target file was created by applying a manifest with this
+	// owner, and applying that manifest again may update or remove it.
+	ManagedBy string `yaml:"managed-by,omitempty"`
+
+	// N. If set, this is a pack target. Its names are divided among generated
+	// targets; see TargetPack.
+	Pack TargetPack `yaml:"pack,omitempty"`
+
 	// LEGACY. Names to be satisfied. Moved to Satisfy.Names.
 	LegacyNames []string `yaml:"names,omitempty"`
 
@@ -170,6 +320,10 @@ type Target struct {
 
 	// Internal use. The filename under which the target is stored.
 	Filename string `yaml:"-"`
+
+	// Internal use. For a target generated from a pack target, the filename of
+	// the pack target.
+	PackedFrom string `yaml:"-"`
 }
 
 func (t *Target) String() string {
@@ -182,9 +336,99 @@ func (t *Target) Validate() error {
 		return fmt.Errorf("invalid provider URL: %q", t.Request.Provider)
 	}
 
+	for _, p := range t.Request.Providers {
+		if !acmeapi.ValidURL(p) {
+			return fmt.Errorf("invalid provider URL: %q", p)
+		}
+	}
+
+	return t.validateKeyTypes()
+}
+
+func (t *Target) validateKeyTypes() error {
+	// A key can only be of one type.
+	if len(t.Request.Key.Types) > 0 && t.Request.Key.ID != "" {
+		return fmt.Errorf("request.key.id cannot be used with request.key.types")
+	}
+
+	seen := map[string]struct{}{}
+	for _, keyType := range t.Request.Key.Types {
+		if !IsSupportedKeyType(keyType) {
+			return fmt.Errorf("unsupported key type: %q", keyType)
+		}
+		if _, ok := seen[keyType]; ok {
+			return fmt.Errorf("key type listed more than once: %q", keyType)
+		}
+		seen[keyType] = struct{}{}
+	}
+
 	return nil
 }
 
+// Returns one target for each key type listed in request.key.types. Each of
+// these targets requests and requires only the given key type. The primary
+// key type comes first. If the target does not list multiple key types,
+// returns a slice containing only the target itself. The variants share no
+// slices or maps with the target or each other.
+func (t *Target) KeyTypeVariants() []*Target {
+	if len(t.Request.Key.Types) == 0 {
+		return []*Target{t}
+	}
+
+	var ts []*Target
+	for _, keyType := range t.Request.Key.Types {
+		tt := t.deepCopy()
+		tt.Satisfy.Key.Type = keyType
+		tt.Request.Key.Type = keyType
+		tt.Request.Key.Types = nil
+		ts = append(ts, tt)
+	}
+
+	return ts
+}
+
+// Returns a copy of the target which shares no slices or maps with it. This
+// must be updated if a field of reference type is added to Target.
+func (t *Target) deepCopy() *Target {
+	tt := *t
+	tt.Satisfy.Names = copyStrings(t.Satisfy.Names)
+	tt.Request.Names = copyStrings(t.Request.Names)
+	tt.Request.Providers = copyStrings(t.Request.Providers)
+	tt.Request.Key.Types = copyStrings(t.Request.Key.Types)
+	tt.Request.Challenge.WebrootPaths = copyStrings(t.Request.Challenge.WebrootPaths)
+	tt.Request.Challenge.HTTPPorts = copyStrings(t.Request.Challenge.HTTPPorts)
+	tt.Request.Challenge.Env = copyEnv(t.Request.Challenge.Env)
+	tt.Request.Challenge.InheritedEnv = copyEnv(t.Request.Challenge.InheritedEnv)
+	if t.Request.Challenge.HTTPSelfTest != nil {
+		httpSelfTest := *t.Request.Challenge.HTTPSelfTest
+		tt.Request.Challenge.HTTPSelfTest = &httpSelfTest
+	}
+	tt.Pack.Names = copyStrings(t.Pack.Names)
+	tt.LegacyNames = copyStrings(t.LegacyNames)
+	return &tt
+}
+
+func copyStrings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+
+	return append([]string{}, ss...)
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	if env == nil {
+		return nil
+	}
+
+	m := make(map[string]string, len(env))
+	for k, v := range env {
+		m[k] = v
+	}
+
+	return m
+}
+
 func (t *Target) ensureFilename() {
 	if t.Filename != "" {
 		return
@@ -207,11 +451,7 @@ func (t *Target) ensureFilename() {
 
 // Returns a copy of the target.
 func (t *Target) Copy() *Target {
-	// A Target contains no pointers to part of the target which should be copied.
-	// i.e. all pointers point to other things not part of the copy. Thus we can
-	// just copy the value. If Target is ever changed to reference any component
-	// of itself via pointer, this must be changed!
-	tt := *t
+	tt := t.deepCopy()
 	tt.Request.Challenge.InheritedEnv = map[string]string{}
 	for k, v := range t.Request.Challenge.InheritedEnv {
 		tt.Request.Challenge.InheritedEnv[k] = v
@@ -220,7 +460,7 @@ func (t *Target) Copy() *Target {
 		tt.Request.Challenge.InheritedEnv[k] = v
 	}
 	tt.Request.Challenge.Env = nil
-	return &tt
+	return tt
 }
 
 // Returns a copy of the target, but zeroes any very specific fields
@@ -236,17 +476,34 @@ func (t *Target) genericise() {
 	//t.Satisfy.ReducedNamesByLabel = nil
 	t.Request.Names = nil
 	t.LegacyNames = nil
+	t.Pack = TargetPack{}
+	t.Template = ""
+	t.ManagedBy = ""
 }
 
 // Represents stored certificate information.
 type Certificate struct {
 	// N. URL to the order used to obtain the certificate. Not a direct URL to
-	// the certificate blob.
+	// the certificate blob. Empty for external certificates.
 	URL string
 
+	// N. URL of the certificate itself, as given by the order. Empty for
+	// external certificates and certificates downloaded before this was
+	// recorded.
+	CertificateURL string
+
+	// N. True if the certificate was not obtained via ACME by this store but
+	// imported, e.g. from another client or CA. An external certificate has no
+	// URL and so can never be downloaded or revoked via ACME.
+	External bool
+
 	// N. Whether this certificate should be revoked.
 	RevocationDesired bool
 
+	// N. The RFC 5280 reason code to give when revoking the certificate. Zero
+	// means unspecified.
+	RevocationReason int
+
 	// N (for now). Whether this certificate has been revoked.
 	Revoked bool
 
@@ -255,6 +512,11 @@ type Certificate struct {
 	// legacy certificate directory.
 	Account *Account
 
+	// N. The directory URL of the provider which issued the certificate. For
+	// certificates obtained before this was recorded, the directory URL of
+	// Account. Empty for external certificates.
+	Provider string
+
 	// D. Certificate data retrieved from URL, plus chained certificates.
 	// The end certificate comes first, the root last, etc.
 	Certificates [][]byte
@@ -262,10 +524,28 @@ type Certificate struct {
 	// D. True if the certificate has been downloaded.
 	Cached bool
 
+	// D. If the CA offered alternate certificate chains, all of the chains
+	// offered, each excluding the end certificate, in the order offered. The
+	// first is the default chain. The chain in Certificates is one of these.
+	Chains [][][]byte
+
 	// D. The private key for the certificate.
 	Key *Key
 
-	// D. ID: formed from hash of certificate URL.
+	// D. The most recently fetched DER-encoded OCSP response for the
+	// certificate, if any.
+	OCSPResponse []byte
+
+	// D. The key pregenerated for use by the next certificate, if any.
+	NextKey *Key
+
+	// D. For certificates linked from live/ for targets requesting multiple key
+	// types, the IDs of the certificates linked from this certificate directory
+	// as "cert-TYPE", etc. Keyed by key type.
+	KeyTypeCertificateIDs map[string]string
+
+	// D. ID: formed from hash of certificate URL, or for external certificates,
+	//    from hash of the end certificate.
 	// D. Path: formed from ID.
 }
 
@@ -276,6 +556,10 @@ func (c *Certificate) String() string {
 
 // Returns the certificate ID.
 func (c *Certificate) ID() string {
+	if c.External {
+		return determineExternalCertificateID(c.Certificates[0])
+	}
+
 	return determineCertificateID(c.URL)
 }
 
@@ -287,6 +571,14 @@ type Key struct {
 	// D. ID: Derived from the key itself.
 	ID string
 
+	// N. The time at which the key was created or imported. For keys stored
+	// before this was recorded, the modification time of the key file.
+	Created time.Time
+
+	// D. Whether the key is on the compromised key list. Compromised keys are
+	// loaded only while a certificate using them has not been revoked.
+	Compromised bool
+
 	// D. Path: formed from ID.
 }
 
@@ -295,6 +587,19 @@ func (k *Key) String() string {
 	return fmt.Sprintf("Key(%v)", k.ID)
 }
 
+// The key types which may be requested.
+var supportedKeyTypes = []string{"rsa", "ecdsa"}
+
+// Returns true iff keyType is a supported key type ("rsa" or "ecdsa").
+func IsSupportedKeyType(keyType string) bool {
+	for _, kt := range supportedKeyTypes {
+		if kt == keyType {
+			return true
+		}
+	}
+	return false
+}
+
 // Returns the type name of the key ("rsa" or "ecdsa").
 func (k *Key) Type() string {
 	switch k.PrivateKey.(type) {
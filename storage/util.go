@@ -12,10 +12,14 @@ import (
 	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
 	"io"
 	"math/big"
+	"net"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func decodeAccountURLPart(part string) (string, error) {
@@ -221,6 +225,18 @@ func determineCertificateID(url string) string {
 	return strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString(b), "="))
 }
 
+const externalCertificateIDPrefix = "external-"
+
+// External certificates have no URL, so their ID is instead formed from the
+// DER encoding of the end certificate, in the same way as for self-signed
+// certificates.
+func determineExternalCertificateID(der []byte) string {
+	h := sha256.New()
+	h.Write(der)
+	b := h.Sum(nil)
+	return externalCertificateIDPrefix + strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString(b), "="))
+}
+
 var reCertID = regexp.MustCompile(`^[a-z0-9]{52}$`)
 
 // Returns true iff the given string could (possibly) be a valid certificate
@@ -229,6 +245,12 @@ func IsWellFormattedCertificateOrKeyID(certificateID string) bool {
 	return reCertID.MatchString(certificateID)
 }
 
+// Returns true iff the given string could (possibly) be a valid certificate
+// ID, including the ID of an external certificate.
+func IsWellFormattedCertificateID(certificateID string) bool {
+	return IsWellFormattedCertificateOrKeyID(strings.TrimPrefix(certificateID, externalCertificateIDPrefix))
+}
+
 func targetGt(a *Target, b *Target) bool {
 	if a == nil && b == nil {
 		return false // equal
@@ -256,9 +278,38 @@ func containsName(names []string, name string) bool {
 	return false
 }
 
+// Normalizes a name which may be a hostname or an IPv4 or IPv6 address. IP
+// addresses are returned in their canonical textual form.
+func NormalizeName(name string) (string, error) {
+	if ip := net.ParseIP(strings.Trim(name, "[]")); ip != nil {
+		return ip.String(), nil
+	}
+
+	return acmeutils.NormalizeHostname(name)
+}
+
+// Returns true iff the name is an IP address rather than a hostname.
+func IsIPAddressName(name string) bool {
+	return net.ParseIP(name) != nil
+}
+
+// Returns the name of the live symlink for a name of a target with the given
+// label. The label follows a hostname after a colon, or an IP address after
+// an "@", since IPv6 addresses contain colons.
+func LiveName(name, label string) string {
+	switch {
+	case label == "":
+		return name
+	case IsIPAddressName(name):
+		return name + "@" + label
+	default:
+		return name + ":" + label
+	}
+}
+
 func normalizeNames(names []string) error {
 	for i := range names {
-		n, err := acmeutils.NormalizeHostname(names[i])
+		n, err := NormalizeName(names[i])
 		if err != nil {
 			return err
 		}
@@ -268,3 +319,56 @@ func normalizeNames(names []string) error {
 
 	return nil
 }
+
+// Parses a duration which may be expressed in days with a "d" suffix (e.g.
+// "180d") or in any form accepted by time.ParseDuration (e.g. "36h").
+func ParseDays(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseUint(s[0:len(s)-1], 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days: %q", s)
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// Formats a duration in the form accepted by ParseDays, preferring days
+// where possible.
+func FormatDays(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+
+	return d.String()
+}
+
+// Overwrites the contents of a file with zeroes and syncs it to disk. The
+// file is not removed.
+func overwriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(make([]byte, fi.Size()))
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
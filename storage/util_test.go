@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"testing"
+	"time"
 )
 
 // Make sure the determineKeyIDFromKey and determineKeyIDFromPublicKey
@@ -28,3 +29,37 @@ func TestKeyID(t *testing.T) {
 		t.Fatalf("key ID mismatch: %#v != %#v", keyID, keyID2)
 	}
 }
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		s string
+		d time.Duration
+	}{
+		{"180d", 180 * 24 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"36h", 36 * time.Hour},
+	}
+
+	for _, tst := range tests {
+		d, err := ParseDays(tst.s)
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", tst.s, err)
+		}
+
+		if d != tst.d {
+			t.Fatalf("mismatch parsing %q: %v != %v", tst.s, d, tst.d)
+		}
+
+		d2, err := ParseDays(FormatDays(d))
+		if err != nil || d2 != d {
+			t.Fatalf("round trip failed for %q: %v, %v", tst.s, d2, err)
+		}
+	}
+
+	for _, s := range []string{"", "d", "-1d", "xd", "1w"} {
+		_, err := ParseDays(s)
+		if err == nil {
+			t.Fatalf("expected error parsing %q", s)
+		}
+	}
+}
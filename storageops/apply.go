@@ -0,0 +1,295 @@
+package storageops
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/util"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The owner recorded in target files created from a manifest if none is
+// specified.
+const DefaultManifestOwner = "apply"
+
+// A manifest describes the complete set of targets managed by its owner. Each
+// target is keyed by the filename it is to have in the desired directory and
+// has the same format as a target file.
+type manifest struct {
+	Targets map[string]map[interface{}]interface{} `yaml:"targets"`
+}
+
+// A change to a target file made when applying a manifest.
+type TargetChange struct {
+	Filename string
+	Action   string // "create", "update" or "remove"
+	Old, New []byte
+}
+
+// Determines the changes to the desired directory needed to make it match the
+// manifest. Target files listed in the manifest are created or replaced, and
+// target files previously created from a manifest with the same owner but no
+// longer listed in it are removed. Target files not created from a manifest
+// with the same owner are never changed; if the manifest lists one, it is an
+// error. The target files listed in the manifest are linted against the
+// targets as they would be after the changes, so that e.g. renaming a target
+// does not conflict with its old name, and any problems found are returned as
+// an error.
+func PlanApply(s storage.Store, manifestData []byte, owner string) ([]*TargetChange, error) {
+	if owner == "" {
+		owner = DefaultManifestOwner
+	}
+
+	var m manifest
+	err := yaml.UnmarshalStrict(manifestData, &m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	existing, err := s.ListTargetFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var merr util.MultiError
+	var changes []*TargetChange
+	planned := map[string][]byte{}
+	for filename, settings := range m.Targets {
+		if filename == "" || strings.ContainsAny(filename, "/\\") || strings.HasPrefix(filename, ".") {
+			merr = append(merr, fmt.Errorf("invalid target filename: %q", filename))
+			continue
+		}
+
+		if settings == nil {
+			settings = map[interface{}]interface{}{}
+		}
+
+		settings["managed-by"] = owner
+		b, err := yaml.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+
+		planned[filename] = b
+
+		old, err := s.ReadTargetFile(filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+
+			changes = append(changes, &TargetChange{Filename: filename, Action: "create", New: b})
+			continue
+		}
+
+		if o := targetFileOwner(old); o != owner {
+			merr = append(merr, fmt.Errorf("target %q already exists and is not managed by %q (managed-by: %q)", filename, owner, o))
+			continue
+		}
+
+		if !bytes.Equal(old, b) {
+			changes = append(changes, &TargetChange{Filename: filename, Action: "update", Old: old, New: b})
+		}
+	}
+
+	for _, filename := range existing {
+		if _, ok := m.Targets[filename]; ok {
+			continue
+		}
+
+		old, err := s.ReadTargetFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if targetFileOwner(old) == owner {
+			changes = append(changes, &TargetChange{Filename: filename, Action: "remove", Old: old})
+			planned[filename] = nil
+		}
+	}
+
+	var filenames []string
+	for filename, b := range planned {
+		if b != nil {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		for _, p := range s.LintTargetWith(filename, "manifest: "+filename, planned[filename], planned) {
+			merr = append(merr, p)
+		}
+	}
+
+	if len(merr) > 0 {
+		return nil, merr
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Filename < changes[j].Filename
+	})
+
+	return changes, nil
+}
+
+// Returns the owner of the manifest from which a target file was created, or
+// "" if it was not created from a manifest or cannot be decoded.
+func targetFileOwner(b []byte) string {
+	var t struct {
+		ManagedBy string `yaml:"managed-by"`
+	}
+
+	yaml.Unmarshal(b, &t) // ignore errors
+	return t.ManagedBy
+}
+
+// Makes the changes determined by PlanApply, then reloads the store.
+//
+// The changes are first checked against the desired directory, so that
+// nothing is changed if a target file was changed since the changes were
+// planned. Target files are then written, and only if all were written are
+// target files removed, so that a failure never leaves names without a
+// target.
+func Apply(s storage.Store, changes []*TargetChange) error {
+	var merr util.MultiError
+	for _, c := range changes {
+		err := checkTargetChange(s, c)
+		if err != nil {
+			merr = append(merr, fmt.Errorf("cannot %s target %q: %v", c.Action, c.Filename, err))
+		}
+	}
+
+	if len(merr) > 0 {
+		return merr
+	}
+
+	for _, c := range changes {
+		if c.Action == "remove" {
+			continue
+		}
+
+		err := s.WriteTargetFile(c.Filename, c.New)
+		if err != nil {
+			merr = append(merr, fmt.Errorf("cannot %s target %q: %v", c.Action, c.Filename, err))
+		}
+	}
+
+	if len(merr) == 0 {
+		for _, c := range changes {
+			if c.Action != "remove" {
+				continue
+			}
+
+			err := s.RemoveTarget(c.Filename)
+			if err != nil {
+				merr = append(merr, fmt.Errorf("cannot %s target %q: %v", c.Action, c.Filename, err))
+			}
+		}
+	}
+
+	err := s.Reload()
+	if err != nil {
+		merr = append(merr, err)
+	}
+
+	if len(merr) > 0 {
+		return merr
+	}
+
+	return nil
+}
+
+// Checks that the target file to be changed is as it was when the change was
+// planned.
+func checkTargetChange(s storage.Store, c *TargetChange) error {
+	switch c.Action {
+	case "create", "update", "remove":
+	default:
+		return fmt.Errorf("unknown action")
+	}
+
+	old, err := s.ReadTargetFile(c.Filename)
+	if os.IsNotExist(err) {
+		if c.Action != "create" {
+			return fmt.Errorf("target file no longer exists")
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.Action == "create" {
+		return fmt.Errorf("target file was created since the changes were planned")
+	}
+
+	if !bytes.Equal(old, c.Old) {
+		return fmt.Errorf("target file was changed since the changes were planned")
+	}
+
+	return nil
+}
+
+// Describes the change as a line diff of the target file.
+func (c *TargetChange) Diff() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s desired/%s\n", c.Action, c.Filename)
+	for _, l := range diffLines(splitLines(c.Old), splitLines(c.New)) {
+		fmt.Fprintf(&buf, "  %s\n", l)
+	}
+
+	return buf.String()
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, "\n")
+}
+
+// Returns the lines of a and b, prefixed with "-" if only in a, "+" if only in
+// b and " " if in both, based on their longest common subsequence.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,175 @@
+package storageops
+
+import (
+	"github.com/hlandau/acmetool/storage"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testManifest = `targets:
+  new.example.com:
+    satisfy:
+      names:
+        - new.example.com
+  keep.example.com:
+    satisfy:
+      names:
+        - keep.example.com
+        - www.keep.example.com
+`
+
+// Writes target files with the given contents to the desired directory.
+func writeTestTargetFiles(t *testing.T, s storage.Store, files map[string]string) {
+	for filename, data := range files {
+		err := s.WriteTargetFile(filename, []byte(data))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	unowned := map[string]string{
+		"other.example.com":  "managed-by: other\nsatisfy:\n  names:\n  - other.example.com\n",
+		"manual.example.com": "satisfy:\n  names:\n  - manual.example.com\n",
+	}
+	writeTestTargetFiles(t, s, unowned)
+	writeTestTargetFiles(t, s, map[string]string{
+		"keep.example.com": "managed-by: apply\nsatisfy:\n  names:\n  - keep.example.com\n",
+		"old.example.com":  "managed-by: apply\nsatisfy:\n  names:\n  - old.example.com\n",
+	})
+
+	changes, err := PlanApply(s, []byte(testManifest), "")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	expected := []string{"update keep.example.com", "create new.example.com", "remove old.example.com"}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	for i, c := range changes {
+		if c.Action+" "+c.Filename != expected[i] {
+			t.Fatalf("got change %q, expected %q", c.Action+" "+c.Filename, expected[i])
+		}
+	}
+
+	err = Apply(s, changes)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b, err := s.ReadTargetFile("new.example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if string(b) != "managed-by: apply\nsatisfy:\n  names:\n  - new.example.com\n" {
+		t.Fatalf("unexpected target file: %q", b)
+	}
+
+	tgt := s.TargetByFilename("keep.example.com")
+	if tgt == nil || len(tgt.Satisfy.Names) != 2 {
+		t.Fatalf("target not replaced: %v", tgt)
+	}
+
+	_, err = s.ReadTargetFile("old.example.com")
+	if !os.IsNotExist(err) {
+		t.Fatalf("owned target not removed: %v", err)
+	}
+
+	// Target files of other owners, or created by hand, are left alone.
+	for filename, data := range unowned {
+		b, err := s.ReadTargetFile(filename)
+		if err != nil || string(b) != data {
+			t.Fatalf("unowned target %q changed: %q, %v", filename, b, err)
+		}
+	}
+
+	// Applying the manifest again changes nothing.
+	changes, err = PlanApply(s, []byte(testManifest), "")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(changes) != 0 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	// With another owner, the target files are all owned by someone else.
+	_, err = PlanApply(s, []byte(testManifest), "other")
+	if err == nil || !strings.Contains(err.Error(), `target "keep.example.com" already exists and is not managed by "other"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = PlanApply(s, []byte("targets:\n  manual.example.com:\n    satisfy:\n      names:\n        - manual.example.com\n"), "")
+	if err == nil || !strings.Contains(err.Error(), `target "manual.example.com" already exists and is not managed by "apply" (managed-by: "")`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Nothing is changed if a target file changed after the changes were planned.
+func TestApplyStale(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestTargetFiles(t, s, map[string]string{
+		"keep.example.com": "managed-by: apply\nsatisfy:\n  names:\n  - keep.example.com\n",
+	})
+
+	changes, err := PlanApply(s, []byte(testManifest), "")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	writeTestTargetFiles(t, s, map[string]string{
+		"keep.example.com": "managed-by: apply\nsatisfy:\n  names:\n  - keep.example.com\n  - mail.example.com\n",
+	})
+
+	err = Apply(s, changes)
+	if err == nil || !strings.Contains(err.Error(), "changed since the changes were planned") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = s.ReadTargetFile("new.example.com")
+	if !os.IsNotExist(err) {
+		t.Fatalf("target created despite error: %v", err)
+	}
+}
+
+func TestTargetChangeDiff(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		lines []string
+	}{
+		{"", "", nil},
+		{"", "a\nb\n", []string{"+a", "+b"}},
+		{"a\nb\n", "", []string{"-a", "-b"}},
+		{"a\nb\nc\n", "a\nc\nd\n", []string{" a", "-b", " c", "+d"}},
+		{"a\nb\n", "b\na\n", []string{"-a", " b", "+a"}},
+	}
+
+	for i, test := range tests {
+		lines := diffLines(splitLines([]byte(test.a)), splitLines([]byte(test.b)))
+		if strings.Join(lines, "\n") != strings.Join(test.lines, "\n") {
+			t.Fatalf("%d: got diff %q, expected %q", i, lines, test.lines)
+		}
+	}
+
+	c := &TargetChange{
+		Filename: "example.com",
+		Action:   "update",
+		Old:      []byte("satisfy:\n  names:\n  - example.com\n"),
+		New:      []byte("satisfy:\n  names:\n  - example.com\n  - www.example.com\n"),
+	}
+
+	expected := "update desired/example.com\n   satisfy:\n     names:\n     - example.com\n  +  - www.example.com\n"
+	if d := c.Diff(); d != expected {
+		t.Fatalf("unexpected diff:\n%s", d)
+	}
+}
@@ -0,0 +1,621 @@
+package storageops
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Optional configuration for the ExportState operation.
+type ExportConfig struct {
+	// If true, the "keys" directory is not included in the archive, nor are
+	// any symlinks to private keys.
+	ExcludeKeys bool
+
+	// If true, the "accounts" directory is not included in the archive, nor
+	// are any symlinks to accounts.
+	ExcludeAccounts bool
+
+	// If non-empty, private keys, including account keys, are encrypted using
+	// a key derived from this passphrase.
+	Passphrase []byte
+}
+
+// Optional configuration for the ImportState operation.
+type ImportConfig struct {
+	// The passphrase with which private keys in the archive were encrypted, if
+	// they were.
+	Passphrase []byte
+}
+
+// Writes a tar archive of the state directory at path to w. The directory
+// layout, symlinks and file modes are preserved. Temporary files and hidden
+// files are not included.
+func ExportState(path string, w io.Writer, cfg ExportConfig) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	excluded := func(rpath string) bool {
+		top := strings.SplitN(rpath, string(filepath.Separator), 2)[0]
+		switch top {
+		case "tmp":
+			return true
+		case "keys":
+			return cfg.ExcludeKeys
+		case "accounts":
+			return cfg.ExcludeAccounts
+		default:
+			return isHiddenRelPath(rpath)
+		}
+	}
+
+	var ke *keyEncrypter
+	if len(cfg.Passphrase) > 0 {
+		ke, err = newKeyEncrypter(cfg.Passphrase, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(path, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rpath, err := filepath.Rel(path, fpath)
+		if err != nil {
+			return err
+		}
+
+		if rpath == "." {
+			return nil
+		}
+
+		if excluded(rpath) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if (fi.Mode() & os.ModeSymlink) != 0 {
+			link, err = os.Readlink(fpath)
+			if err != nil {
+				return err
+			}
+
+			rlink, err := filepath.Rel(path, filepath.Join(filepath.Dir(fpath), link))
+			if err != nil {
+				return err
+			}
+
+			if excluded(rlink) {
+				log.Debugf("export: not including symlink to excluded object: %s -> %s", rpath, link)
+				return nil
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		// Ownership is determined by the permissions configuration of the
+		// importing host, not by the exporting host.
+		hdr.Name = filepath.ToSlash(rpath)
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if ke != nil && fi.Mode().IsRegular() && isKeyFile(rpath) {
+			b, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				return err
+			}
+
+			b, err = ke.encrypt(hdr.Name, b)
+			if err != nil {
+				return err
+			}
+
+			hdr.Size = int64(len(b))
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+
+			_, err = tw.Write(b)
+			return err
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Extracts a tar archive created by ExportState into the state directory at
+// path. The state directory must not already contain any targets,
+// certificates, keys, accounts or live symlinks. Objects in the archive which
+// would be placed outside the state directory or beneath a symlink, and
+// symlinks pointing outside it, are rejected. Modification times are
+// restored, as the ages of keys may be determined from them.
+//
+// The archive is extracted into a temporary directory, which is moved into
+// place only once the whole archive has been extracted and verified, so that
+// a failed import leaves the state directory as it was.
+//
+// The caller should subsequently open the state directory, which verifies it
+// and enforces the configured permissions, and relink it.
+func ImportState(path string, r io.Reader, cfg ImportConfig) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{"desired", "certs", "keys", "accounts", "live"} {
+		empty, err := dirIsEmpty(filepath.Join(path, dir))
+		if err != nil {
+			return err
+		}
+
+		if !empty {
+			return fmt.Errorf("state directory %q already contains objects in %q; refusing to import into it", path, dir)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Join(path, "tmp"), 0700)
+	if err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir(filepath.Join(path, "tmp"), "import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	dirTimes, err := extractState(staging, r, cfg)
+	if err != nil {
+		return err
+	}
+
+	err = moveTree(staging, path)
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		fpath := filepath.Join(path, dirTimes[i].rpath)
+		err = os.Chtimes(fpath, dirTimes[i].modTime, dirTimes[i].modTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The modification time of a directory, which is restored once its contents
+// have been extracted.
+type dirTime struct {
+	rpath   string
+	modTime time.Time
+}
+
+// Extracts the archive into path, which must be an empty directory, and
+// verifies that no symlink in it resolves to a location outside it.
+func extractState(path string, r io.Reader, cfg ImportConfig) ([]dirTime, error) {
+	var dirTimes []dirTime
+	var symlinks []string
+
+	kd := &keyDecrypter{passphrase: cfg.Passphrase}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rpath := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(rpath) || rpath == ".." || strings.HasPrefix(rpath, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("archive contains object outside the state directory: %q", hdr.Name)
+		}
+
+		if rpath == "." || rpath == "tmp" || isHiddenRelPath(rpath) || strings.HasPrefix(rpath, "tmp"+string(filepath.Separator)) {
+			continue
+		}
+
+		err = checkExtractPath(path, rpath, hdr.Typeflag == tar.TypeDir)
+		if err != nil {
+			return nil, err
+		}
+
+		fpath := filepath.Join(path, rpath)
+
+		// Files are created with restrictive permissions; the permissions
+		// configured for the state directory are enforced when it is opened.
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(fpath, 0700)
+			dirTimes = append(dirTimes, dirTime{rpath, hdr.ModTime})
+
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(fpath), 0700)
+			if err != nil {
+				return nil, err
+			}
+
+			var fr io.Reader = tr
+			if isKeyFile(rpath) {
+				fr, err = kd.decryptReader(hdr.Name, tr)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			err = extractFile(fpath, fr, mode&0600)
+			if err != nil {
+				return nil, err
+			}
+
+			err = os.Chtimes(fpath, hdr.ModTime, hdr.ModTime)
+
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) {
+				return nil, fmt.Errorf("archive contains symlink with absolute target: %q -> %q", hdr.Name, hdr.Linkname)
+			}
+
+			var rlink string
+			rlink, err = filepath.Rel(path, filepath.Join(filepath.Dir(fpath), hdr.Linkname))
+			if err != nil {
+				return nil, err
+			}
+
+			if rlink == ".." || strings.HasPrefix(rlink, ".."+string(filepath.Separator)) {
+				return nil, fmt.Errorf("archive contains symlink pointing outside the state directory: %q -> %q", hdr.Name, hdr.Linkname)
+			}
+
+			err = os.MkdirAll(filepath.Dir(fpath), 0700)
+			if err != nil {
+				return nil, err
+			}
+
+			err = os.Symlink(hdr.Linkname, fpath)
+			symlinks = append(symlinks, rpath)
+
+		default:
+			return nil, fmt.Errorf("archive contains object of unsupported type: %q", hdr.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The targets of symlinks are checked above without following other
+	// symlinks, which a symlink target may pass through, so the symlinks are
+	// checked again once they have all been created.
+	for _, rpath := range symlinks {
+		err := checkSymlinkTarget(path, rpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dirTimes, nil
+}
+
+// Ensures that extracting an object at rpath beneath path does not write
+// through a symlink. None of the parent directories of rpath which already
+// exist may be symlinks, and the object may not already exist unless both it
+// and the existing object are directories.
+func checkExtractPath(path, rpath string, isDir bool) error {
+	parts := strings.Split(rpath, string(filepath.Separator))
+	cur := path
+	for _, part := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if (fi.Mode() & os.ModeSymlink) != 0 {
+			return fmt.Errorf("archive contains object beneath a symlink: %q", rpath)
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("archive contains object beneath a non-directory: %q", rpath)
+		}
+	}
+
+	fi, err := os.Lstat(filepath.Join(path, rpath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if isDir && fi.IsDir() {
+		return nil
+	}
+
+	return fmt.Errorf("archive contains duplicate object: %q", rpath)
+}
+
+// Ensures that the symlink at rpath beneath path does not resolve to a
+// location outside path. Dangling symlinks are permitted.
+func checkSymlinkTarget(path, rpath string) error {
+	root, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	target, err := filepath.EvalSymlinks(filepath.Join(path, rpath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot resolve symlink %q in archive: %v", rpath, err)
+	}
+
+	rtarget, err := filepath.Rel(root, target)
+	if err != nil {
+		return err
+	}
+
+	if rtarget == ".." || strings.HasPrefix(rtarget, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("archive contains symlink resolving outside the state directory: %q", rpath)
+	}
+
+	return nil
+}
+
+// Moves the contents of the directory src into the directory dst. Directories
+// which exist in both are merged; files in dst are replaced.
+func moveTree(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		spath, dpath := filepath.Join(src, name), filepath.Join(dst, name)
+		sfi, err := os.Lstat(spath)
+		if err != nil {
+			return err
+		}
+
+		dfi, err := os.Lstat(dpath)
+		if err == nil && sfi.IsDir() && dfi.IsDir() {
+			err = moveTree(spath, dpath)
+			if err != nil {
+				return err
+			}
+
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err = os.Rename(spath, dpath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractFile(fpath string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func dirIsEmpty(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(0)
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func isHiddenRelPath(rp string) bool {
+	return strings.HasPrefix(rp, ".") || strings.Contains(rp, string(filepath.Separator)+".")
+}
+
+// Returns true iff the path, relative to the state directory, is that of a
+// private key file, including an account key file.
+func isKeyFile(rpath string) bool {
+	top := strings.SplitN(rpath, string(filepath.Separator), 2)[0]
+	return (top == "keys" || top == "accounts") && filepath.Base(rpath) == "privkey"
+}
+
+// Encrypted private keys are stored in an archive as a PEM block of this type,
+// whose headers give the scrypt salt and the AES-GCM nonce. The salt is the
+// same for all keys in an archive, so that the encryption key need only be
+// derived from the passphrase once. The name of the file in the archive is
+// authenticated, so that keys cannot be substituted for one another.
+const encryptedKeyPEMType = "ACMETOOL ENCRYPTED PRIVATE KEY"
+
+// scrypt parameters for deriving keys from passphrases.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+type keyEncrypter struct {
+	salt []byte
+	aead cipher.AEAD
+}
+
+// Derives the encryption key from the passphrase. If salt is nil, a random
+// salt is generated.
+func newKeyEncrypter(passphrase, salt []byte) (*keyEncrypter, error) {
+	if salt == nil {
+		salt = make([]byte, 16)
+		_, err := io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	k, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyEncrypter{salt: salt, aead: aead}, nil
+}
+
+func (ke *keyEncrypter) encrypt(name string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, ke.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyPEMType,
+		Headers: map[string]string{
+			"Salt":  base64.StdEncoding.EncodeToString(ke.salt),
+			"Nonce": base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: ke.aead.Seal(nil, nonce, plaintext, []byte(name)),
+	}), nil
+}
+
+type keyDecrypter struct {
+	passphrase []byte
+	ke         *keyEncrypter
+}
+
+// Returns a reader for the contents of a key file read from r, decrypting it
+// if it is encrypted.
+func (kd *keyDecrypter) decryptReader(name string, r io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		return bytes.NewReader(b), nil
+	}
+
+	if len(kd.passphrase) == 0 {
+		return nil, fmt.Errorf("archive contains encrypted private keys, but no passphrase was given")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted private key: %q: %v", name, err)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted private key: %q: %v", name, err)
+	}
+
+	if kd.ke == nil || !bytes.Equal(kd.ke.salt, salt) {
+		kd.ke, err = newKeyEncrypter(kd.passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(nonce) != kd.ke.aead.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted private key: %q", name)
+	}
+
+	plaintext, err := kd.ke.aead.Open(nil, nonce, block.Bytes, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt private key %q; the passphrase may be wrong", name)
+	}
+
+	return bytes.NewReader(plaintext), nil
+}
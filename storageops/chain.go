@@ -0,0 +1,76 @@
+package storageops
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"gopkg.in/hlandau/acmeapi.v2"
+)
+
+// Retrieves the alternate certificate chains offered by the CA for a
+// downloaded certificate. Returns all chains, each excluding the end
+// certificate, with the default chain first, or nil if no alternate chains are
+// offered. Alternate chains which cannot be retrieved or which are not for the
+// same end certificate are skipped.
+func loadCertificateChains(ctx context.Context, cl *acmeapi.RealmClient, acct *acmeapi.Account, cert *acmeapi.Certificate) [][][]byte {
+	if len(cert.LinkAlternate) == 0 {
+		return nil
+	}
+
+	chains := [][][]byte{cert.CertificateChain[1:]}
+	for _, u := range cert.LinkAlternate {
+		alt := &acmeapi.Certificate{
+			URL: u,
+		}
+
+		err := cl.LoadCertificate(ctx, acct, alt)
+		if err != nil {
+			log.Errore(err, "failed to load alternate certificate chain ", u)
+			continue
+		}
+
+		if len(alt.CertificateChain) == 0 || !bytes.Equal(alt.CertificateChain[0], cert.CertificateChain[0]) {
+			log.Warnf("alternate certificate chain %q is not for the same certificate, ignoring it", u)
+			continue
+		}
+
+		chains = append(chains, alt.CertificateChain[1:])
+	}
+
+	return chains
+}
+
+// Returns the end certificate followed by the first of the chains matching the
+// preferred chain name, or by the first (default) chain if none matches. A
+// chain matches if the common name of the issuer of its topmost certificate is
+// the preferred chain name. Only the topmost certificate is considered, as the
+// chains offered usually share intermediates; otherwise the default chain
+// would match a root which only issued its intermediate.
+func selectCertificateChain(endCert []byte, chains [][][]byte, preferredChain string) [][]byte {
+	selected := chains[0]
+	if preferredChain != "" {
+		for _, chain := range chains {
+			if chainMatches(chain, preferredChain) {
+				selected = chain
+				break
+			}
+		}
+	}
+
+	return append([][]byte{endCert}, selected...)
+}
+
+func chainMatches(chain [][]byte, name string) bool {
+	if len(chain) == 0 {
+		return false
+	}
+
+	c, err := x509.ParseCertificate(chain[len(chain)-1])
+	if err != nil {
+		return false
+	}
+
+	// If the chain includes its root, the root is self-issued, so this matches
+	// the subject of the root.
+	return c.Issuer.CommonName == name
+}
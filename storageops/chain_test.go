@@ -0,0 +1,99 @@
+package storageops
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Creates a CA certificate with the given common name, issued by issuer, or
+// self-issued if issuer is nil. The key of the CA is key, or a new key if key
+// is nil, so that cross-signed certificates can be made.
+func newTestCA(t *testing.T, name string, key *ecdsa.PrivateKey, issuer *testCA) *testCA {
+	if key == nil {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	parent, signer := tpl, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return &testCA{cert: c, key: key}
+}
+
+// Both chains contain an intermediate issued by "ISRG Root X1". They differ
+// only in the topmost certificate, which in the default chain is the root
+// cross-signed by "DST Root CA X3", and in the alternate chain is the
+// self-signed root.
+func TestSelectCertificateChain(t *testing.T) {
+	dst := newTestCA(t, "DST Root CA X3", nil, nil)
+	x1 := newTestCA(t, "ISRG Root X1", nil, nil)
+	x1Cross := newTestCA(t, "ISRG Root X1", x1.key, dst)
+	r3 := newTestCA(t, "R3", nil, x1)
+
+	endCert := []byte("end")
+	longChain := [][]byte{r3.cert.Raw, x1Cross.cert.Raw}
+	shortChain := [][]byte{r3.cert.Raw, x1.cert.Raw}
+	chains := [][][]byte{longChain, shortChain}
+
+	tests := []struct {
+		preferredChain string
+		expected       [][]byte
+	}{
+		{"", longChain},
+		{"ISRG Root X1", shortChain},
+		{"DST Root CA X3", longChain},
+		{"R3", longChain},
+		{"Unknown Root", longChain},
+	}
+
+	for _, tst := range tests {
+		selected := selectCertificateChain(endCert, chains, tst.preferredChain)
+		if len(selected) != len(tst.expected)+1 || !bytes.Equal(selected[0], endCert) {
+			t.Fatalf("wrong chain selected for %q", tst.preferredChain)
+		}
+
+		for i, der := range tst.expected {
+			if !bytes.Equal(selected[i+1], der) {
+				t.Fatalf("wrong chain selected for %q", tst.preferredChain)
+			}
+		}
+	}
+}
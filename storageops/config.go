@@ -10,6 +10,10 @@ func RemoveTargetHostname(s storage.Store, hostname string) error {
 			return nil // continue
 		}
 
+		if t.PackedFrom != "" {
+			return removePackTargetHostname(s, s.TargetByFilename(t.PackedFrom), hostname)
+		}
+
 		t.Satisfy.Names = removeStringFromList(t.Satisfy.Names, hostname)
 		t.Request.Names = removeStringFromList(t.Request.Names, hostname)
 
@@ -21,6 +25,33 @@ func RemoveTargetHostname(s storage.Store, hostname string) error {
 	})
 }
 
+// Removes hostname from the names list of a pack target. Names listed in the
+// directory of a pack target must be removed from the directory instead.
+func removePackTargetHostname(s storage.Store, pt *storage.Target, hostname string) error {
+	if pt == nil {
+		return nil
+	}
+
+	var names []string
+	for _, name := range pt.Pack.Names {
+		if n, err := storage.NormalizeName(name); err != nil || n != hostname {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == len(pt.Pack.Names) {
+		log.Warnf("%q is not listed in pack target %q; if it is in the pack directory %q, remove it from there", hostname, pt.Filename, pt.Pack.Directory)
+		return nil
+	}
+
+	pt.Pack.Names = names
+	if !pt.Pack.IsSet() {
+		return s.RemoveTarget(pt.Filename)
+	}
+
+	return s.SaveTarget(pt)
+}
+
 func containsName(names []string, name string) bool {
 	for _, n := range names {
 		if n == name {
@@ -1,12 +1,50 @@
 package storageops
 
-import "github.com/hlandau/acmetool/storage"
+import (
+	"crypto/x509"
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/util"
+	"strings"
+	"time"
+)
 
-func Cull(s storage.Store, simulate bool) error {
+// Keys created or imported more recently than this are not culled by default.
+// This protects keys for certificates which have been requested but not yet
+// downloaded, as well as keys imported for future use.
+const DefaultKeyCullGracePeriod = 30 * 24 * time.Hour
+
+// Optional configuration for the Cull operation.
+type CullConfig struct {
+	// If true, log what would be deleted without deleting anything.
+	Simulate bool
+
+	// Unreferenced keys created or imported more recently than this are not
+	// culled. If zero, DefaultKeyCullGracePeriod is used. If negative, there
+	// is no grace period.
+	KeyGracePeriod time.Duration
+
+	// If true, key files are overwritten before being deleted.
+	EraseKeys bool
+}
+
+func Cull(s storage.Store, cfg CullConfig) error {
 	certificatesToCull := map[string]*storage.Certificate{}
+	culledCertificates := map[string]*storage.Certificate{}
+
+	// Keys specified by the default target must not be culled.
+	err := s.DefaultTargetError()
+	if err != nil {
+		return err
+	}
+
+	// A target which cannot be loaded would be treated as absent, so its
+	// certificates and the key it specifies would be culled.
+	if loadErrs := TargetLoadErrors(s); len(loadErrs) > 0 {
+		return util.MultiError(loadErrs)
+	}
 
 	// Relink before culling.
-	err := Relink(s)
+	err = Relink(s)
 	if err != nil {
 		return err
 	}
@@ -20,23 +58,134 @@ func Cull(s storage.Store, simulate bool) error {
 	// Unselect any certificate which is currently referenced.
 	s.VisitPreferredCertificates(func(hostname string, c *storage.Certificate) error {
 		delete(certificatesToCull, c.ID())
+		for _, kcID := range c.KeyTypeCertificateIDs {
+			delete(certificatesToCull, kcID)
+		}
 		return nil
 	})
 
 	// Now delete any certificate which is not generally valid.
 	for certID, c := range certificatesToCull {
 		if CertificateGenerallyValid(c) {
+			delete(certificatesToCull, certID)
 			continue
 		}
 
-		if simulate {
+		if cfg.Simulate {
 			log.Noticef("would delete certificate %s", certID)
 		} else {
 			log.Noticef("deleting certificate %s", certID)
 			err := s.RemoveCertificate(certID)
-			log.Errore(err, "failed to delete certificate ", certID)
+			if err != nil {
+				// The certificate is still present, so its key must be kept.
+				log.Errore(err, "failed to delete certificate ", certID)
+				continue
+			}
 		}
+
+		culledCertificates[certID] = c
 	}
 
+	cullKeys(s, cfg, culledCertificates)
 	return nil
 }
+
+// Deletes keys which are not referenced by any certificate (other than those
+// in culledCertificates) or target and which were not created recently.
+// Compromised keys are deleted as soon as they are not referenced.
+func cullKeys(s storage.Store, cfg CullConfig, culledCertificates map[string]*storage.Certificate) {
+	gracePeriod := cfg.KeyGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultKeyCullGracePeriod
+	} else if gracePeriod < 0 {
+		gracePeriod = 0
+	}
+
+	referencedKeys := map[string]struct{}{}
+	s.VisitCertificates(func(c *storage.Certificate) error {
+		// When simulating, culled certificates have not actually been removed.
+		if _, culled := culledCertificates[c.ID()]; culled {
+			return nil
+		}
+
+		if c.Key != nil {
+			referencedKeys[c.Key.ID] = struct{}{}
+		} else if keyID, ok := certificateKeyID(c); ok {
+			// Compromised keys are not loaded once the certificates using them
+			// have been revoked, so are not linked to those certificates.
+			referencedKeys[keyID] = struct{}{}
+		}
+		if c.NextKey != nil {
+			referencedKeys[c.NextKey.ID] = struct{}{}
+		}
+		return nil
+	})
+
+	addTargetKey := func(t *storage.Target) {
+		if t.Request.Key.ID != "" {
+			referencedKeys[strings.TrimSpace(strings.ToLower(t.Request.Key.ID))] = struct{}{}
+		}
+	}
+	addTargetKey(s.DefaultTarget())
+	s.VisitTargets(func(t *storage.Target) error {
+		addTargetKey(t)
+		return nil
+	})
+
+	var keysToCull []string
+	s.VisitKeys(func(k *storage.Key) error {
+		if _, ok := referencedKeys[k.ID]; ok {
+			return nil
+		}
+
+		if k.Created.IsZero() || storage.InternalClock.Now().Sub(k.Created) < gracePeriod {
+			log.Debugf("%v is unreferenced but was created recently (%v), not culling", k, k.Created)
+			return nil
+		}
+
+		keysToCull = append(keysToCull, k.ID)
+		return nil
+	})
+
+	s.VisitCompromisedKeys(func(keyID string) error {
+		if _, ok := referencedKeys[keyID]; !ok {
+			keysToCull = append(keysToCull, keyID)
+		}
+		return nil
+	})
+
+	for _, keyID := range keysToCull {
+		if cfg.Simulate {
+			log.Noticef("would delete key %s", keyID)
+			continue
+		}
+
+		log.Noticef("deleting key %s", keyID)
+		var err error
+		if cfg.EraseKeys {
+			err = s.EraseKey(keyID)
+		} else {
+			err = s.RemoveKey(keyID)
+		}
+		log.Errore(err, "failed to delete key ", keyID)
+	}
+}
+
+// Returns the ID of the key used by a downloaded certificate.
+func certificateKeyID(c *storage.Certificate) (string, bool) {
+	if len(c.Certificates) == 0 {
+		return "", false
+	}
+
+	cc, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return "", false
+	}
+
+	keyID, err := storage.DetermineKeyIDFromPublicKey(cc.PublicKey)
+	if err != nil {
+		return "", false
+	}
+
+	return keyID, true
+}
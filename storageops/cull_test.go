@@ -0,0 +1,207 @@
+package storageops
+
+import (
+	"github.com/hlandau/acmetool/storage"
+	"github.com/jmhodges/clock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the IDs of the keys in the store, including compromised keys which
+// are no longer loaded.
+func storedKeyIDs(s storage.Store) map[string]bool {
+	keyIDs := map[string]bool{}
+	s.VisitKeys(func(k *storage.Key) error {
+		keyIDs[k.ID] = true
+		return nil
+	})
+	s.VisitCompromisedKeys(func(keyID string) error {
+		keyIDs[keyID] = true
+		return nil
+	})
+	return keyIDs
+}
+
+func TestCullKeys(t *testing.T) {
+	defer func(c clock.Clock) { storage.InternalClock = c }(storage.InternalClock)
+
+	tests := []struct {
+		// The time elapsed since the keys were created, and the grace period.
+		age, gracePeriod time.Duration
+		// Whether the unreferenced key which is not compromised is culled.
+		culled bool
+	}{
+		{age: 10 * 24 * time.Hour},
+		{age: 40 * 24 * time.Hour, culled: true},
+		{age: 2 * time.Hour, gracePeriod: time.Hour, culled: true},
+		{age: 2 * time.Hour, gracePeriod: 3 * time.Hour},
+		{gracePeriod: -1, culled: true},
+	}
+
+	for i, test := range tests {
+		s, cleanup := newTestStore(t)
+		defer cleanup()
+
+		importKey := func() string {
+			k, err := s.ImportKey(newTestKey(t))
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			return k.ID
+		}
+
+		ca := newTestCA(t, "CA", nil, nil)
+		c := newTestStoredCertificate(t, s, ca, newTestKey(t), []string{"example.com"})
+		certKeyID := c.Key.ID
+
+		nextKeyID := importKey()
+		err := s.SetNextKey(c, s.KeyByID(nextKeyID))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		targetKeyID := importKey()
+		tgt := &storage.Target{}
+		tgt.Satisfy.Names = []string{"example.com"}
+		tgt.Request.Key.ID = targetKeyID
+		err = s.SaveTarget(tgt)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		unreferencedKeyID := importKey()
+
+		// A compromised key used by a revoked certificate is no longer loaded, but
+		// is still referenced by the certificate.
+		revoked := newTestStoredCertificate(t, s, ca, newTestKey(t), []string{"example.net"})
+		revokedKeyID := revoked.Key.ID
+		revoked.Revoked = true
+		err = s.SaveCertificate(revoked)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		compromisedKeyID := importKey()
+		for _, keyID := range []string{revokedKeyID, compromisedKeyID} {
+			err = s.MarkKeyCompromised(keyID)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+		}
+
+		err = s.Reload()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		fc := clock.NewFake()
+		fc.Set(time.Now().Add(test.age))
+		storage.InternalClock = fc
+
+		cullKeys(s, CullConfig{KeyGracePeriod: test.gracePeriod}, nil)
+
+		// Compromised keys are culled regardless of age once unreferenced.
+		expected := map[string]bool{
+			certKeyID:         true,
+			nextKeyID:         true,
+			targetKeyID:       true,
+			revokedKeyID:      true,
+			unreferencedKeyID: !test.culled,
+			compromisedKeyID:  false,
+		}
+
+		keyIDs := storedKeyIDs(s)
+		for keyID, kept := range expected {
+			if keyIDs[keyID] != kept {
+				t.Fatalf("%d: key %s kept: %v, expected %v", i, keyID, keyIDs[keyID], kept)
+			}
+		}
+
+		// Once the revoked certificate is removed, its compromised key is culled.
+		err = s.RemoveCertificate(revoked.ID())
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		cullKeys(s, CullConfig{KeyGracePeriod: test.gracePeriod}, nil)
+		if storedKeyIDs(s)[revokedKeyID] {
+			t.Fatalf("%d: compromised key not culled once unreferenced", i)
+		}
+	}
+}
+
+// Keys of certificates being culled are culled with them, even when only
+// simulating the removal of the certificates.
+func TestCullKeysCulledCertificates(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	ca := newTestCA(t, "CA", nil, nil)
+	c := newTestStoredCertificate(t, s, ca, newTestKey(t), []string{"example.com"})
+
+	cullKeys(s, CullConfig{KeyGracePeriod: -1, Simulate: true}, map[string]*storage.Certificate{c.ID(): c})
+	if !storedKeyIDs(s)[c.Key.ID] {
+		t.Fatalf("key removed when simulating")
+	}
+
+	cullKeys(s, CullConfig{KeyGracePeriod: -1}, map[string]*storage.Certificate{c.ID(): c})
+	if storedKeyIDs(s)[c.Key.ID] {
+		t.Fatalf("key of culled certificate not culled")
+	}
+}
+
+// Nothing is culled while a target file cannot be loaded, as its certificates
+// and the key it specifies would be treated as unreferenced.
+func TestCullTargetLoadError(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	k, err := s.ImportKey(newTestKey(t))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	fn := filepath.Join(s.Path(), "desired", "example.com")
+	err = ioutil.WriteFile(fn, []byte("satisfy:\n  names:\n    - example.com\nrequest:\n  key:\n    id: "+k.ID+"\nobsolete: true\n"), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = Cull(s, CullConfig{KeyGracePeriod: -1})
+	if err == nil || !strings.Contains(err.Error(), "desired/example.com") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !storedKeyIDs(s)[k.ID] {
+		t.Fatalf("key specified by target which cannot be loaded culled")
+	}
+
+	// Once the target file is removed, the key is no longer referenced.
+	err = os.Remove(fn)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = Cull(s, CullConfig{KeyGracePeriod: -1})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if storedKeyIDs(s)[k.ID] {
+		t.Fatalf("unreferenced key not culled")
+	}
+}
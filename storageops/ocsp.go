@@ -0,0 +1,209 @@
+package storageops
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"github.com/hlandau/acmetool/hooks"
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/util"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// How long to wait for an OCSP responder.
+const ocspTimeout = 30 * time.Second
+
+// If an OCSP response does not specify when the next update will be
+// available, it is refreshed after this interval.
+const ocspDefaultRefreshInterval = 12 * time.Hour
+
+// OCSP responses larger than this are rejected.
+const ocspMaxResponseSize = 1024 * 1024
+
+// Fetches and stores OCSP responses for all preferred certificates which do
+// not already have a sufficiently fresh response, and invokes the ocsp-updated
+// hooks for the hostnames whose responses were updated.
+func RefreshOCSP(ctx context.Context, store storage.Store) error {
+	err := makeReconcile(store, ReconcileConfig{}).RefreshOCSP(ctx)
+	log.Errore(err, "failed to refresh OCSP responses")
+	return err
+}
+
+func (r *reconcile) RefreshOCSP(ctx context.Context) error {
+	certHostnames := map[*storage.Certificate][]string{}
+	r.store.VisitPreferredCertificates(func(hostname string, c *storage.Certificate) error {
+		certHostnames[c] = append(certHostnames[c], hostname)
+		return nil
+	})
+
+	var merr util.MultiError
+	var updatedHostnames []string
+	for c, hostnames := range certHostnames {
+		_, updated := r.ocspUpdated[c.ID()]
+		refreshed, err := r.refreshOCSP(ctx, c)
+		if err != nil {
+			merr = append(merr, fmt.Errorf("failed to refresh OCSP response for %v: %v", c, err))
+		}
+
+		if updated || refreshed {
+			updatedHostnames = append(updatedHostnames, hostnames...)
+		}
+	}
+
+	r.ocspUpdated = map[string]struct{}{}
+	sort.Strings(updatedHostnames)
+
+	hctx := &hooks.Context{
+		StateDir: r.store.Path(),
+	}
+
+	err := hooks.NotifyOCSPUpdated(hctx, updatedHostnames) // ignore error
+	log.Errore(err, "failed to call notify hooks")
+
+	if len(merr) > 0 {
+		return merr
+	}
+
+	return nil
+}
+
+// Fetches an OCSP response for the certificate if it does not have one which
+// is sufficiently fresh. Returns true if a new response was stored.
+func (r *reconcile) refreshOCSP(ctx context.Context, c *storage.Certificate) (updated bool, err error) {
+	if c.Revoked || len(c.Certificates) < 2 {
+		return false, nil
+	}
+
+	leaf, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return false, err
+	}
+
+	issuer, err := x509.ParseCertificate(c.Certificates[1])
+	if err != nil {
+		return false, err
+	}
+
+	if len(leaf.OCSPServer) == 0 {
+		log.Debugf("%v does not specify an OCSP responder", c)
+		return false, nil
+	}
+
+	if len(c.OCSPResponse) > 0 && !OCSPResponseNeedsRefreshing(c.OCSPResponse, leaf, issuer) {
+		log.Debugf("%v: OCSP response does not need refreshing", c)
+		return false, nil
+	}
+
+	der, res, err := fetchOCSPResponse(ctx, leaf, issuer)
+	if err != nil {
+		return false, err
+	}
+
+	if res.Status == ocsp.Revoked {
+		return false, r.markRevokedByCA(c)
+	}
+
+	if res.Status != ocsp.Good {
+		return false, fmt.Errorf("OCSP responder does not report certificate as good (status %d)", res.Status)
+	}
+
+	return r.storeOCSPResponse(c, der, res)
+}
+
+// Stores an OCSP response reporting that the certificate is good. Returns
+// true if it differs from the stored response. The certificate is recorded as
+// having an updated response, so that the ocsp-updated hooks are invoked for
+// it even if the response was stored before the certificates were reloaded.
+func (r *reconcile) storeOCSPResponse(c *storage.Certificate, der []byte, res *ocsp.Response) (updated bool, err error) {
+	if bytes.Equal(der, c.OCSPResponse) {
+		return false, nil
+	}
+
+	log.Debugf("%v: storing OCSP response produced at %v, next update %v", c, res.ProducedAt, res.NextUpdate)
+	err = r.store.SaveOCSPResponse(c, der)
+	if err != nil {
+		return false, err
+	}
+
+	r.ocspUpdated[c.ID()] = struct{}{}
+	return true, nil
+}
+
+// Returns true if the OCSP response is invalid or has passed the halfway point
+// of its validity period.
+func OCSPResponseNeedsRefreshing(der []byte, leaf, issuer *x509.Certificate) bool {
+	res, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		log.Debugf("stored OCSP response is invalid: %v", err)
+		return true
+	}
+
+	return !storage.InternalClock.Now().Before(ocspRefreshTime(res))
+}
+
+func ocspRefreshTime(res *ocsp.Response) time.Time {
+	if res.NextUpdate.IsZero() {
+		return res.ThisUpdate.Add(ocspDefaultRefreshInterval)
+	}
+
+	return res.ThisUpdate.Add(res.NextUpdate.Sub(res.ThisUpdate) / 2)
+}
+
+// Requests the status of the leaf certificate from its OCSP responder. The
+// response is verified against the issuer and returned in both DER-encoded
+// and parsed form.
+func fetchOCSPResponse(ctx context.Context, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ocspTimeout)
+	defer cancel()
+
+	hreq, err := http.NewRequest("POST", leaf.OCSPServer[0], bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hreq = hreq.WithContext(ctx)
+	hreq.Header.Set("Content-Type", "application/ocsp-request")
+	hreq.Header.Set("Accept", "application/ocsp-response")
+
+	cl := InternalHTTPClient
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+
+	hres, err := cl.Do(hreq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hres.Body.Close()
+
+	if hres.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder %q returned status %d", leaf.OCSPServer[0], hres.StatusCode)
+	}
+
+	der, err := ioutil.ReadAll(io.LimitReader(hres.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !res.NextUpdate.IsZero() && !storage.InternalClock.Now().Before(res.NextUpdate) {
+		return nil, nil, fmt.Errorf("OCSP responder %q returned a stale response (next update %v)", leaf.OCSPServer[0], res.NextUpdate)
+	}
+
+	return der, res, nil
+}
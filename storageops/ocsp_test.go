@@ -0,0 +1,277 @@
+package storageops
+
+import (
+	"context"
+	"crypto/x509"
+	"github.com/hlandau/acmetool/acmetest"
+	"github.com/hlandau/acmetool/hooks"
+	"github.com/hlandau/acmetool/storage"
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Starts an in-process CA and directs the OCSP and CRL requests made by this
+// package to it, using a fake clock set to the current time. The returned
+// function stops the CA and restores the global state changed.
+func newTestStatusServer(t *testing.T, cfg acmetest.Config) (*acmetest.Server, clock.FakeClock, func()) {
+	srv, err := acmetest.New(cfg)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	httpClient, clk := InternalHTTPClient, storage.InternalClock
+	InternalHTTPClient = srv.HTTPClient()
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	storage.InternalClock = fc
+
+	return srv, fc, func() {
+		InternalHTTPClient, storage.InternalClock = httpClient, clk
+		srv.Close()
+	}
+}
+
+// Stores a certificate issued by srv for the given names, which becomes the
+// preferred certificate for each of them.
+func issueTestCertificate(t *testing.T, s storage.Store, srv *acmetest.Server, names []string) *storage.Certificate {
+	key := newTestKey(t)
+	chain, err := srv.IssueCertificate(names, &key.PublicKey)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c := storeTestChain(t, s, key, chain)
+	for _, name := range names {
+		err = s.SetPreferredCertificateForHostname(name, c)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return s.CertificateByID(c.ID())
+}
+
+// Installs an ocsp-updated hook which appends the hostnames it is passed to
+// the returned file.
+func installOCSPUpdatedHook(t *testing.T, s storage.Store) string {
+	dir := filepath.Join(s.Path(), "hooks")
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "record"), []byte(`#!/bin/sh
+set -e
+[ "$1" = "ocsp-updated" ] || exit 42
+cat >> "$ACME_STATE_DIR/ocsp-updated.log"
+`), 0755)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	defaultPaths := hooks.DefaultPaths
+	hooks.DefaultPaths = []string{dir}
+	t.Cleanup(func() { hooks.DefaultPaths = defaultPaths })
+
+	return filepath.Join(s.Path(), "ocsp-updated.log")
+}
+
+func readTestFile(t *testing.T, fn string) string {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("error: %v", err)
+	}
+
+	return string(b)
+}
+
+// Returns the stored OCSP response of a certificate after verifying it
+// against the issuer.
+func storedOCSPResponse(t *testing.T, s storage.Store, c *storage.Certificate, issuer *x509.Certificate) []byte {
+	c = s.CertificateByID(c.ID())
+	leaf, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	res, err := ocsp.ParseResponseForCert(c.OCSPResponse, leaf, issuer)
+	if err != nil {
+		t.Fatalf("stored OCSP response for %v is invalid: %v", c, err)
+	}
+
+	if res.Status != ocsp.Good {
+		t.Fatalf("stored OCSP response has status %d", res.Status)
+	}
+
+	return c.OCSPResponse
+}
+
+// Responses are refreshed once half of their validity period has passed, and
+// the ocsp-updated hooks are invoked for the hostnames of the certificates
+// whose responses were refreshed.
+func TestRefreshOCSP(t *testing.T) {
+	srv, fc, stop := newTestStatusServer(t, acmetest.Config{OCSP: true})
+	defer stop()
+
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	hookLog := installOCSPUpdatedHook(t, s)
+	c1 := issueTestCertificate(t, s, srv, []string{"example.com", "www.example.com"})
+	c2 := issueTestCertificate(t, s, srv, []string{"example.net"})
+
+	err := RefreshOCSP(context.Background(), s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	res1 := storedOCSPResponse(t, s, c1, srv.CACertificate())
+	res2 := storedOCSPResponse(t, s, c2, srv.CACertificate())
+	if l := readTestFile(t, hookLog); l != "example.com\nexample.net\nwww.example.com\n" {
+		t.Fatalf("unexpected hostnames passed to hook: %q", l)
+	}
+
+	// The responses are valid for four days, so are not refreshed until two
+	// days have passed. Responses are signed afresh for each request, so a
+	// response which was not refreshed is unchanged.
+	for _, d := range []time.Duration{0, 36 * time.Hour} {
+		fc.Set(time.Now().Add(d))
+		err = RefreshOCSP(context.Background(), s)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if string(storedOCSPResponse(t, s, c1, srv.CACertificate())) != string(res1) {
+			t.Fatalf("response refreshed after %v", d)
+		}
+	}
+
+	if l := readTestFile(t, hookLog); l != "example.com\nexample.net\nwww.example.com\n" {
+		t.Fatalf("hook invoked without responses being refreshed: %q", l)
+	}
+
+	fc.Set(time.Now().Add(3 * 24 * time.Hour))
+	err = RefreshOCSP(context.Background(), s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if string(storedOCSPResponse(t, s, c1, srv.CACertificate())) == string(res1) ||
+		string(storedOCSPResponse(t, s, c2, srv.CACertificate())) == string(res2) {
+		t.Fatalf("responses not refreshed after half-life")
+	}
+
+	if l := readTestFile(t, hookLog); l != "example.com\nexample.net\nwww.example.com\nexample.com\nexample.net\nwww.example.com\n" {
+		t.Fatalf("unexpected hostnames passed to hook: %q", l)
+	}
+}
+
+// Responses which cannot be verified against the issuer, or which are stale,
+// are not stored.
+func TestRefreshOCSPVerification(t *testing.T) {
+	srv, fc, stop := newTestStatusServer(t, acmetest.Config{OCSP: true})
+	defer stop()
+
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	installOCSPUpdatedHook(t, s)
+
+	// A certificate stored with the wrong issuer.
+	key := newTestKey(t)
+	chain, err := srv.IssueCertificate([]string{"example.com"}, &key.PublicKey)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	ca := newTestCA(t, "CA", nil, nil)
+	c := storeTestChain(t, s, key, [][]byte{chain[0], ca.cert.Raw})
+	err = s.SetPreferredCertificateForHostname("example.com", c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = RefreshOCSP(context.Background(), s)
+	if err == nil {
+		t.Fatalf("response not signed by issuer accepted")
+	}
+
+	if len(s.CertificateByID(c.ID()).OCSPResponse) != 0 {
+		t.Fatalf("response not signed by issuer stored")
+	}
+
+	// The responses of the server are valid for four days.
+	s, cleanup = newTestStore(t)
+	defer cleanup()
+
+	c = issueTestCertificate(t, s, srv, []string{"example.net"})
+	fc.Set(time.Now().Add(5 * 24 * time.Hour))
+	err = RefreshOCSP(context.Background(), s)
+	if err == nil {
+		t.Fatalf("stale response accepted")
+	}
+
+	if len(s.CertificateByID(c.ID()).OCSPResponse) != 0 {
+		t.Fatalf("stale response stored")
+	}
+
+	fc.Set(time.Now())
+	err = RefreshOCSP(context.Background(), s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	storedOCSPResponse(t, s, c, srv.CACertificate())
+}
+
+// A certificate which the responder reports as revoked is marked as revoked.
+func TestRefreshOCSPRevoked(t *testing.T) {
+	srv, _, stop := newTestStatusServer(t, acmetest.Config{OCSP: true})
+	defer stop()
+
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	hookLog := installOCSPUpdatedHook(t, s)
+	c := issueTestCertificate(t, s, srv, []string{"example.com"})
+
+	err := srv.Revoke(c.Certificates[0], 1)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = RefreshOCSP(context.Background(), s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c = s.CertificateByID(c.ID())
+	if !c.Revoked || len(c.OCSPResponse) != 0 {
+		t.Fatalf("certificate not marked as revoked: %v", c)
+	}
+
+	if l := readTestFile(t, hookLog); l != "" {
+		t.Fatalf("hook invoked for revoked certificate: %q", l)
+	}
+}
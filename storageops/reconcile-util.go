@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"github.com/hlandau/acmetool/storage"
+	"strings"
 )
 
 func HaveUncachedCertificates(s storage.Store) bool {
@@ -70,6 +71,11 @@ func DoesCertificateSatisfy(c *storage.Certificate, t *storage.Target) bool {
 		return false
 	}
 
+	if c.Key.Compromised {
+		log.Debugf("%v cannot satisfy %v because its key has been compromised", c, t)
+		return false
+	}
+
 	cc, err := x509.ParseCertificate(c.Certificates[0])
 	if err != nil {
 		log.Debugf("%v cannot satisfy %v because we cannot parse it: %v", c, t, err)
@@ -77,14 +83,13 @@ func DoesCertificateSatisfy(c *storage.Certificate, t *storage.Target) bool {
 	}
 
 	names := map[string]struct{}{}
-	for _, name := range cc.DNSNames {
-		names[name] = struct{}{}
+	for _, name := range CertificateNames(cc) {
+		names[strings.ToLower(name)] = struct{}{}
 	}
 
 	for _, name := range t.Satisfy.Names {
-		_, ok := names[name]
-		if !ok {
-			log.Debugf("%v cannot satisfy %v because required hostname %q is not listed on it: %#v", c, t, name, cc.DNSNames)
+		if !namesCover(names, name) {
+			log.Debugf("%v cannot satisfy %v because required name %q is not listed on it: %#v", c, t, name, CertificateNames(cc))
 			return false
 		}
 	}
@@ -98,6 +103,58 @@ func DoesCertificateSatisfy(c *storage.Certificate, t *storage.Target) bool {
 	return true
 }
 
+// Returns true iff the name is one of the given names, or is matched by a
+// wildcard among them. As per RFC 6125, a wildcard may only be the entire
+// left-most label, and matches exactly one label; "*.example.com" matches
+// "foo.example.com" but neither "example.com" nor "bar.foo.example.com".
+// Wildcard names themselves, and IP addresses, are only matched exactly.
+func namesCover(names map[string]struct{}, name string) bool {
+	if _, ok := names[name]; ok {
+		return true
+	}
+
+	wildcard, ok := wildcardFor(name)
+	if !ok {
+		return false
+	}
+
+	_, ok = names[wildcard]
+	return ok
+}
+
+// Returns the wildcard name which would match the given name, e.g.
+// "*.example.com" for "foo.example.com". Returns false if no wildcard could
+// match the name.
+func wildcardFor(name string) (string, bool) {
+	if strings.HasPrefix(name, "*.") || storage.IsIPAddressName(name) {
+		return "", false
+	}
+
+	idx := strings.IndexByte(name, '.')
+	if idx <= 0 || idx == len(name)-1 {
+		return "", false
+	}
+
+	// Don't allow a wildcard to match directly under a TLD.
+	parent := name[idx+1:]
+	if strings.IndexByte(parent, '.') < 0 {
+		return "", false
+	}
+
+	return "*." + parent, true
+}
+
+// Returns the DNS names and IP addresses listed on a certificate. IP addresses
+// are given in the same canonical form as in target names.
+func CertificateNames(cc *x509.Certificate) []string {
+	names := append([]string(nil), cc.DNSNames...)
+	for _, ip := range cc.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return names
+}
+
 func FindBestCertificateSatisfying(s storage.Store, t *storage.Target) (*storage.Certificate, error) {
 	var bestCert *storage.Certificate
 
@@ -149,6 +206,28 @@ func CertificateBetterThan(a, b *storage.Certificate) (bool, error) {
 		return false, nil
 	}
 
+	now := storage.InternalClock.Now()
+	aExpired, bExpired := !now.Before(ac.NotAfter), !now.Before(bc.NotAfter)
+	if aExpired != bExpired {
+		log.Tracef("certBetterThan: unexpired certificate is better than expired certificate")
+		return !aExpired, nil
+	}
+
+	// A certificate obtained via ACME after an external certificate was issued
+	// is preferred over it, so that an imported certificate is used only until
+	// it has been replaced. An older certificate obtained via ACME, which may be
+	// about to expire, does not shadow a newer external certificate.
+	if a.External != b.External {
+		acmeCert, externalCert := ac, bc
+		if a.External {
+			acmeCert, externalCert = bc, ac
+		}
+
+		acmeIsNewer := acmeCert.NotBefore.After(externalCert.NotBefore)
+		log.Tracef("certBetterThan: certificate obtained via ACME newer than external certificate=%v", acmeIsNewer)
+		return acmeIsNewer != a.External, nil
+	}
+
 	isAfter := ac.NotAfter.After(bc.NotAfter)
 	log.Tracef("certBetterThan: (%v > %v)=%v", ac.NotAfter, bc.NotAfter, isAfter)
 	return isAfter, nil
@@ -167,7 +246,7 @@ func CertificateNeedsRenewing(c *storage.Certificate, t *storage.Target) bool {
 	}
 
 	renewTime := renewTime(cc.NotBefore, cc.NotAfter, t)
-	needsRenewing := !InternalClock.Now().Before(renewTime)
+	needsRenewing := !storage.InternalClock.Now().Before(renewTime)
 
 	log.Debugf("%v needsRenewing=%v notAfter=%v", c, needsRenewing, cc.NotAfter)
 	return needsRenewing
@@ -198,7 +277,7 @@ func CertificateGenerallyValid(c *storage.Certificate) bool {
 		return false
 	}
 
-	if !InternalClock.Now().Before(cc.NotAfter) {
+	if !storage.InternalClock.Now().Before(cc.NotAfter) {
 		log.Debugf("%v not generally valid because it is expired", c)
 		return false
 	}
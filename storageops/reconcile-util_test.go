@@ -0,0 +1,63 @@
+package storageops
+
+import "testing"
+
+func TestNamesCover(t *testing.T) {
+	names := map[string]struct{}{
+		"example.com":   {},
+		"*.example.com": {},
+		"*.com":         {},
+		"192.0.2.1":     {},
+		"*.example.net": {},
+		"*.0.2.2":       {},
+	}
+
+	tests := []struct {
+		name   string
+		covers bool
+	}{
+		{"example.com", true},
+		{"foo.example.com", true},
+		// A wildcard does not match the apex.
+		{"example.net", false},
+		{"foo.example.net", true},
+		// A wildcard matches exactly one label.
+		{"bar.foo.example.com", false},
+		// A wildcard directly under a TLD matches nothing.
+		{"foo.com", false},
+		// IP addresses are only matched exactly.
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"*.example.com", true},
+		{"*.foo.example.com", false},
+	}
+
+	for _, tst := range tests {
+		if covers := namesCover(names, tst.name); covers != tst.covers {
+			t.Fatalf("namesCover(%q) = %v, expected %v", tst.name, covers, tst.covers)
+		}
+	}
+}
+
+func TestWildcardFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		wildcard string
+	}{
+		{"foo.example.com", "*.example.com"},
+		{"bar.foo.example.com", "*.foo.example.com"},
+		{"example.com", ""},
+		{"com", ""},
+		{"*.example.com", ""},
+		{"192.0.2.1", ""},
+		{"2001:db8::1", ""},
+		{".example.com", ""},
+	}
+
+	for _, tst := range tests {
+		wildcard, ok := wildcardFor(tst.name)
+		if ok != (tst.wildcard != "") || wildcard != tst.wildcard {
+			t.Fatalf("wildcardFor(%q) = %q, %v, expected %q", tst.name, wildcard, ok, tst.wildcard)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"errors"
 	"fmt"
 	"github.com/hlandau/acmetool/hooks"
 	"github.com/hlandau/acmetool/responder"
@@ -15,9 +16,9 @@ import (
 	"github.com/hlandau/acmetool/storage"
 	"github.com/hlandau/acmetool/util"
 	"github.com/hlandau/xlog"
-	"github.com/jmhodges/clock"
 	"gopkg.in/hlandau/acmeapi.v2"
 	"gopkg.in/hlandau/acmeapi.v2/acmeendpoints"
+	"net"
 	"net/http"
 	"path/filepath"
 	"sort"
@@ -27,9 +28,6 @@ import (
 
 var log, Log = xlog.New("acmetool.storageops")
 
-// Internal use only. Used for testing purposes. Do not change.
-var InternalClock = clock.Default()
-
 // Internal use only. Used for testing purposes. Do not change.
 var InternalHTTPClient *http.Client
 
@@ -37,8 +35,18 @@ var InternalHTTPClient *http.Client
 type ReconcileConfig struct {
 	// If non-empty, a set of target names/paths to limit reconciliation to.
 	// Essentially, the reconciliation engine acts as if only these targets
-	// exist. Otherwise all targets are used.
+	// exist. Otherwise all targets are used. A hostname selects the targets
+	// which have it as a name to be satisfied.
 	Targets []string
+
+	// If true, new certificates are requested for the selected targets even if
+	// their best certificates do not need renewing.
+	ForceRenewal bool
+
+	// If non-zero, new certificates are requested for the selected targets
+	// whose best certificates expire within this period, even if they do not
+	// otherwise need renewing yet.
+	RenewIfExpiringWithin time.Duration
 }
 
 type reconcile struct {
@@ -48,6 +56,18 @@ type reconcile struct {
 
 	// Cache of account clients to avoid duplicated directory lookups.
 	accountClients map[*storage.Account]*acmeapi.RealmClient
+
+	// Cache of clients which request a profile for new orders, by account and
+	// profile name.
+	profileClients map[profileClientKey]*acmeapi.RealmClient
+
+	// IDs of certificates whose OCSP responses have been updated since the
+	// ocsp-updated hooks were last invoked.
+	ocspUpdated map[string]struct{}
+
+	// Key types of the certificates obtained for each target in this
+	// reconciliation.
+	renewed map[*storage.Target]map[string]struct{}
 }
 
 func makeReconcile(store storage.Store, cfg ReconcileConfig) *reconcile {
@@ -55,6 +75,9 @@ func makeReconcile(store storage.Store, cfg ReconcileConfig) *reconcile {
 		store:          store,
 		cfg:            cfg,
 		accountClients: map[*storage.Account]*acmeapi.RealmClient{},
+		profileClients: map[profileClientKey]*acmeapi.RealmClient{},
+		ocspUpdated:    map[string]struct{}{},
+		renewed:        map[*storage.Target]map[string]struct{}{},
 	}
 }
 
@@ -102,10 +125,28 @@ func (r *reconcile) GetAccountURL() (string, error) {
 	return aapi.URL, nil
 }
 
-func Reconcile(store storage.Store, cfg ReconcileConfig) error {
+// Reconciles the state directory: downloads uncached certificates, processes
+// revocations and requests certificates for targets which need them, then
+// updates the live symlinks and OCSP responses.
+//
+// If ctx is cancelled or its deadline passes, requests in progress are
+// abandoned and no further certificates are requested, but challenges already
+// started are still cleaned up and the live symlinks are still updated to
+// reflect any certificates obtained.
+func Reconcile(ctx context.Context, store storage.Store, cfg ReconcileConfig) error {
+	// Without the default target, every target would lose the settings it
+	// inherits, such as its provider and key settings.
+	err := store.DefaultTargetError()
+	if err != nil {
+		return err
+	}
+
 	r := makeReconcile(store, cfg)
 
-	reconcileErr := r.Reconcile()
+	err = recordReconcileTime(store, storage.InternalClock.Now())
+	log.Errore(err, "failed to record reconciliation time")
+
+	reconcileErr := r.Reconcile(ctx)
 	log.Errore(reconcileErr, "failed to reconcile")
 
 	reloadErr := r.store.Reload()
@@ -114,7 +155,14 @@ func Reconcile(store storage.Store, cfg ReconcileConfig) error {
 	relinkErr := r.Relink()
 	log.Errore(relinkErr, "failed to relink after reconciliation")
 
-	err := reconcileErr
+	// Failure to obtain OCSP responses does not prevent certificates from
+	// being used, so it is not treated as a reconciliation failure.
+	if ctx.Err() == nil {
+		ocspErr := r.RefreshOCSP(ctx)
+		log.Errore(ocspErr, "failed to refresh OCSP responses after reconciliation")
+	}
+
+	err = reconcileErr
 	if err == nil {
 		err = reloadErr
 	}
@@ -122,9 +170,34 @@ func Reconcile(store storage.Store, cfg ReconcileConfig) error {
 		err = relinkErr
 	}
 
+	// Targets which could not be loaded have not been reconciled.
+	if loadErrs := TargetLoadErrors(r.store); err == nil && len(loadErrs) > 0 {
+		err = util.MultiError(loadErrs)
+	}
+
 	return err
 }
 
+// Returns an error for each target file which could not be loaded, ordered by
+// filename.
+func TargetLoadErrors(store storage.Store) []error {
+	targetErrs := store.TargetErrors()
+
+	var filenames []string
+	for filename := range targetErrs {
+		filenames = append(filenames, filename)
+	}
+
+	sort.Strings(filenames)
+
+	var errs []error
+	for _, filename := range filenames {
+		errs = append(errs, fmt.Errorf("cannot load target file desired/%s: %v", filename, targetErrs[filename]))
+	}
+
+	return errs
+}
+
 func Relink(store storage.Store) error {
 	err := makeReconcile(store, ReconcileConfig{}).Relink()
 	log.Errore(err, "failed to relink")
@@ -140,7 +213,11 @@ func (r *reconcile) Relink() error {
 	var updatedHostnames []string
 
 	for name, tgt := range hostnameTargetMapping {
-		c, err := FindBestCertificateSatisfying(r.store, tgt)
+		// For targets requesting multiple key types, the live symlink points to
+		// a certificate for the primary key type.
+		variants := tgt.KeyTypeVariants()
+
+		c, err := FindBestCertificateSatisfying(r.store, variants[0])
 		if err != nil {
 			log.Debugf("could not find certificate satisfying %v: %v", tgt, err)
 			continue
@@ -150,13 +227,22 @@ func (r *reconcile) Relink() error {
 
 		cprev, err := r.store.PreferredCertificateForHostname(name)
 
+		updated := false
 		if c != cprev || err != nil {
 			log.Debugf("relinking: %v -> %v (was %v)", name, c, cprev)
-			updatedHostnames = append(updatedHostnames, name)
+			updated = true
 
 			err = r.store.SetPreferredCertificateForHostname(name, c)
 			log.Errore(err, "failed to set preferred certificate for hostname")
 		}
+
+		if r.relinkKeyTypes(c, variants) {
+			updated = true
+		}
+
+		if updated {
+			updatedHostnames = append(updatedHostnames, name)
+		}
 	}
 
 	ctx := &hooks.Context{
@@ -169,6 +255,87 @@ func (r *reconcile) Relink() error {
 	return nil
 }
 
+// Returns the best certificate for each key type requested by each target to
+// which a hostname is linked by Relink. A target none of whose names are
+// linked to it, because targets with a higher priority or more names list all
+// of them, is omitted.
+func TargetCertificates(store storage.Store) (map[*storage.Target][]*storage.Certificate, error) {
+	hostnameTargetMapping, err := makeReconcile(store, ReconcileConfig{}).disjoinTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	targetCertificates := map[*storage.Target][]*storage.Certificate{}
+	for _, tgt := range hostnameTargetMapping {
+		if _, ok := targetCertificates[tgt]; ok {
+			continue
+		}
+
+		targetCertificates[tgt] = nil
+		for _, tv := range tgt.KeyTypeVariants() {
+			c, err := FindBestCertificateSatisfying(store, tv)
+			if err == nil {
+				targetCertificates[tgt] = append(targetCertificates[tgt], c)
+			}
+		}
+	}
+
+	return targetCertificates, nil
+}
+
+// Links the best certificate for each key type from the directory of the
+// certificate c, which is the preferred certificate for a target, if the
+// target requests multiple key types. Links for key types which the target
+// no longer requests are removed. Returns true if any link was changed.
+func (r *reconcile) relinkKeyTypes(c *storage.Certificate, variants []*storage.Target) (changed bool) {
+	requested := map[string]struct{}{}
+	if len(variants) > 1 {
+		for _, tv := range variants {
+			requested[tv.Request.Key.Type] = struct{}{}
+		}
+	}
+
+	for keyType := range c.KeyTypeCertificateIDs {
+		if _, ok := requested[keyType]; ok {
+			continue
+		}
+
+		log.Debugf("relinking: %v %s -> (none)", c, keyType)
+		err := r.store.RemoveCertificateForKeyType(c, keyType)
+		log.Errore(err, "failed to remove link for key type ", keyType)
+		if err == nil {
+			changed = true
+		}
+	}
+
+	if len(variants) < 2 {
+		return
+	}
+
+	for _, tv := range variants {
+		keyType := tv.Request.Key.Type
+
+		kc, err := FindBestCertificateSatisfying(r.store, tv)
+		if err != nil {
+			log.Debugf("could not find certificate satisfying %v for key type %q: %v", tv, keyType, err)
+			continue
+		}
+
+		if c.KeyTypeCertificateIDs[keyType] == kc.ID() {
+			continue
+		}
+
+		log.Debugf("relinking: %v %s -> %v", c, keyType, kc)
+		err = r.store.SetCertificateForKeyType(c, keyType, kc)
+		log.Errore(err, "failed to link certificate for key type ", keyType)
+		if err == nil {
+			changed = true
+		}
+	}
+
+	return
+}
+
 func (r *reconcile) disjoinTargets() (hostnameTargetMapping map[string]*storage.Target, err error) {
 	var targets []*storage.Target
 
@@ -183,14 +350,16 @@ func (r *reconcile) disjoinTargets() (hostnameTargetMapping map[string]*storage.
 	//
 	// N.B. The 'Reduced Names'/'Reduced Names By Label' data isn't actually used
 	// for anything currently, so we disable computation of it currently.
+	//
+	// Names are mapped to the targets listing them. A name covered by another
+	// target's wildcard name is still linked to a wildcard certificate where
+	// that is the best certificate, as certificates are matched against targets
+	// using wildcard matching.
 	hostnameTargetMapping = map[string]*storage.Target{}
 	for _, tgt := range targets {
 		//tgt.Satisfy.ReducedNamesByLabel = nil
 		for _, name := range tgt.Satisfy.Names {
-			key := name
-			if tgt.Label != "" {
-				key += ":" + tgt.Label
-			}
+			key := storage.LiveName(name, tgt.Label)
 			_, exists := hostnameTargetMapping[key]
 			if !exists {
 				hostnameTargetMapping[key] = tgt
@@ -211,16 +380,19 @@ func (r *reconcile) disjoinTargets() (hostnameTargetMapping map[string]*storage.
 	return
 }
 
-func (r *reconcile) Reconcile() error {
-	err := r.processUncachedCertificates()
+func (r *reconcile) Reconcile(ctx context.Context) error {
+	err := r.processUncachedCertificates(ctx)
 	if err != nil {
 		return err
 	}
 
-	//err = r.processPendingRevocations()
-	//log.Errore(err, "could not process pending revocations")
+	err = r.processPendingRevocations(ctx)
+	log.Errore(err, "could not process pending revocations")
+
+	err = r.processRevocationStatus(ctx)
+	log.Errore(err, "could not determine revocation status of certificates")
 
-	err = r.processTargets()
+	err = r.processTargets(ctx)
 	log.Errore(err, "error while processing targets")
 	if err != nil {
 		return err
@@ -229,14 +401,14 @@ func (r *reconcile) Reconcile() error {
 	return nil
 }
 
-func (r *reconcile) processUncachedCertificates() error {
+func (r *reconcile) processUncachedCertificates(ctx context.Context) error {
 	if !HaveUncachedCertificates(r.store) {
 		return nil
 	}
 
 	log.Debug("there are uncached certificates - downloading them")
 
-	err := r.downloadUncachedCertificates()
+	err := r.downloadUncachedCertificates(ctx)
 	if err != nil {
 		log.Errore(err, "error while downloading uncached certificates")
 		return err
@@ -259,14 +431,106 @@ func (r *reconcile) processUncachedCertificates() error {
 	return nil
 }
 
-func (r *reconcile) downloadUncachedCertificates() error {
+func (r *reconcile) processPendingRevocations(ctx context.Context) error {
+	var merr util.MultiError
+
+	r.store.VisitCertificates(func(c *storage.Certificate) error {
+		if c.Revoked || !c.RevocationDesired {
+			return nil
+		}
+
+		err := r.revokeCertificate(ctx, c)
+		if err != nil {
+			merr = append(merr, fmt.Errorf("failed to revoke %v: %v", c, err))
+		}
+
+		return nil
+	})
+
+	if len(merr) > 0 {
+		return merr
+	}
+
+	return nil
+}
+
+func (r *reconcile) revokeCertificate(ctx context.Context, c *storage.Certificate) error {
+	if c.External {
+		return fmt.Errorf("external certificates cannot be revoked via ACME")
+	}
+
+	if len(c.Certificates) == 0 {
+		return fmt.Errorf("certificate has not been downloaded")
+	}
+
+	if c.Account == nil && c.Key == nil {
+		return fmt.Errorf("neither the account which requested the certificate nor its private key is available")
+	}
+
+	acct := c.Account
+	if acct == nil {
+		// The request is signed with the certificate key, so any account for the
+		// provider which issued the certificate will do.
+		var err error
+		acct, err = r.getAccountByDirectoryURL(c.Provider)
+		if err != nil {
+			return err
+		}
+	}
+
+	cl, err := r.getClientForAccount(acct)
+	if err != nil {
+		return err
+	}
+
+	acctAPI := acct.ToAPI()
+	err = cl.LocateAccount(ctx, acctAPI)
+	if err != nil {
+		return err
+	}
+
+	// Sign the request using the certificate key where possible, as this
+	// works regardless of which account requested the certificate.
+	var revocationKey crypto.PrivateKey
+	if c.Key != nil {
+		revocationKey = c.Key.PrivateKey
+	}
+
+	log.Noticef("revoking %v (reason %d)", c, c.RevocationReason)
+	err = cl.Revoke(ctx, acctAPI, c.Certificates[0], revocationKey, c.RevocationReason)
+	if err != nil {
+		return err
+	}
+
+	c.Revoked = true
+	return r.store.SaveCertificate(c)
+}
+
+func (r *reconcile) downloadUncachedCertificates(ctx context.Context) error {
+	// It is not known which target the certificates were requested for, so
+	// the default target's settings are used and the certificates are not
+	// checked against a CSR.
+	t := r.store.DefaultTarget()
+	roots, err := loadTrustStore(t.Request.TrustStore)
+	if err != nil {
+		return err
+	}
+
 	return r.store.VisitCertificates(func(c *storage.Certificate) error {
 		if c.Cached {
 			return nil
 		}
 
-		err := r.downloadCertificateAdaptive(c)
+		err := r.downloadCertificateAdaptive(ctx, c, t, nil, roots)
 		if err != nil {
+			// A certificate which failed verification has been deleted, and
+			// must not hold up the others or the processing of targets.
+			var verr *verificationError
+			if errors.As(err, &verr) {
+				log.Errore(err, "uncached certificate failed verification and was deleted: ", c)
+				return nil
+			}
+
 			// If the download fails, consider whether the error is permanent or
 			// temporary. If temporary, don't hold up other certificates and continue
 			// for now. We'll try again when next invoked.
@@ -286,9 +550,10 @@ func (r *reconcile) downloadUncachedCertificates() error {
 	})
 }
 
-func (r *reconcile) getAccountByDirectoryURL(directoryURL string) (*storage.Account, error) {
+// Returns the directory URL to use if directoryURL is not specified.
+func (r *reconcile) resolveDirectoryURL(directoryURL string) (string, error) {
 	if directoryURL == "" {
-		directoryURL = r.store.DefaultTarget().Request.Provider
+		directoryURL = r.store.DefaultTarget().Request.ProviderURLs()[0]
 	}
 
 	if directoryURL == "" {
@@ -296,7 +561,16 @@ func (r *reconcile) getAccountByDirectoryURL(directoryURL string) (*storage.Acco
 	}
 
 	if !acmeapi.ValidURL(directoryURL) {
-		return nil, fmt.Errorf("directory URL is not a valid HTTPS URL")
+		return "", fmt.Errorf("directory URL is not a valid HTTPS URL")
+	}
+
+	return directoryURL, nil
+}
+
+func (r *reconcile) getAccountByDirectoryURL(directoryURL string) (*storage.Account, error) {
+	directoryURL, err := r.resolveDirectoryURL(directoryURL)
+	if err != nil {
+		return nil, err
 	}
 
 	ma := r.store.AccountByDirectoryURL(directoryURL)
@@ -304,10 +578,10 @@ func (r *reconcile) getAccountByDirectoryURL(directoryURL string) (*storage.Acco
 		return ma, nil
 	}
 
-	return r.createNewAccount(directoryURL)
+	return r.createNewAccount(directoryURL, "")
 }
 
-func (r *reconcile) createNewAccount(directoryURL string) (*storage.Account, error) {
+func (r *reconcile) createNewAccount(directoryURL, label string) (*storage.Account, error) {
 	pk, err := generateKey(&r.store.DefaultTarget().Request.Key)
 	if err != nil {
 		return nil, err
@@ -316,6 +590,7 @@ func (r *reconcile) createNewAccount(directoryURL string) (*storage.Account, err
 	a := &storage.Account{
 		PrivateKey:   pk,
 		DirectoryURL: directoryURL,
+		Label:        label,
 	}
 
 	err = r.store.SaveAccount(a)
@@ -331,16 +606,19 @@ func (r *reconcile) getGenericClient() (*acmeapi.RealmClient, error) {
 	return r.getClientForDirectoryURL("")
 }
 
-func (r *reconcile) getClientForDirectoryURL(directoryURL string) (*acmeapi.RealmClient, error) {
-	// Upgrade old directory URLs.
+// Upgrades old directory URLs.
+func currentDirectoryURL(directoryURL string) string {
 	endp, err := acmeendpoints.ByDirectoryURL(directoryURL)
 	if err == nil {
-		directoryURL = endp.DirectoryURL
+		return endp.DirectoryURL
 	}
 
-	// Create client.
+	return directoryURL
+}
+
+func (r *reconcile) getClientForDirectoryURL(directoryURL string) (*acmeapi.RealmClient, error) {
 	return acmeapi.NewRealmClient(acmeapi.RealmClientConfig{
-		DirectoryURL: directoryURL,
+		DirectoryURL: currentDirectoryURL(directoryURL),
 		HTTPClient:   InternalHTTPClient,
 	})
 }
@@ -360,37 +638,110 @@ func (r *reconcile) getClientForAccount(a *storage.Account) (*acmeapi.RealmClien
 	return cl, nil
 }
 
+type profileClientKey struct {
+	account *storage.Account
+	profile string
+}
+
+// Returns a client for the account which requests the given profile for new
+// orders, or the usual client for the account if profile is empty.
+func (r *reconcile) getProfileClientForAccount(a *storage.Account, profile string) (*acmeapi.RealmClient, error) {
+	if profile == "" {
+		return r.getClientForAccount(a)
+	}
+
+	k := profileClientKey{a, profile}
+	cl := r.profileClients[k]
+	if cl == nil {
+		p := &solver.Profile{
+			Name:         profile,
+			DirectoryURL: currentDirectoryURL(a.DirectoryURL),
+			HTTPClient:   InternalHTTPClient,
+		}
+
+		var err error
+		cl, err = p.NewRealmClient(a.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		r.profileClients[k] = cl
+	}
+
+	return cl, nil
+}
+
+// Returns true if a new certificate is to be requested to replace c even
+// though it does not need renewing, because of the ForceRenewal or
+// RenewIfExpiringWithin settings.
+func (r *reconcile) renewalForced(c *storage.Certificate) bool {
+	if r.cfg.ForceRenewal {
+		log.Debugf("%v: renewal forced", c)
+		return true
+	}
+
+	if r.cfg.RenewIfExpiringWithin <= 0 || len(c.Certificates) == 0 {
+		return false
+	}
+
+	cc, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return false
+	}
+
+	if cc.NotAfter.Sub(storage.InternalClock.Now()) >= r.cfg.RenewIfExpiringWithin {
+		return false
+	}
+
+	log.Debugf("%v: expires within %v, renewing", c, r.cfg.RenewIfExpiringWithin)
+	return true
+}
+
 func (r *reconcile) targetIsSelected(t *storage.Target) (selected bool, err error) {
 	if len(r.cfg.Targets) == 0 {
 		selected = true
 		return
 	}
 
+	// A target generated from a pack target is selected by the pack target.
+	filenames := []string{t.Filename}
+	if t.PackedFrom != "" {
+		filenames = append(filenames, t.PackedFrom)
+	}
+
 	for _, spec := range r.cfg.Targets {
-		// If the spec is just a one-component path ("foo"), treat it as a match on
-		// a name inside the "desired" directory.
-		if spec == t.Filename {
+		// A spec may also be a name to be satisfied by the target.
+		if name, nerr := storage.NormalizeName(spec); nerr == nil && containsName(t.Satisfy.Names, name) {
 			selected = true
 			return
 		}
 
-		// Get absolute path of target filename and absolute path of provided
-		// pathspec, interpreting it as a path, and see if they match.
-		var tgtFilename string
-		tgtFilename, err = filepath.Abs(filepath.Join(r.store.Path(), "desired", t.Filename))
-		if err != nil {
-			return
-		}
+		for _, filename := range filenames {
+			// If the spec is just a one-component path ("foo"), treat it as a match
+			// on a name inside the "desired" directory.
+			if spec == filename {
+				selected = true
+				return
+			}
 
-		var absSpec string
-		absSpec, err = filepath.Abs(spec)
-		if err != nil {
-			return
-		}
+			// Get absolute path of target filename and absolute path of provided
+			// pathspec, interpreting it as a path, and see if they match.
+			var tgtFilename string
+			tgtFilename, err = filepath.Abs(filepath.Join(r.store.Path(), "desired", filename))
+			if err != nil {
+				return
+			}
 
-		if absSpec == tgtFilename {
-			selected = true
-			return
+			var absSpec string
+			absSpec, err = filepath.Abs(spec)
+			if err != nil {
+				return
+			}
+
+			if absSpec == tgtFilename {
+				selected = true
+				return
+			}
 		}
 	}
 
@@ -398,25 +749,91 @@ func (r *reconcile) targetIsSelected(t *storage.Target) (selected bool, err erro
 	return
 }
 
-func (r *reconcile) processTargets() error {
+func (r *reconcile) processTargets(ctx context.Context) error {
 	var merr util.MultiError
 
+	// Targets in descending order of rank, for finding wildcard targets.
+	var rankedTargets []*storage.Target
+	r.store.VisitTargets(func(t *storage.Target) error {
+		rankedTargets = append(rankedTargets, t)
+		return nil
+	})
+
+	sort.Stable(sort.Reverse(targetSorter(rankedTargets)))
+
+	// Targets whose names are covered by the wildcard names of another target
+	// are processed last, so that the wildcard target has already been renewed
+	// if it needed to be.
+	var coveredTargets []*storage.Target
+	wildcardTargets := map[*storage.Target]*storage.Target{}
+
 	r.store.VisitTargets(func(t *storage.Target) error {
+		// Once cancelled, no further certificates are requested.
+		if err := ctx.Err(); err != nil {
+			merr = append(merr, err)
+			return err
+		}
+
 		selected, err := r.targetIsSelected(t)
 		if err != nil || !selected {
 			return err
 		}
 
-		c, err := FindBestCertificateSatisfying(r.store, t)
-		log.Debugf("%v: best certificate satisfying is %v, err=%v", t, c, err)
-		if err == nil && !CertificateNeedsRenewing(c, t) {
-			log.Debugf("%v: have best certificate which does not need renewing, skipping target", t)
-			return nil // continue
+		if wt := r.wildcardCoveringTarget(t, rankedTargets); wt != nil {
+			coveredTargets = append(coveredTargets, t)
+			wildcardTargets[t] = wt
+			return nil
+		}
+
+		merr = append(merr, r.processTarget(ctx, t, nil)...)
+		return nil
+	})
+
+	for _, t := range coveredTargets {
+		if err := ctx.Err(); err != nil {
+			merr = append(merr, err)
+			break
 		}
 
-		log.Debugf("%v: requesting certificate", t)
-		err = r.requestCertificateForTarget(t)
-		log.Errore(err, t, ": failed to request certificate")
+		merr = append(merr, r.processTarget(ctx, t, wildcardTargets[t])...)
+	}
+
+	log.Debugf("done processing targets, reconciliation complete, %d errors occurred", len(merr))
+
+	if len(merr) != 0 {
+		return merr
+	}
+
+	return nil
+}
+
+// Requests certificates for the target if it needs them. wt is the target
+// whose wildcard names cover the names of the target, if any. Returns the
+// errors which occurred.
+func (r *reconcile) processTarget(ctx context.Context, t, wt *storage.Target) (merr util.MultiError) {
+	// A target requesting multiple key types is satisfied separately for each
+	// key type.
+	for _, tv := range t.KeyTypeVariants() {
+		c, err := FindBestCertificateSatisfying(r.store, tv)
+		log.Debugf("%v: best certificate satisfying (key type %q) is %v, err=%v", tv, tv.Satisfy.Key.Type, c, err)
+		if err == nil && !CertificateNeedsRenewing(c, tv) && !r.renewalForced(c) {
+			log.Debugf("%v: have best certificate which does not need renewing, skipping", tv)
+			err = r.ensureNextKey(c, tv)
+			log.Errore(err, tv, ": failed to pregenerate next key")
+			continue
+		}
+
+		// If the names are covered by a wildcard certificate of another target
+		// which will serve in place of a certificate for this target, there is no
+		// need to request another certificate for them, unless renewal is forced.
+		if err == nil && wt != nil && !r.renewalForced(c) && r.wildcardSatisfies(wt, tv) {
+			log.Debugf("%v: best certificate needs renewing, but names are covered by a certificate of wildcard target %v, skipping", tv, wt)
+			continue
+		}
+
+		log.Debugf("%v: requesting certificate", tv)
+		err = r.requestCertificateForTarget(ctx, tv)
+		log.Errore(err, tv, ": failed to request certificate")
 		if err != nil {
 			// Do not block satisfaction of other targets just because one fails;
 			// collect errors and return them as one.
@@ -424,25 +841,123 @@ func (r *reconcile) processTargets() error {
 				Target: t,
 				Err:    err,
 			})
+			continue
 		}
 
-		return nil
-	})
+		r.recordRenewed(t, tv.Request.Key.Type)
+	}
 
-	log.Debugf("done processing targets, reconciliation complete, %d errors occurred", len(merr))
+	return
+}
 
-	if len(merr) != 0 {
-		return merr
+// Returns another target being reconciled whose wildcard names cover all of
+// the names of target t, if there is one. Where there are several, the
+// highest-ranked is returned. rankedTargets contains all targets in
+// descending order of rank.
+func (r *reconcile) wildcardCoveringTarget(t *storage.Target, rankedTargets []*storage.Target) *storage.Target {
+	for _, wt := range rankedTargets {
+		if wt == t || wt.Label != t.Label || !targetWildcardsCover(wt, t) {
+			continue
+		}
+
+		selected, err := r.targetIsSelected(wt)
+		if err != nil || !selected {
+			continue
+		}
+
+		return wt
 	}
 
 	return nil
 }
 
+// Returns true iff every name of target t is matched by a wildcard name of
+// target wt.
+func targetWildcardsCover(wt, t *storage.Target) bool {
+	for _, name := range t.Satisfy.Names {
+		wildcard, ok := wildcardFor(name)
+		if !ok || !containsName(wt.Satisfy.Names, wildcard) {
+			return false
+		}
+	}
+
+	return len(t.Satisfy.Names) > 0
+}
+
+// Returns true iff the wildcard target wt has a certificate which can serve in
+// place of a certificate for the target variant tv: one which satisfies tv and
+// does not need renewing, or one obtained earlier in this reconciliation. The
+// certificate must have been requested with the settings which tv would use.
+func (r *reconcile) wildcardSatisfies(wt, tv *storage.Target) bool {
+	for _, wtv := range wt.KeyTypeVariants() {
+		if !requestsEquivalent(&wtv.Request, &tv.Request) {
+			continue
+		}
+
+		if r.wasRenewed(wt, wtv.Request.Key.Type) {
+			return true
+		}
+
+		wc, err := FindBestCertificateSatisfying(r.store, wtv)
+		if err == nil && !CertificateNeedsRenewing(wc, wtv) && DoesCertificateSatisfy(wc, tv) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true iff certificates requested with the given settings are
+// interchangeable, apart from the names requested.
+func requestsEquivalent(a, b *storage.TargetRequest) bool {
+	return stringsEqual(a.ProviderURLs(), b.ProviderURLs()) &&
+		a.AccountName == b.AccountName &&
+		a.Account == b.Account &&
+		a.Key.Type == b.Key.Type &&
+		a.OCSPMustStaple == b.OCSPMustStaple &&
+		a.Profile == b.Profile
+}
+
+func stringsEqual(xs, ys []string) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Records that a certificate of the given key type was obtained for target t
+// in this reconciliation.
+func (r *reconcile) recordRenewed(t *storage.Target, keyType string) {
+	if r.renewed[t] == nil {
+		r.renewed[t] = map[string]struct{}{}
+	}
+
+	r.renewed[t][keyType] = struct{}{}
+}
+
+// Returns true iff a certificate of the given key type was obtained for
+// target t in this reconciliation.
+func (r *reconcile) wasRenewed(t *storage.Target, keyType string) bool {
+	_, ok := r.renewed[t][keyType]
+	return ok
+}
+
 func (r *reconcile) getRequestAccount(tr *storage.TargetRequest) (*storage.Account, error) {
 	if tr.Account != nil {
 		return tr.Account, nil
 	}
 
+	if tr.AccountName != "" {
+		return r.getAccountByName(tr.AccountName, tr.Provider)
+	}
+
 	// This will create the account if it doesn't exist.
 	acct, err := r.getAccountByDirectoryURL(tr.Provider)
 	if err != nil {
@@ -452,57 +967,207 @@ func (r *reconcile) getRequestAccount(tr *storage.TargetRequest) (*storage.Accou
 	return acct, nil
 }
 
-func (r *reconcile) requestCertificateForTarget(t *storage.Target) error {
+// Finds the account for the provider with the given label or, failing that,
+// the account with the given ID. If no provider is given, the account with the
+// label for the default provider is preferred, but an account with the label
+// for any provider is used. If there is no such account, an account with the
+// given label is created for the provider.
+func (r *reconcile) getAccountByName(name, directoryURL string) (*storage.Account, error) {
+	resolvedURL, err := r.resolveDirectoryURL(directoryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	a := r.store.AccountByLabel(name, resolvedURL)
+	if a == nil && directoryURL == "" {
+		a = r.store.AccountByLabel(name, "")
+	}
+	if a == nil {
+		a = r.store.AccountByID(name)
+	}
+
+	if a != nil {
+		if directoryURL != "" && !a.MatchesURL(directoryURL) {
+			return nil, fmt.Errorf("account %q is for provider %q, not %q", name, a.DirectoryURL, directoryURL)
+		}
+
+		return a, nil
+	}
+
+	directoryURL = resolvedURL
+
+	log.Noticef("creating new account %q for %q", name, directoryURL)
+	return r.createNewAccount(directoryURL, name)
+}
+
+// Returns the label of the account to use for a fallback provider of a target.
+// An account is for a single provider, so the account the target specifies
+// cannot be used, but its label selects the corresponding account for the
+// fallback provider. If the target's account is unlabelled, returns "", and
+// the unlabelled account for the provider is used.
+func (r *reconcile) fallbackAccountLabel(tr *storage.TargetRequest) string {
+	if tr.Account != nil {
+		return tr.Account.Label
+	}
+
+	if a := r.store.AccountByID(tr.AccountName); a != nil {
+		return a.Label
+	}
+
+	return tr.AccountName
+}
+
+func (r *reconcile) requestCertificateForTarget(ctx context.Context, t *storage.Target) error {
 	ensureConceivablySatisfiable(t)
 
-	acct, err := r.getRequestAccount(&t.Request)
+	// A misconfigured trust store would cause every certificate ordered to
+	// fail verification, so it is checked before ordering.
+	roots, err := loadTrustStore(t.Request.TrustStore)
 	if err != nil {
 		return err
 	}
 
-	cl, err := r.getClientForAccount(acct)
+	csr, err := r.createCSR(t)
 	if err != nil {
 		return err
 	}
 
-	apiAcct := acct.ToAPI()
+	var acct *storage.Account
+	var order *acmeapi.Order
+	providers := t.Request.ProviderURLs()
+	for i, directoryURL := range providers {
+		acct, order, err = r.orderFromProvider(ctx, t, directoryURL, i == 0, csr)
+		if err == nil {
+			break
+		}
+
+		// A network error may be the result of cancellation, which should not
+		// cause the next provider to be tried.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if i == len(providers)-1 || !isFailoverError(err) {
+			return err
+		}
 
-	err = solver.AssistedRegistration(context.TODO(), cl, apiAcct, nil)
+		log.Warnf("%v: request to provider %q failed, trying %q: %v", t, directoryURL, providers[i+1], err)
+	}
+
+	c, err := r.store.ImportCertificate(acct, order.URL)
 	if err != nil {
+		log.Errore(err, "could not import certificate")
 		return err
 	}
 
-	csr, err := r.createCSR(t)
+	csrInfo, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return err
+	}
+
+	err = r.downloadCertificateAdaptive(ctx, c, t, csrInfo, roots)
 	if err != nil {
 		return err
 	}
 
+	err = r.ensureNextKey(c, t)
+	log.Errore(err, t, ": failed to pregenerate next key")
+
+	return nil
+}
+
+// Orders a certificate for the target from the given provider, returning the
+// account used and the finalized order. The account specified by the target
+// is only used for its primary provider; for other providers, the account for
+// the provider with the same label is used, and is created and registered if
+// necessary.
+func (r *reconcile) orderFromProvider(ctx context.Context, t *storage.Target, directoryURL string, primary bool, csr []byte) (*storage.Account, *acmeapi.Order, error) {
+	tr := t.Request
+	tr.Provider = directoryURL
+	if !primary {
+		tr.Account = nil
+		tr.AccountName = r.fallbackAccountLabel(&t.Request)
+	}
+
+	acct, err := r.getRequestAccount(&tr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cl, err := r.getProfileClientForAccount(acct, t.Request.Profile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	apiAcct := acct.ToAPI()
+
+	err = solver.AssistedRegistration(ctx, cl, apiAcct, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	orderTpl := acmeapi.Order{}
 	for _, name := range t.Request.Names {
-		orderTpl.Identifiers = append(orderTpl.Identifiers, acmeapi.Identifier{
+		identifier := acmeapi.Identifier{
 			Type:  acmeapi.IdentifierTypeDNS,
 			Value: name,
-		})
+		}
+		if storage.IsIPAddressName(name) {
+			identifier.Type = solver.IdentifierTypeIP
+		}
+
+		orderTpl.Identifiers = append(orderTpl.Identifiers, identifier)
 	}
 
-	log.Debugf("%v: ordering certificate", t)
-	order, err := solver.Order(context.TODO(), cl, apiAcct, &orderTpl, csr, r.targetToChallengeConfig(t))
+	log.Debugf("%v: ordering certificate from %q", t, acct.DirectoryURL)
+	order, err := solver.Order(ctx, cl, apiAcct, &orderTpl, csr, r.targetToChallengeConfig(t))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	c, err := r.store.ImportCertificate(acct, order.URL)
-	if err != nil {
-		log.Errore(err, "could not import certificate")
-		return err
+	return acct, order, nil
+}
+
+// Returns true if a request which failed with the given error should be
+// retried with the next provider: if the provider failed with a server error
+// or rate limited the request, or could not be reached. Errors due to the
+// request itself, such as failed validation, are not retried, as another
+// provider would fail in the same way. Wrapped errors are classified by the
+// error they wrap.
+//
+// Cancellation surfaces as a network error but is not a failure of the
+// provider. Callers must check the context too, as a request which exceeded
+// the deadline of the context cannot be told apart from one which timed out.
+func isFailoverError(err error) bool {
+	var merr util.MultiError
+	if errors.As(err, &merr) {
+		for _, sub := range merr {
+			if !isFailoverError(sub) {
+				return false
+			}
+		}
+
+		return len(merr) > 0
 	}
 
-	err = r.downloadCertificateAdaptive(c)
-	if err != nil {
-		return err
+	if errors.Is(err, context.Canceled) {
+		return false
 	}
 
-	return nil
+	var he *acmeapi.HTTPError
+	if errors.As(err, &he) {
+		if he.Problem != nil {
+			switch he.Problem.Type {
+			case "urn:ietf:params:acme:error:serverInternal", "urn:ietf:params:acme:error:rateLimited":
+				return true
+			}
+		}
+
+		return he.Res != nil && (he.Res.StatusCode >= 500 || he.Res.StatusCode == http.StatusTooManyRequests)
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
 }
 
 func (r *reconcile) targetToChallengeConfig(t *storage.Target) *responder.ChallengeConfig {
@@ -518,7 +1183,15 @@ func (r *reconcile) targetToChallengeConfig(t *storage.Target) *responder.Challe
 		hctx.Env[k] = v
 	}
 
-	startHookFunc := func(challengeInfo interface{}) error {
+	// Hooks are killed if the context passed by the responder is done.
+	hookContext := func(ctx context.Context) *hooks.Context {
+		hc := *hctx
+		hc.Ctx = ctx
+		return &hc
+	}
+
+	startHookFunc := func(ctx context.Context, challengeInfo interface{}) error {
+		hctx := hookContext(ctx)
 		switch v := challengeInfo.(type) {
 		case *responder.HTTPChallengeInfo:
 			_, err := hooks.ChallengeHTTPStart(hctx, v.Hostname, t.Filename, v.Filename, v.Body)
@@ -534,7 +1207,8 @@ func (r *reconcile) targetToChallengeConfig(t *storage.Target) *responder.Challe
 		}
 	}
 
-	stopHookFunc := func(challengeInfo interface{}) error {
+	stopHookFunc := func(ctx context.Context, challengeInfo interface{}) error {
+		hctx := hookContext(ctx)
 		switch v := challengeInfo.(type) {
 		case *responder.HTTPChallengeInfo:
 			return hooks.ChallengeHTTPStop(hctx, v.Hostname, t.Filename, v.Filename, v.Body)
@@ -573,11 +1247,20 @@ func (r *reconcile) createCSR(t *storage.Target) ([]byte, error) {
 		return nil, fmt.Errorf("cannot request a certificate with no names")
 	}
 
-	csr := &x509.CertificateRequest{
-		DNSNames: t.Request.Names,
-		Subject: pkix.Name{
-			CommonName: t.Request.Names[0],
-		},
+	csr := &x509.CertificateRequest{}
+	for _, name := range t.Request.Names {
+		if ip := net.ParseIP(name); ip != nil {
+			csr.IPAddresses = append(csr.IPAddresses, ip)
+		} else {
+			csr.DNSNames = append(csr.DNSNames, name)
+		}
+	}
+
+	// IP addresses are not placed in the common name.
+	if len(csr.DNSNames) > 0 {
+		csr.Subject = pkix.Name{
+			CommonName: csr.DNSNames[0],
+		}
 	}
 
 	if t.Request.OCSPMustStaple {
@@ -587,7 +1270,7 @@ func (r *reconcile) createCSR(t *storage.Target) ([]byte, error) {
 		})
 	}
 
-	pk, err := r.generateOrGetKey(&t.Request.Key)
+	pk, err := r.determineKey(t)
 	if err != nil {
 		log.Errore(err, "could not generate key while generating CSR for", t)
 		return nil, err
@@ -607,9 +1290,94 @@ func (r *reconcile) createCSR(t *storage.Target) ([]byte, error) {
 	return x509.CreateCertificateRequest(rand.Reader, csr, pk)
 }
 
+// Determines the key to use when requesting a certificate for a target. A key
+// specified by ID takes precedence. Otherwise, the key of the previous
+// certificate for the target is reused unless the rotation policy says it is
+// due for replacement, in which case the pregenerated next key is used if there
+// is one.
+func (r *reconcile) determineKey(t *storage.Target) (crypto.PrivateKey, error) {
+	trk := &t.Request.Key
+	if trk.ID != "" {
+		return r.generateOrGetKey(trk)
+	}
+
+	prev, err := FindBestCertificateSatisfying(r.store, t)
+	if err != nil {
+		return generateKey(trk)
+	}
+
+	age := storage.InternalClock.Now().Sub(keyInServiceSince(r.store, prev.Key))
+	if !trk.Rotate.ShouldRotate(age) && keyMatchesRequest(prev.Key, trk) {
+		log.Debugf("%v: reusing key %v of previous certificate %v (key age %v)", t, prev.Key, prev, age)
+		return prev.Key.PrivateKey, nil
+	}
+
+	if prev.NextKey != nil && !prev.NextKey.Compromised && keyMatchesRequest(prev.NextKey, trk) {
+		log.Debugf("%v: using pregenerated key %v of previous certificate %v", t, prev.NextKey, prev)
+		return prev.NextKey.PrivateKey, nil
+	}
+
+	return generateKey(trk)
+}
+
+// Returns the time from which the age of a key is measured by the rotation
+// policy: the time it was first used in a certificate, so that a pregenerated
+// key does not age while it waits to be used. A key not used in any
+// certificate is aged from its creation.
+func keyInServiceSince(s storage.Store, k *storage.Key) time.Time {
+	var since time.Time
+	for _, c := range CertificatesUsingKey(s, k) {
+		if len(c.Certificates) == 0 {
+			continue
+		}
+
+		cc, err := x509.ParseCertificate(c.Certificates[0])
+		if err != nil {
+			continue
+		}
+
+		if since.IsZero() || cc.NotBefore.Before(since) {
+			since = cc.NotBefore
+		}
+	}
+
+	if since.IsZero() {
+		return k.Created
+	}
+
+	return since
+}
+
+// Generates the next key for a certificate satisfying the target, if the
+// target asks for it to be pregenerated and it does not exist yet.
+func (r *reconcile) ensureNextKey(c *storage.Certificate, t *storage.Target) error {
+	if !t.Request.Key.PregenerateNext || c.NextKey != nil {
+		return nil
+	}
+
+	pk, err := generateKey(&t.Request.Key)
+	if err != nil {
+		return err
+	}
+
+	k, err := r.store.ImportKey(pk)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("%v: pregenerated next key %v for %v", t, k, c)
+	return r.store.SetNextKey(c, k)
+}
+
 func (r *reconcile) generateOrGetKey(trk *storage.TargetRequestKey) (crypto.PrivateKey, error) {
 	if trk.ID != "" {
-		k := r.store.KeyByID(strings.TrimSpace(strings.ToLower(trk.ID)))
+		keyID := strings.TrimSpace(strings.ToLower(trk.ID))
+		if r.store.IsKeyCompromised(keyID) {
+			log.Warnf("target requests specific key %q but it has been marked as compromised, generating a new key", trk.ID)
+			return generateKey(trk)
+		}
+
+		k := r.store.KeyByID(keyID)
 		if k != nil {
 			return k.PrivateKey, nil
 		}
@@ -620,7 +1388,14 @@ func (r *reconcile) generateOrGetKey(trk *storage.TargetRequestKey) (crypto.Priv
 	return generateKey(trk)
 }
 
-func (r *reconcile) downloadCertificateAdaptive(c *storage.Certificate) error {
+// Downloads a certificate and the chains offered for it, selecting the chain
+// preferred by target t. The certificate is verified before it is saved; csr,
+// if known, is the CSR used to request it, and roots are the roots loaded from
+// the trust store of t. If verification fails, the certificate is deleted and
+// a permanent *verificationError is returned. The certificate is not kept for
+// a later download, as the target which requested it is not recorded, so it
+// could not be verified against that target's trust store again.
+func (r *reconcile) downloadCertificateAdaptive(ctx context.Context, c *storage.Certificate, t *storage.Target, csr *x509.CertificateRequest, roots *x509.CertPool) error {
 	log.Debugf("downloading certificate %v", c)
 
 	if c.Account == nil {
@@ -634,7 +1409,7 @@ func (r *reconcile) downloadCertificateAdaptive(c *storage.Certificate) error {
 
 	acctAPI := c.Account.ToAPI()
 	if acctAPI.URL == "" {
-		err = cl.LocateAccount(context.TODO(), acctAPI)
+		err = cl.LocateAccount(ctx, acctAPI)
 		if err != nil {
 			return err
 		}
@@ -642,7 +1417,7 @@ func (r *reconcile) downloadCertificateAdaptive(c *storage.Certificate) error {
 
 	order := &acmeapi.Order{}
 	cert := &acmeapi.Certificate{}
-	isCert, err := cl.LoadOrderOrCertificate(context.TODO(), c.URL, acctAPI, order, cert)
+	isCert, err := cl.LoadOrderOrCertificate(ctx, c.URL, acctAPI, order, cert)
 	if err != nil {
 		return err
 	}
@@ -666,7 +1441,7 @@ func (r *reconcile) downloadCertificateAdaptive(c *storage.Certificate) error {
 				return err
 			}
 
-			err = cl.WaitLoadOrder(context.TODO(), acctAPI, order)
+			err = cl.WaitLoadOrder(ctx, acctAPI, order)
 			if err != nil {
 				return err
 			}
@@ -685,7 +1460,7 @@ func (r *reconcile) downloadCertificateAdaptive(c *storage.Certificate) error {
 			URL: order.CertificateURL,
 		}
 
-		err = cl.LoadCertificate(context.TODO(), acctAPI, cert)
+		err = cl.LoadCertificate(ctx, acctAPI, cert)
 		if err != nil {
 			return err
 		}
@@ -697,6 +1472,32 @@ func (r *reconcile) downloadCertificateAdaptive(c *storage.Certificate) error {
 	}
 
 	c.Certificates = cert.CertificateChain
+	c.CertificateURL = cert.URL
+	c.Chains = loadCertificateChains(ctx, cl, acctAPI, cert)
+	if len(c.Chains) > 1 {
+		c.Certificates = selectCertificateChain(cert.CertificateChain[0], c.Chains, t.Request.PreferredChain)
+	}
+
+	key := c.Key
+	if key == nil {
+		key = r.keyForCertificate(c.Certificates[0])
+	}
+
+	chain, err := parseCertificateChain(c.Certificates)
+	if err == nil {
+		err = verifyCertificateMatch(chain[0], csr, key)
+	}
+	if err == nil {
+		err = verifyCertificateChain(chain, roots)
+	}
+	if err != nil {
+		log.Errore(err, "certificate failed verification, deleting it: ", c)
+		c.Certificates, c.Chains = nil, nil
+		err2 := r.store.RemoveCertificate(c.ID())
+		log.Errore(err2, "failed to delete certificate which failed verification: ", c)
+		return util.NewPertError(false, &verificationError{err})
+	}
+
 	c.Cached = true
 
 	err = r.store.SaveCertificate(c)
@@ -708,4 +1509,29 @@ func (r *reconcile) downloadCertificateAdaptive(c *storage.Certificate) error {
 	return nil
 }
 
+// Returned when a downloaded certificate fails verification.
+type verificationError struct {
+	err error
+}
+
+func (e *verificationError) Error() string {
+	return fmt.Sprintf("certificate failed verification: %v", e.err)
+}
+
+// Returns the stored key used by the given end certificate, or nil if there
+// is none.
+func (r *reconcile) keyForCertificate(der []byte) *storage.Key {
+	cc, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil
+	}
+
+	keyID, err := storage.DetermineKeyIDFromPublicKey(cc.PublicKey)
+	if err != nil {
+		return nil
+	}
+
+	return r.store.KeyByID(keyID)
+}
+
 // todo change solver.Order to not wait for finalisation
@@ -0,0 +1,477 @@
+package storageops
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/hlandau/acmetool/acmetest"
+	"github.com/hlandau/acmetool/hooks"
+	"github.com/hlandau/acmetool/interaction"
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/util"
+	"gopkg.in/hlandau/acmeapi.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the first names of the targets for which certificate requests
+// failed, as reported by processTargets.
+func failedTargets(t *testing.T, err error) map[string]bool {
+	failed := map[string]bool{}
+	if err == nil {
+		return failed
+	}
+
+	merr, ok := err.(util.MultiError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, e := range merr {
+		tse, ok := e.(*TargetSpecificError)
+		if !ok {
+			t.Fatalf("unexpected error: %v", e)
+		}
+
+		failed[tse.Target.Satisfy.Names[0]] = true
+	}
+
+	return failed
+}
+
+// A target whose names are covered by a wildcard target is only left alone if
+// the wildcard target has a certificate which can be used in its place.
+func TestProcessTargetsWildcard(t *testing.T) {
+	// Every request to the provider fails, so the targets for which
+	// certificates are requested are those which fail.
+	srv := httptest.NewTLSServer(http.HandlerFunc(http.NotFound))
+	defer srv.Close()
+
+	httpClient := InternalHTTPClient
+	InternalHTTPClient = srv.Client()
+	defer func() { InternalHTTPClient = httpClient }()
+
+	now := time.Now()
+	tests := []struct {
+		// Validity period of the certificate of the wildcard target.
+		notBefore, notAfter time.Time
+		forced              bool
+		profile             string
+		failed              []string
+	}{
+		// The wildcard certificate needs renewing for the covered target, which
+		// has the default margin, but not for the wildcard target.
+		{notBefore: now.Add(-16 * 24 * time.Hour), notAfter: now.Add(5 * 24 * time.Hour)},
+		// The wildcard certificate was not requested with the profile of the
+		// covered target.
+		{notBefore: now.Add(-16 * 24 * time.Hour), notAfter: now.Add(5 * 24 * time.Hour), profile: "shortlived", failed: []string{"foo.example.com"}},
+		// Renewal of the covered target is forced.
+		{notBefore: now.Add(-16 * 24 * time.Hour), notAfter: now.Add(5 * 24 * time.Hour), forced: true, failed: []string{"*.example.com", "foo.example.com"}},
+		// Renewal of the wildcard target fails.
+		{notBefore: now.Add(-60 * 24 * time.Hour), notAfter: now.Add(24 * time.Hour), failed: []string{"*.example.com", "foo.example.com"}},
+	}
+
+	for i, test := range tests {
+		s, cleanup := newTestStore(t)
+		defer cleanup()
+
+		s.DefaultTarget().Request.Provider = srv.URL + "/directory"
+		s.DefaultTarget().Request.Key.Type = "ecdsa"
+		err := s.SaveTarget(s.DefaultTarget())
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		wt := &storage.Target{}
+		wt.Satisfy.Names = []string{"*.example.com"}
+		wt.Satisfy.Margin = 1
+		err = s.SaveTarget(wt)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		tgt := &storage.Target{}
+		tgt.Satisfy.Names = []string{"foo.example.com"}
+		tgt.Request.Profile = test.profile
+		err = s.SaveTarget(tgt)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		ca := newTestCA(t, "CA", nil, nil)
+		key := newTestKey(t)
+		storeTestCertificate(t, s, ca, key, newTestCertificateValidFor(t, ca, key, wt.Satisfy.Names, false, test.notBefore, test.notAfter))
+
+		r := makeReconcile(s, ReconcileConfig{ForceRenewal: test.forced})
+		failed := failedTargets(t, r.processTargets(context.Background()))
+		if len(failed) != len(test.failed) {
+			t.Fatalf("%d: certificates requested for %v, expected %v", i, failed, test.failed)
+		}
+
+		for _, name := range test.failed {
+			if !failed[name] {
+				t.Fatalf("%d: certificates requested for %v, expected %v", i, failed, test.failed)
+			}
+		}
+	}
+}
+
+// Reconciliation fails if a target file cannot be loaded, as the target is not
+// being renewed.
+func TestReconcileTargetLoadError(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	err := ioutil.WriteFile(filepath.Join(s.Path(), "desired", "example.com"), []byte("satisfy:\n  names:\n    - example.com\nobsolete: true\n"), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = Reconcile(context.Background(), s, ReconcileConfig{})
+	if err == nil || !strings.Contains(err.Error(), "desired/example.com") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Agrees to the terms of service and declines to give an e. mail address when
+// accounts are registered.
+type testInterceptor struct{}
+
+func (testInterceptor) Prompt(c *interaction.Challenge) (*interaction.Response, error) {
+	if c.UniqueID == "acme-enter-email" || strings.HasPrefix(c.UniqueID, "acme-agreement:") {
+		return &interaction.Response{}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported challenge for interceptor: %v", c)
+}
+
+func (testInterceptor) Status(info *interaction.StatusInfo) (interaction.StatusSink, error) {
+	return nil, fmt.Errorf("status not supported")
+}
+
+// Writes the certificate of the CA of srv to a trust store file in the state
+// directory and returns its path.
+func writeTestTrustStore(t *testing.T, s storage.Store, srv *acmetest.Server, filename string) string {
+	fn := filepath.Join(s.Path(), filename)
+	err := ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.CACertificate().Raw}), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return fn
+}
+
+// Returns the ID of the preferred certificate for a hostname, or "" if there
+// is none.
+func preferredCertificateID(s storage.Store, hostname string) string {
+	c, err := s.PreferredCertificateForHostname(hostname)
+	if err != nil {
+		return ""
+	}
+
+	return c.ID()
+}
+
+// An uncached certificate whose chain fails verification is deleted, without
+// preventing other uncached certificates from being downloaded or other
+// targets from being renewed.
+func TestReconcileUncachedVerificationFailure(t *testing.T) {
+	var servers []*acmetest.Server
+	for i := 0; i < 2; i++ {
+		srv, err := acmetest.New(acmetest.Config{SkipValidation: true})
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		defer srv.Close()
+
+		servers = append(servers, srv)
+	}
+
+	// The test servers share a TLS certificate, so a client of either trusts
+	// both.
+	defer func(httpClient *http.Client, interceptor interaction.Interactor, hookPaths []string) {
+		InternalHTTPClient, interaction.Interceptor, hooks.DefaultPaths = httpClient, interceptor, hookPaths
+	}(InternalHTTPClient, interaction.Interceptor, hooks.DefaultPaths)
+	InternalHTTPClient = servers[0].HTTPClient()
+	interaction.Interceptor = testInterceptor{}
+	hooks.DefaultPaths = nil
+
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// The challenges are not validated, so no responder is needed.
+	selfTest := false
+	dt := s.DefaultTarget()
+	dt.Request.Provider = servers[0].DirectoryURL()
+	dt.Request.Key.Type = "ecdsa"
+	dt.Request.TrustStore = writeTestTrustStore(t, s, servers[0], "ca0.pem")
+	dt.Request.Challenge.HTTPSelfTest = &selfTest
+	err := s.SaveTarget(dt)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// Only the target for b.example.com trusts the second server.
+	for i, name := range []string{"a.example.com", "b.example.com"} {
+		tgt := &storage.Target{}
+		tgt.Satisfy.Names = []string{name}
+		if i == 1 {
+			tgt.Request.Provider = servers[1].DirectoryURL()
+			tgt.Request.TrustStore = writeTestTrustStore(t, s, servers[1], "ca1.pem")
+		}
+
+		err = s.SaveTarget(tgt)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = Reconcile(context.Background(), s, ReconcileConfig{})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	certA, certB := preferredCertificateID(s, "a.example.com"), preferredCertificateID(s, "b.example.com")
+	if certA == "" || certB == "" {
+		t.Fatalf("certificates not obtained: %q, %q", certA, certB)
+	}
+
+	// Discard the downloaded certificates, so that they are downloaded again
+	// and verified against the trust store of the default target, which only
+	// the certificate for a.example.com satisfies.
+	for _, id := range []string{certA, certB} {
+		for _, name := range []string{"cert", "chain", "fullchain"} {
+			err = os.Remove(filepath.Join(s.Path(), "certs", id, name))
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+		}
+	}
+
+	tgt := &storage.Target{}
+	tgt.Satisfy.Names = []string{"c.example.com"}
+	err = s.SaveTarget(tgt)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !HaveUncachedCertificates(s) {
+		t.Fatalf("certificates not uncached")
+	}
+
+	err = Reconcile(context.Background(), s, ReconcileConfig{})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if c := s.CertificateByID(certA); c == nil || !c.Cached || preferredCertificateID(s, "a.example.com") != certA {
+		t.Fatalf("uncached certificate not downloaded: %v", c)
+	}
+
+	if s.CertificateByID(certB) != nil {
+		t.Fatalf("certificate which failed verification not deleted")
+	}
+
+	// The target whose certificate was deleted obtains another, and the new
+	// target is satisfied.
+	if id := preferredCertificateID(s, "b.example.com"); id == "" || id == certB {
+		t.Fatalf("certificate not replaced: %q", id)
+	}
+
+	if preferredCertificateID(s, "c.example.com") == "" {
+		t.Fatalf("certificate not obtained for new target")
+	}
+}
+
+func TestIsFailoverError(t *testing.T) {
+	httpError := func(status int, problemType string) error {
+		he := &acmeapi.HTTPError{Res: &http.Response{StatusCode: status}}
+		if problemType != "" {
+			he.Problem = &acmeapi.Problem{Type: "urn:ietf:params:acme:error:" + problemType}
+		}
+		return he
+	}
+
+	serverError := httpError(500, "")
+	unreachable := &url.Error{Op: "Get", URL: "https://ca.example.com/directory", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	unauthorized := httpError(403, "unauthorized")
+
+	tests := []struct {
+		err      error
+		failover bool
+	}{
+		{serverError, true},
+		{httpError(503, ""), true},
+		{httpError(429, ""), true},
+		{httpError(400, "rateLimited"), true},
+		{httpError(400, "serverInternal"), true},
+		{unauthorized, false},
+		{httpError(400, "invalidProfile"), false},
+		{unreachable, true},
+		{errors.New("authorization failed"), false},
+
+		// Wrapped errors are classified by the error they wrap.
+		{fmt.Errorf("cannot create order: %w", serverError), true},
+		{fmt.Errorf("cannot create order: %w", unauthorized), false},
+		{util.NewWrapError(unreachable, "cannot create order"), true},
+		{util.NewWrapError(util.MultiError{serverError, unreachable}, "authorization failed"), true},
+
+		// Every error must be one to fail over for.
+		{util.MultiError{serverError, unreachable}, true},
+		{util.MultiError{serverError, unauthorized}, false},
+		{util.MultiError{}, false},
+
+		// Cancellation is reported by the HTTP client as a URL error.
+		{&url.Error{Op: "Get", URL: "https://ca.example.com/directory", Err: context.Canceled}, false},
+	}
+
+	for i, test := range tests {
+		if isFailoverError(test.err) != test.failover {
+			t.Fatalf("%d: isFailoverError(%v) != %v", i, test.err, test.failover)
+		}
+	}
+}
+
+// The account for a fallback provider is selected by the label of the
+// account of the target, whether it is selected by label or by ID.
+func TestFallbackAccountLabel(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	labelled := &storage.Account{
+		PrivateKey:   newTestKey(t),
+		DirectoryURL: "https://ca.example.com/directory",
+		Label:        "customer",
+	}
+	unlabelled := &storage.Account{
+		PrivateKey:   newTestKey(t),
+		DirectoryURL: "https://ca.example.com/directory",
+	}
+	for _, a := range []*storage.Account{labelled, unlabelled} {
+		err := s.SaveAccount(a)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		account     *storage.Account
+		accountName string
+		label       string
+	}{
+		{labelled, "", "customer"},
+		{unlabelled, "", ""},
+		{nil, labelled.ID(), "customer"},
+		{nil, unlabelled.ID(), ""},
+		{nil, "customer", "customer"},
+		{nil, "", ""},
+	}
+
+	r := makeReconcile(s, ReconcileConfig{})
+	for i, test := range tests {
+		tr := &storage.TargetRequest{Account: test.account, AccountName: test.accountName}
+		if label := r.fallbackAccountLabel(tr); label != test.label {
+			t.Fatalf("%d: got label %q, expected %q", i, label, test.label)
+		}
+	}
+}
+
+// A target selects an account by label or ID, and a target which does not
+// select an account never uses a labelled account.
+func TestGetRequestAccount(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	const ca1, ca2 = "https://ca1.example.com/directory", "https://ca2.example.com/directory"
+	s.DefaultTarget().Request.Provider = ca1
+	err := s.SaveTarget(s.DefaultTarget())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	customer := &storage.Account{PrivateKey: newTestKey(t), DirectoryURL: ca1, Label: "customer"}
+	other := &storage.Account{PrivateKey: newTestKey(t), DirectoryURL: ca2, Label: "other"}
+	unlabelled := &storage.Account{PrivateKey: newTestKey(t), DirectoryURL: ca1}
+	for _, a := range []*storage.Account{customer, other, unlabelled} {
+		err := s.SaveAccount(a)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	r := makeReconcile(s, ReconcileConfig{})
+	tests := []struct {
+		provider, accountName string
+		expected              *storage.Account
+	}{
+		{ca1, "customer", customer},
+		{ca1, customer.ID(), customer},
+		{"", "customer", customer},
+		{"", "other", other},
+		{"", other.ID(), other},
+		{ca1, "", unlabelled},
+		{"", "", unlabelled},
+	}
+
+	for i, test := range tests {
+		a, err := r.getRequestAccount(&storage.TargetRequest{Provider: test.provider, AccountName: test.accountName})
+		if err != nil {
+			t.Fatalf("%d: error: %v", i, err)
+		}
+
+		if a.ID() != test.expected.ID() {
+			t.Fatalf("%d: got account %v, expected %v", i, a, test.expected)
+		}
+	}
+
+	// An account selected by ID must be for the provider of the target.
+	_, err = r.getRequestAccount(&storage.TargetRequest{Provider: ca2, AccountName: customer.ID()})
+	if err == nil || !strings.Contains(err.Error(), "is for provider") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The only account for the provider is labelled, so an unlabelled account
+	// is created.
+	a, err := r.getRequestAccount(&storage.TargetRequest{Provider: ca2})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if a.Label != "" || a.DirectoryURL != ca2 {
+		t.Fatalf("unexpected account: %v", a)
+	}
+
+	// An account with a new label is created for the provider.
+	a, err = r.getRequestAccount(&storage.TargetRequest{Provider: ca2, AccountName: "customer"})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if a.Label != "customer" || a.DirectoryURL != ca2 {
+		t.Fatalf("unexpected account: %v", a)
+	}
+}
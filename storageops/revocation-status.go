@@ -0,0 +1,280 @@
+package storageops
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"github.com/hlandau/acmetool/storage"
+	"github.com/hlandau/acmetool/util"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long to wait for a CRL to be downloaded.
+const crlTimeout = 60 * time.Second
+
+// CRLs larger than this are rejected.
+const crlMaxSize = 64 * 1024 * 1024
+
+// If a CRL does not specify when the next update will be available, it is
+// downloaded again after this interval.
+const crlDefaultRefreshInterval = 24 * time.Hour
+
+// The times at which CRLs are next due to be downloaded are recorded in this
+// file in the conf directory, one per line as an RFC 3339 time followed by
+// the CRL URL.
+const crlScheduleFilename = "crl-schedule"
+
+// Checks whether the CA has revoked any of the preferred certificates, and
+// marks any such certificate as revoked. A certificate marked as revoked
+// satisfies no target, so replacements are subsequently requested.
+//
+// OCSP is used where the certificate specifies a responder; otherwise, or if
+// OCSP fails, the CRL distribution points of the certificate are consulted. A
+// certificate with a stored OCSP response which does not yet need refreshing
+// is not checked, and good OCSP responses obtained are stored. As CRLs can be
+// large, a CRL is not downloaded again until its next update is due, and
+// certificates it covers are assumed not to have been revoked until then.
+func (r *reconcile) processRevocationStatus(ctx context.Context) error {
+	var certs []*storage.Certificate
+	seen := map[*storage.Certificate]struct{}{}
+	r.store.VisitPreferredCertificates(func(hostname string, c *storage.Certificate) error {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			certs = append(certs, c)
+		}
+		return nil
+	})
+
+	// CRLs are usually shared by many certificates.
+	crls := map[string]*x509.RevocationList{}
+	crlSchedule := loadCRLSchedule(r.store)
+
+	var merr util.MultiError
+	for _, c := range certs {
+		if c.Revoked || len(c.Certificates) < 2 {
+			continue
+		}
+
+		revoked, err := r.isRevokedByCA(ctx, c, crls, crlSchedule)
+		if err != nil {
+			merr = append(merr, fmt.Errorf("failed to determine revocation status of %v: %v", c, err))
+			continue
+		}
+
+		if !revoked {
+			continue
+		}
+
+		err = r.markRevokedByCA(c)
+		if err != nil {
+			merr = append(merr, err)
+		}
+	}
+
+	if len(crls) > 0 {
+		err := saveCRLSchedule(r.store, crlSchedule)
+		if err != nil {
+			merr = append(merr, fmt.Errorf("failed to save CRL schedule: %v", err))
+		}
+	}
+
+	if len(merr) > 0 {
+		return merr
+	}
+
+	return nil
+}
+
+func (r *reconcile) isRevokedByCA(ctx context.Context, c *storage.Certificate, crls map[string]*x509.RevocationList, crlSchedule map[string]time.Time) (bool, error) {
+	leaf, err := x509.ParseCertificate(c.Certificates[0])
+	if err != nil {
+		return false, err
+	}
+
+	issuer, err := x509.ParseCertificate(c.Certificates[1])
+	if err != nil {
+		return false, err
+	}
+
+	if len(leaf.OCSPServer) > 0 {
+		// Only responses indicating that the certificate is good are stored.
+		if len(c.OCSPResponse) > 0 && !OCSPResponseNeedsRefreshing(c.OCSPResponse, leaf, issuer) {
+			return false, nil
+		}
+
+		der, res, err := fetchOCSPResponse(ctx, leaf, issuer)
+		switch {
+		case err != nil:
+			log.Warnf("%v: cannot determine revocation status via OCSP, trying CRL: %v", c, err)
+		case res.Status == ocsp.Revoked:
+			return true, nil
+		case res.Status == ocsp.Good:
+			_, err := r.storeOCSPResponse(c, der, res)
+			return false, err
+		default:
+			log.Warnf("%v: OCSP responder does not know certificate status, trying CRL", c)
+		}
+	}
+
+	if len(leaf.CRLDistributionPoints) == 0 {
+		if len(leaf.OCSPServer) == 0 {
+			log.Debugf("%v specifies neither an OCSP responder nor a CRL distribution point", c)
+			return false, nil
+		}
+
+		return false, fmt.Errorf("OCSP failed and no CRL distribution point is specified")
+	}
+
+	var merr util.MultiError
+	for _, u := range leaf.CRLDistributionPoints {
+		crl, ok := crls[u]
+		if !ok {
+			if next, ok := crlSchedule[u]; ok && storage.InternalClock.Now().Before(next) {
+				log.Debugf("%v: CRL %q is not due to be downloaded again until %v", c, u, next)
+				return false, nil
+			}
+
+			crl, err = fetchCRL(ctx, u, issuer)
+			if err != nil {
+				merr = append(merr, fmt.Errorf("CRL %q: %v", u, err))
+				continue
+			}
+
+			crls[u] = crl
+			crlSchedule[u] = crlNextDownloadTime(crl)
+		}
+
+		for _, rc := range crl.RevokedCertificateEntries {
+			if rc.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	return false, merr
+}
+
+// Returns the time at which a CRL is next due to be downloaded.
+func crlNextDownloadTime(crl *x509.RevocationList) time.Time {
+	now := storage.InternalClock.Now()
+	if crl.NextUpdate.After(now) {
+		return crl.NextUpdate
+	}
+
+	return now.Add(crlDefaultRefreshInterval)
+}
+
+func loadCRLSchedule(s storage.Store) map[string]time.Time {
+	schedule := map[string]time.Time{}
+	b, err := s.ReadMiscellaneousConfFile(crlScheduleFilename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errore(err, "cannot read CRL schedule")
+		}
+		return schedule
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, fields[0])
+		if err == nil {
+			schedule[fields[1]] = t
+		}
+	}
+
+	return schedule
+}
+
+// Saves the CRL schedule, omitting CRLs which are already due.
+func saveCRLSchedule(s storage.Store, schedule map[string]time.Time) error {
+	now := storage.InternalClock.Now()
+
+	var lines []string
+	for u, t := range schedule {
+		if t.After(now) {
+			lines = append(lines, t.UTC().Format(time.RFC3339)+" "+u+"\n")
+		}
+	}
+
+	sort.Strings(lines)
+	return s.WriteMiscellaneousConfFile(crlScheduleFilename, []byte(strings.Join(lines, "")))
+}
+
+// Marks a certificate which the CA has revoked as revoked.
+func (r *reconcile) markRevokedByCA(c *storage.Certificate) error {
+	log.Warnf("%v has been revoked by the CA; it will be replaced", c)
+
+	c.Revoked = true
+	err := r.store.SaveCertificate(c)
+	if err != nil {
+		return fmt.Errorf("failed to mark %v as revoked: %v", c, err)
+	}
+
+	return nil
+}
+
+// Downloads a CRL and verifies that it was signed by issuer.
+func fetchCRL(ctx context.Context, u string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return nil, fmt.Errorf("unsupported CRL URL")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, crlTimeout)
+	defer cancel()
+
+	hreq, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hreq = hreq.WithContext(ctx)
+
+	cl := InternalHTTPClient
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+
+	hres, err := cl.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hres.Body.Close()
+
+	if hres.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %d", hres.StatusCode)
+	}
+
+	der, err := ioutil.ReadAll(io.LimitReader(hres.Body, crlMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, err
+	}
+
+	err = crl.CheckSignatureFrom(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if !crl.NextUpdate.IsZero() && !storage.InternalClock.Now().Before(crl.NextUpdate) {
+		log.Warnf("CRL %q is stale (next update %v)", u, crl.NextUpdate)
+	}
+
+	return crl, nil
+}
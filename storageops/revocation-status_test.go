@@ -0,0 +1,161 @@
+package storageops
+
+import (
+	"context"
+	"github.com/hlandau/acmetool/acmetest"
+	"github.com/hlandau/acmetool/storage"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the CRL schedule stored in the conf directory, checking that it
+// lists only the CRL of srv.
+func testCRLSchedule(t *testing.T, s storage.Store, srv *acmetest.Server) time.Time {
+	b, err := s.ReadMiscellaneousConfFile(crlScheduleFilename)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || fields[1] != srv.CRLURL() || !strings.HasSuffix(string(b), "\n") {
+		t.Fatalf("unexpected CRL schedule: %q", b)
+	}
+
+	next, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return next
+}
+
+func testRevoked(t *testing.T, s storage.Store, certs ...*storage.Certificate) []bool {
+	err := s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	var revoked []bool
+	for _, c := range certs {
+		revoked = append(revoked, s.CertificateByID(c.ID()).Revoked)
+	}
+
+	return revoked
+}
+
+// A CRL is not downloaded again until its next update is due, as recorded in
+// the CRL schedule, and certificates it lists are marked as revoked.
+func TestProcessRevocationStatusCRL(t *testing.T) {
+	srv, fc, stop := newTestStatusServer(t, acmetest.Config{CRL: true})
+	defer stop()
+
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	c1 := issueTestCertificate(t, s, srv, []string{"example.com"})
+	c2 := issueTestCertificate(t, s, srv, []string{"example.net"})
+
+	err := makeReconcile(s, ReconcileConfig{}).processRevocationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The CRLs of the server are valid for four days.
+	next := testCRLSchedule(t, s, srv)
+	if d := next.Sub(fc.Now()); d < 4*24*time.Hour-time.Minute || d > 4*24*time.Hour+time.Minute {
+		t.Fatalf("CRL scheduled to be downloaded after %v", d)
+	}
+
+	if r := testRevoked(t, s, c1, c2); r[0] || r[1] {
+		t.Fatalf("certificates marked as revoked: %v", r)
+	}
+
+	// A revocation is not detected until the CRL is next due to be downloaded.
+	err = srv.Revoke(c1.Certificates[0], 1)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	fc.Set(next.Add(-time.Minute))
+	err = makeReconcile(s, ReconcileConfig{}).processRevocationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if r := testRevoked(t, s, c1, c2); r[0] || r[1] {
+		t.Fatalf("CRL downloaded before it was due: %v", r)
+	}
+
+	if !testCRLSchedule(t, s, srv).Equal(next) {
+		t.Fatalf("CRL schedule changed before the CRL was due")
+	}
+
+	fc.Set(next.Add(time.Minute))
+	err = makeReconcile(s, ReconcileConfig{}).processRevocationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if r := testRevoked(t, s, c1, c2); !r[0] || r[1] {
+		t.Fatalf("unexpected revocation status: %v", r)
+	}
+
+	// The next update of the CRL downloaded has already passed according to
+	// the clock, so it is downloaded again a day later.
+	if next := testCRLSchedule(t, s, srv); !next.Equal(fc.Now().Add(crlDefaultRefreshInterval).Truncate(time.Second)) {
+		t.Fatalf("CRL scheduled to be downloaded at %v", next)
+	}
+}
+
+// OCSP is preferred over the CRL, and a revocation is detected when the
+// stored OCSP response needs refreshing.
+func TestProcessRevocationStatusOCSP(t *testing.T) {
+	srv, fc, stop := newTestStatusServer(t, acmetest.Config{OCSP: true, CRL: true})
+	defer stop()
+
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	c1 := issueTestCertificate(t, s, srv, []string{"example.com"})
+	c2 := issueTestCertificate(t, s, srv, []string{"example.net"})
+
+	err := makeReconcile(s, ReconcileConfig{}).processRevocationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	storedOCSPResponse(t, s, c1, srv.CACertificate())
+	storedOCSPResponse(t, s, c2, srv.CACertificate())
+
+	_, err = s.ReadMiscellaneousConfFile(crlScheduleFilename)
+	if !os.IsNotExist(err) {
+		t.Fatalf("CRL downloaded although OCSP succeeded: %v", err)
+	}
+
+	err = srv.Revoke(c1.Certificates[0], 1)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The stored responses are fresh.
+	err = makeReconcile(s, ReconcileConfig{}).processRevocationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if r := testRevoked(t, s, c1, c2); r[0] || r[1] {
+		t.Fatalf("revocation status checked with fresh OCSP response: %v", r)
+	}
+
+	fc.Set(time.Now().Add(3 * 24 * time.Hour))
+	err = makeReconcile(s, ReconcileConfig{}).processRevocationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if r := testRevoked(t, s, c1, c2); !r[0] || r[1] {
+		t.Fatalf("unexpected revocation status: %v", r)
+	}
+}
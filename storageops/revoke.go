@@ -4,42 +4,136 @@ import (
 	"fmt"
 	"github.com/hlandau/acmetool/storage"
 	"github.com/hlandau/acmetool/util"
+	"sort"
+	"strings"
 )
 
-func RevokeByCertificateOrKeyID(s storage.Store, id string) error {
-	c := s.CertificateByID(id)
-	if c == nil {
-		return revokeByKeyID(s, id)
+// RFC 5280 revocation reason codes which may be given when requesting
+// revocation via ACME.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"removeFromCRL":        8,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+// Revocation reason code for key compromise.
+const RevocationReasonKeyCompromise = 1
+
+// Parses a revocation reason name such as "keyCompromise" (case
+// insensitively) into its reason code.
+func ParseRevocationReason(name string) (int, error) {
+	for k, v := range revocationReasons {
+		if strings.EqualFold(k, name) {
+			return v, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown revocation reason %q, must be one of: %s", name, strings.Join(RevocationReasonNames(), ", "))
+}
+
+// Returns the names of the supported revocation reasons.
+func RevocationReasonNames() []string {
+	var names []string
+	for k := range revocationReasons {
+		names = append(names, k)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return revocationReasons[names[i]] < revocationReasons[names[j]]
+	})
+	return names
+}
+
+// Returns the name of a revocation reason code, or the code itself if it is
+// not known.
+func RevocationReasonName(reason int) string {
+	for k, v := range revocationReasons {
+		if v == reason {
+			return k
+		}
 	}
 
+	return fmt.Sprintf("%d", reason)
+}
+
+// Marks a certificate for revocation with the given reason code. The
+// revocation is requested when next reconciling.
+func MarkForRevocation(s storage.Store, c *storage.Certificate, reason int) error {
 	if c.Revoked {
 		log.Warnf("%v already revoked", c)
 		return nil
 	}
 
+	if c.External {
+		return fmt.Errorf("%v is an external certificate and cannot be revoked via ACME", c)
+	}
+
 	c.RevocationDesired = true
+	c.RevocationReason = reason
 	return s.SaveCertificate(c)
 }
 
-func revokeByKeyID(s storage.Store, keyID string) error {
+// Returns all known certificates using the given key.
+func CertificatesUsingKey(s storage.Store, k *storage.Key) []*storage.Certificate {
+	var certs []*storage.Certificate
+	s.VisitCertificates(func(c *storage.Certificate) error {
+		if c.Key == k {
+			certs = append(certs, c)
+		}
+		return nil
+	})
+	return certs
+}
+
+// Handles the compromise of a private key. All known certificates using the
+// key are marked for revocation with reason keyCompromise, and the key is
+// added to the compromised key list so that it is never used again. Targets
+// which were satisfied by those certificates will no longer be satisfied, so
+// the caller should subsequently reconcile, which requests revocation, obtains
+// replacement certificates using new keys and relinks.
+func CompromiseKey(s storage.Store, keyID string) error {
+	var err error
+	if s.KeyByID(keyID) != nil {
+		err = revokeByKeyID(s, keyID, RevocationReasonKeyCompromise)
+		log.Errore(err, "failed to mark all certificates using compromised key for revocation")
+	} else {
+		log.Warnf("key %q is not known, adding it to the compromised key list only", keyID)
+	}
+
+	// Block the key even if some certificates could not be marked.
+	err2 := s.MarkKeyCompromised(keyID)
+	if err2 != nil {
+		return err2
+	}
+
+	return err
+}
+
+func revokeByKeyID(s storage.Store, keyID string, reason int) error {
 	k := s.KeyByID(keyID)
 	if k == nil {
 		return fmt.Errorf("cannot find certificate or key with given ID: %q", keyID)
 	}
 
 	var merr util.MultiError
-	s.VisitCertificates(func(c *storage.Certificate) error {
-		if c.Key != k {
-			return nil // continue
+	for _, c := range CertificatesUsingKey(s, k) {
+		if c.External {
+			log.Warnf("%v uses key %v but is an external certificate and cannot be revoked via ACME", c, k)
+			continue
 		}
 
-		err := RevokeByCertificateOrKeyID(s, c.ID())
+		err := MarkForRevocation(s, c, reason)
 		if err != nil {
 			merr = append(merr, fmt.Errorf("failed to mark %v for revocation: %v", c, err))
 		}
-
-		return nil
-	})
+	}
 
 	if len(merr) > 0 {
 		return merr
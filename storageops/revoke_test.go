@@ -0,0 +1,137 @@
+package storageops
+
+import (
+	"crypto"
+	"crypto/x509"
+	"github.com/hlandau/acmetool/storage"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Creates a store in a temporary directory. The returned function removes it.
+func newTestStore(t *testing.T) (storage.Store, func()) {
+	dir, err := ioutil.TempDir("", "acmetool-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := storage.NewFDB(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("error: %v", err)
+	}
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// Stores a certificate issued by ca for the given names using the public key
+// of key, which is imported if it is not already. The store is reloaded so
+// that the certificate is linked to its key.
+func newTestStoredCertificate(t *testing.T, s storage.Store, ca *testCA, key crypto.Signer, names []string) *storage.Certificate {
+	return storeTestCertificate(t, s, ca, key, newTestCertificate(t, ca, key, names, false))
+}
+
+// Stores the certificate cert issued by ca using the public key of key, as
+// for newTestStoredCertificate.
+func storeTestCertificate(t *testing.T, s storage.Store, ca *testCA, key crypto.Signer, cert *x509.Certificate) *storage.Certificate {
+	return storeTestChain(t, s, key, [][]byte{cert.Raw, ca.cert.Raw})
+}
+
+// Stores a certificate with the given DER-encoded chain, the first element of
+// which uses the public key of key, as for newTestStoredCertificate.
+func storeTestChain(t *testing.T, s storage.Store, key crypto.Signer, chain [][]byte) *storage.Certificate {
+	_, err := s.ImportKey(key)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	acct, err := s.ImportAccount("https://ca.example.com/directory", newTestKey(t))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c, err := s.ImportCertificate(acct, "https://ca.example.com/cert/"+cert.SerialNumber.String())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c.Certificates = chain
+	c.Cached = true
+	err = s.SaveCertificate(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return s.CertificateByID(c.ID())
+}
+
+// If revoking the certificates using a compromised key fails, the key remains
+// available to sign the revocation request when it is retried, but the
+// certificates no longer satisfy any target.
+func TestCompromiseKeyRetry(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	ca := newTestCA(t, "CA", nil, nil)
+	key := newTestKey(t)
+	c := newTestStoredCertificate(t, s, ca, key, []string{"example.com"})
+	keyID := c.Key.ID
+
+	tgt := &storage.Target{}
+	tgt.Satisfy.Names = []string{"example.com"}
+	if !DoesCertificateSatisfy(c, tgt) {
+		t.Fatalf("certificate does not satisfy target")
+	}
+
+	for i := 0; i < 2; i++ {
+		err := CompromiseKey(s, keyID)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		// The revocation request has not yet been made, as when it fails.
+		err = s.Reload()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		c = s.CertificateByID(c.ID())
+		if !c.RevocationDesired || c.RevocationReason != RevocationReasonKeyCompromise {
+			t.Fatalf("certificate not marked for revocation for key compromise")
+		}
+
+		if c.Key == nil || c.Key.ID != keyID || !c.Key.Compromised {
+			t.Fatalf("compromised key not available for revocation: %v", c.Key)
+		}
+
+		if DoesCertificateSatisfy(c, tgt) {
+			t.Fatalf("certificate using compromised key satisfies target")
+		}
+	}
+
+	c.Revoked = true
+	err := s.SaveCertificate(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if s.KeyByID(keyID) != nil {
+		t.Fatalf("compromised key loaded after revocation")
+	}
+}
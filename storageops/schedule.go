@@ -0,0 +1,122 @@
+package storageops
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/hlandau/acmetool/storage"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The times of recent reconciliations are recorded in this file in the conf
+// directory, one per line in RFC 3339 format, oldest first.
+const reconcileHistoryFilename = "reconcile-history"
+
+// The number of reconciliation times recorded.
+const reconcileHistoryLength = 8
+
+// Records the time of a reconciliation so that the interval at which
+// reconciliation is run (e.g. by cron) can be determined.
+func recordReconcileTime(s storage.Store, t time.Time) error {
+	times := reconcileTimes(s)
+	times = append(times, t)
+	if len(times) > reconcileHistoryLength {
+		times = times[len(times)-reconcileHistoryLength:]
+	}
+
+	var lines []string
+	for _, t := range times {
+		lines = append(lines, t.UTC().Format(time.RFC3339))
+	}
+
+	return s.WriteMiscellaneousConfFile(reconcileHistoryFilename, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+func reconcileTimes(s storage.Store) []time.Time {
+	b, err := s.ReadMiscellaneousConfFile(reconcileHistoryFilename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errore(err, "cannot read reconciliation history")
+		}
+		return nil
+	}
+
+	var times []time.Time
+	for _, line := range strings.Split(string(b), "\n") {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(line))
+		if err == nil {
+			times = append(times, t)
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	return times
+}
+
+// Estimates the interval at which reconciliation runs as the median gap
+// between recent reconciliations, including the time since the most recent
+// one, so that a single missed or manual run does not skew it. Returns false
+// if there is not enough history to tell.
+func ReconcileInterval(s storage.Store) (time.Duration, bool) {
+	times := reconcileTimes(s)
+	if len(times) < 2 {
+		return 0, false
+	}
+
+	times = append(times, storage.InternalClock.Now())
+
+	var gaps []time.Duration
+	for i := 1; i < len(times); i++ {
+		gaps = append(gaps, times[i].Sub(times[i-1]))
+	}
+
+	sort.Slice(gaps, func(i, j int) bool {
+		return gaps[i] < gaps[j]
+	})
+
+	n := len(gaps)
+	if n%2 == 0 {
+		return (gaps[n/2-1] + gaps[n/2]) / 2, true
+	}
+
+	return gaps[n/2], true
+}
+
+// Checks whether reconciliation runs often enough to renew the best
+// certificate for each target in time. A certificate should have at least
+// two opportunities to be renewed between its renewal time and its expiry.
+// Returns a description of each problem found.
+func CheckReconcileInterval(s storage.Store) []string {
+	interval, ok := ReconcileInterval(s)
+	if !ok {
+		return nil
+	}
+
+	var warnings []string
+	s.VisitTargets(func(t *storage.Target) error {
+		for _, tv := range t.KeyTypeVariants() {
+			c, err := FindBestCertificateSatisfying(s, tv)
+			if err != nil {
+				continue
+			}
+
+			cc, err := x509.ParseCertificate(c.Certificates[0])
+			if err != nil {
+				continue
+			}
+
+			span := renewSpan(cc.NotBefore, cc.NotAfter, tv)
+			if interval > span/2 {
+				warnings = append(warnings, fmt.Sprintf("%v: %v must be renewed within %v of expiry, but reconciliation only runs about every %v; run acmetool reconcile more often (e.g. hourly)",
+					t, c, span.Round(time.Minute), interval.Round(time.Minute)))
+			}
+		}
+		return nil
+	})
+
+	return warnings
+}
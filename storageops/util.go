@@ -47,7 +47,18 @@ func targetGt(a *storage.Target, b *storage.Target) bool {
 // emails at 19 days, so...
 const defaultRenewalMarginDays = 30
 
+// Certificates valid for no longer than this are considered short-lived.
+const shortLivedValidityPeriod = 10 * 24 * time.Hour
+
 func renewTime(notBefore, notAfter time.Time, t *storage.Target) time.Time {
+	return notAfter.Add(-renewSpan(notBefore, notAfter, t))
+}
+
+// Returns how long before expiry a certificate should be renewed. This is a
+// third of the validity period, up to the renewal margin. Short-lived
+// certificates are renewed halfway through their validity period instead, so
+// that there is time to retry if renewal fails.
+func renewSpan(notBefore, notAfter time.Time, t *storage.Target) time.Duration {
 	renewalMarginDays := defaultRenewalMarginDays
 	if t.Satisfy.Margin > 0 {
 		renewalMarginDays = t.Satisfy.Margin
@@ -57,11 +68,15 @@ func renewTime(notBefore, notAfter time.Time, t *storage.Target) time.Time {
 
 	validityPeriod := notAfter.Sub(notBefore)
 	renewSpan := validityPeriod / 3
+	if validityPeriod <= shortLivedValidityPeriod {
+		renewSpan = validityPeriod / 2
+	}
+
 	if renewSpan > renewalMargin {
 		renewSpan = renewalMargin
 	}
 
-	return notAfter.Add(-renewSpan)
+	return renewSpan
 }
 
 func signatureAlgorithmFromKey(pk crypto.PrivateKey) (x509.SignatureAlgorithm, error) {
@@ -88,6 +103,16 @@ func generateKey(trk *storage.TargetRequestKey) (pk crypto.PrivateKey, err error
 	return
 }
 
+// Returns true iff the key is of the type a target requests.
+func keyMatchesRequest(k *storage.Key, trk *storage.TargetRequestKey) bool {
+	keyType := trk.Type
+	if keyType == "" {
+		keyType = "rsa"
+	}
+
+	return k.Type() == keyType
+}
+
 // Error associated with a specific target, for clarity of error messages.
 type TargetSpecificError struct {
 	Target *storage.Target
@@ -0,0 +1,197 @@
+package storageops
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/hlandau/acmetool/storage"
+	"io/ioutil"
+	"strings"
+)
+
+// Value of the trust-store setting which selects the system trust store.
+const trustStoreSystem = "system"
+
+// Parses a downloaded certificate chain, whose first certificate is the end
+// certificate.
+func parseCertificateChain(certs [][]byte) ([]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates were downloaded")
+	}
+
+	var chain []*x509.Certificate
+	for _, der := range certs {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse certificate: %v", err)
+		}
+
+		chain = append(chain, c)
+	}
+
+	return chain, nil
+}
+
+// Checks that a downloaded end certificate is the certificate which was
+// requested. If the CSR used to request the certificate is known, the end
+// certificate must use the public key of the CSR, contain exactly the names
+// requested, and contain the OCSP Must Staple extension if it was requested.
+// Otherwise, the end certificate must use the public key of key, which is nil
+// if the key of the certificate is not known.
+//
+// A certificate which fails these checks can never be used.
+func verifyCertificateMatch(leaf *x509.Certificate, csr *x509.CertificateRequest, key *storage.Key) error {
+	if csr == nil {
+		return verifyCertificateKey(leaf, key)
+	}
+
+	if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("certificate public key does not match the requested key")
+	}
+
+	names := append([]string(nil), csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	err := verifyCertificateNames(leaf, names)
+	if err != nil {
+		return err
+	}
+
+	if requestsMustStaple(csr.Extensions) && !requestsMustStaple(leaf.Extensions) {
+		return fmt.Errorf("certificate does not contain the requested OCSP Must Staple extension")
+	}
+
+	return nil
+}
+
+// Checks that a downloaded certificate chain builds from the end certificate
+// to one of roots, as loaded by loadTrustStore. If roots is nil, the chain
+// need only build to its topmost certificate.
+func verifyCertificateChain(chain []*x509.Certificate, roots *x509.CertPool) error {
+	if roots == nil {
+		if len(chain) < 2 {
+			return nil
+		}
+
+		roots = x509.NewCertPool()
+		roots.AddCert(chain[len(chain)-1])
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   storage.InternalClock.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate chain does not verify: %v", err)
+	}
+
+	return nil
+}
+
+// The certificate must use the public key of key, so that a certificate is
+// never saved without its private key.
+func verifyCertificateKey(leaf *x509.Certificate, key *storage.Key) error {
+	if key == nil {
+		return fmt.Errorf("certificate public key does not match any known private key")
+	}
+
+	signer, ok := key.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type: %T", key.PrivateKey)
+	}
+
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, spki) {
+		return fmt.Errorf("certificate public key does not match %v", key)
+	}
+
+	return nil
+}
+
+// The names on the certificate must be exactly the names requested.
+func verifyCertificateNames(leaf *x509.Certificate, names []string) error {
+	requested := map[string]struct{}{}
+	for _, name := range names {
+		requested[strings.ToLower(name)] = struct{}{}
+	}
+
+	issued := map[string]struct{}{}
+	for _, name := range CertificateNames(leaf) {
+		name = strings.ToLower(name)
+		if _, ok := requested[name]; !ok {
+			return fmt.Errorf("certificate contains name which was not requested: %q", name)
+		}
+
+		issued[name] = struct{}{}
+	}
+
+	for name := range requested {
+		if _, ok := issued[name]; !ok {
+			return fmt.Errorf("certificate does not contain requested name: %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Returns true iff the extensions include the TLS Feature extension requesting
+// OCSP Must Staple.
+func requestsMustStaple(exts []pkix.Extension) bool {
+	for _, ext := range exts {
+		if ext.Id.Equal(oidTLSFeature) && bytes.Equal(ext.Value, mustStapleFeatureValue) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a pool of the roots to which certificate chains must build. The
+// trust store is a path to a file of PEM-encoded root certificates, or
+// "system" for the system trust store. If it is empty, nil is returned, and
+// chains need only build to their topmost certificate.
+//
+// An error means the trust store is misconfigured, not that any certificate
+// is bad.
+func loadTrustStore(trustStore string) (*x509.CertPool, error) {
+	switch trustStore {
+	case "":
+		return nil, nil
+
+	case trustStoreSystem:
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("cannot load system trust store: %v", err)
+		}
+
+		return roots, nil
+
+	default:
+		b, err := ioutil.ReadFile(trustStore)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load trust store: %v", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("trust store %q contains no certificates", trustStore)
+		}
+
+		return roots, nil
+	}
+}
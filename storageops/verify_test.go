@@ -0,0 +1,237 @@
+package storageops
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/hlandau/acmetool/storage"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return key
+}
+
+// Issues an end certificate for the given names, which may include IP
+// addresses, using the public key of key.
+func newTestCertificate(t *testing.T, ca *testCA, key crypto.Signer, names []string, mustStaple bool) *x509.Certificate {
+	return newTestCertificateValidFor(t, ca, key, names, mustStaple, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+}
+
+// Like newTestCertificate, but with the given validity period.
+func newTestCertificateValidFor(t *testing.T, ca *testCA, key crypto.Signer, names []string, mustStaple bool, notBefore, notAfter time.Time) *x509.Certificate {
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, name)
+		}
+	}
+
+	if mustStaple {
+		tpl.ExtraExtensions = []pkix.Extension{{Id: oidTLSFeature, Value: mustStapleFeatureValue}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return c
+}
+
+func newTestCSR(t *testing.T, key crypto.Signer, names []string, mustStaple bool) *x509.CertificateRequest {
+	tpl := &x509.CertificateRequest{}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, name)
+		}
+	}
+
+	if mustStaple {
+		tpl.ExtraExtensions = []pkix.Extension{{Id: oidTLSFeature, Value: mustStapleFeatureValue}}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, tpl, key)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return csr
+}
+
+func TestVerifyCertificateMatch(t *testing.T) {
+	ca := newTestCA(t, "CA", nil, nil)
+	key, otherKey := newTestKey(t), newTestKey(t)
+	names := []string{"a.example.com", "b.example.com", "192.0.2.1"}
+
+	tests := []struct {
+		csr  *x509.CertificateRequest
+		key  *storage.Key
+		cert *x509.Certificate
+		ok   bool
+	}{
+		{csr: newTestCSR(t, key, names, false), cert: newTestCertificate(t, ca, key, names, false), ok: true},
+		{csr: newTestCSR(t, key, names, false), cert: newTestCertificate(t, ca, key, []string{"B.example.com", "192.0.2.1", "a.example.com"}, false), ok: true},
+		{csr: newTestCSR(t, key, names, true), cert: newTestCertificate(t, ca, key, names, true), ok: true},
+		{csr: newTestCSR(t, key, names, false), cert: newTestCertificate(t, ca, key, names, true), ok: true},
+
+		// Wrong key.
+		{csr: newTestCSR(t, key, names, false), cert: newTestCertificate(t, ca, otherKey, names, false)},
+		// Missing name.
+		{csr: newTestCSR(t, key, names, false), cert: newTestCertificate(t, ca, key, names[:2], false)},
+		// Name not requested.
+		{csr: newTestCSR(t, key, names[:2], false), cert: newTestCertificate(t, ca, key, names, false)},
+		// Missing OCSP Must Staple.
+		{csr: newTestCSR(t, key, names, true), cert: newTestCertificate(t, ca, key, names, false)},
+
+		// Without a CSR, only the key is checked.
+		{key: &storage.Key{PrivateKey: key}, cert: newTestCertificate(t, ca, key, names, false), ok: true},
+		{key: &storage.Key{PrivateKey: otherKey}, cert: newTestCertificate(t, ca, key, names, false)},
+		{cert: newTestCertificate(t, ca, key, names, false)},
+	}
+
+	for i, test := range tests {
+		err := verifyCertificateMatch(test.cert, test.csr, test.key)
+		if test.ok && err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		} else if !test.ok && err == nil {
+			t.Fatalf("%d: expected verification to fail", i)
+		}
+	}
+}
+
+func TestVerifyCertificateChain(t *testing.T) {
+	root := newTestCA(t, "Root", nil, nil)
+	intermediate := newTestCA(t, "Intermediate", nil, root)
+	otherRoot := newTestCA(t, "Other Root", nil, nil)
+
+	key := newTestKey(t)
+	leaf := newTestCertificate(t, intermediate, key, []string{"example.com"}, false)
+	otherLeaf := newTestCertificate(t, otherRoot, key, []string{"example.com"}, false)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	tests := []struct {
+		chain []*x509.Certificate
+		roots *x509.CertPool
+		ok    bool
+	}{
+		{chain: []*x509.Certificate{leaf}, ok: true},
+		{chain: []*x509.Certificate{leaf, intermediate.cert}, ok: true},
+		{chain: []*x509.Certificate{leaf, intermediate.cert, root.cert}, ok: true},
+		{chain: []*x509.Certificate{leaf, intermediate.cert}, roots: roots, ok: true},
+
+		// The chain does not build to its topmost certificate.
+		{chain: []*x509.Certificate{leaf, otherRoot.cert}},
+		// The chain does not build to the trust store.
+		{chain: []*x509.Certificate{leaf}, roots: roots},
+		{chain: []*x509.Certificate{otherLeaf, otherRoot.cert}, roots: roots},
+	}
+
+	for i, test := range tests {
+		err := verifyCertificateChain(test.chain, test.roots)
+		if test.ok && err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		} else if !test.ok && err == nil {
+			t.Fatalf("%d: expected verification to fail", i)
+		}
+	}
+}
+
+func TestParseCertificateChain(t *testing.T) {
+	ca := newTestCA(t, "CA", nil, nil)
+
+	_, err := parseCertificateChain(nil)
+	if err == nil {
+		t.Fatalf("empty chain parsed")
+	}
+
+	_, err = parseCertificateChain([][]byte{[]byte("garbage")})
+	if err == nil {
+		t.Fatalf("corrupt chain parsed")
+	}
+
+	chain, err := parseCertificateChain([][]byte{ca.cert.Raw})
+	if err != nil || len(chain) != 1 || !chain[0].Equal(ca.cert) {
+		t.Fatalf("chain not parsed: %v", err)
+	}
+}
+
+func TestLoadTrustStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmetool-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "CA", nil, nil)
+	rootsFile := filepath.Join(dir, "roots.pem")
+	err = ioutil.WriteFile(rootsFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	emptyFile := filepath.Join(dir, "empty.pem")
+	err = ioutil.WriteFile(emptyFile, []byte("not a certificate\n"), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	roots, err := loadTrustStore("")
+	if err != nil || roots != nil {
+		t.Fatalf("unexpected trust store for empty setting: %v, %v", roots, err)
+	}
+
+	roots, err = loadTrustStore(rootsFile)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	leaf := newTestCertificate(t, ca, newTestKey(t), []string{"example.com"}, false)
+	err = verifyCertificateChain([]*x509.Certificate{leaf}, roots)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, trustStore := range []string{filepath.Join(dir, "missing.pem"), emptyFile} {
+		_, err = loadTrustStore(trustStore)
+		if err == nil {
+			t.Fatalf("misconfigured trust store %q loaded", trustStore)
+		}
+	}
+}
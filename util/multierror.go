@@ -35,6 +35,11 @@ func (werr *WrapError) Error() string {
 	return fmt.Sprintf("%s [due to inner error: %v]", werr.Msg, werr.Sub)
 }
 
+// Returns the wrapped error, for errors.Is and errors.As.
+func (werr *WrapError) Unwrap() error {
+	return werr.Sub
+}
+
 // PertError knows whether it's temporary or not.
 type PertError struct {
 	error
@@ -52,6 +57,11 @@ func (e *PertError) Temporary() bool {
 	return e.temporary
 }
 
+// Returns the wrapped error, for errors.Is and errors.As.
+func (e *PertError) Unwrap() error {
+	return e.error
+}
+
 type tmp interface {
 	Temporary() bool
 }